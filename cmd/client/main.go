@@ -2,41 +2,138 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
-	"github.com/xesina/tcp-chat/internal/client"
-	"github.com/xesina/tcp-chat/internal/message"
+	"github.com/xesina/tcp-chat/pkg/chat/client"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const serverPort = 50000
 
 func main() {
-	cl := client.New()
+	var token, name string
+	var creds client.Credentials
+	flag.StringVar(&token, "token", "", "Resume token of an earlier session")
+	flag.StringVar(&name, "name", "", "User name to log in as, the account is created on first use")
+	flag.StringVar(&creds.Username, "user", "", "User name to authenticate as, logs in to its account")
+	flag.StringVar(&creds.Password, "password", "", "Password of -user, read from TCP_CHAT_PASSWORD when empty")
+	flag.StringVar(&creds.Token, "auth-token", "", "Bearer token to authenticate with")
+	flag.BoolVar(&creds.Certificate, "cert-auth", false, "Authenticate with the -tls-cert client certificate")
+
+	var useTLS bool
+	var tlsCA, tlsCert, tlsKey string
+	flag.BoolVar(&useTLS, "tls", false, "Connect using TLS")
+	flag.StringVar(&tlsCA, "tls-ca", "", "PEM CA bundle the server certificate is verified against, the system roots are used when empty")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM client certificate file presented to the server")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM key file of -tls-cert")
+	var keepAlive time.Duration
+	var reconnect bool
+	flag.BoolVar(&reconnect, "reconnect", false, "Reconnect and restore the session when the connection is lost")
+	flag.DurationVar(&keepAlive, "keepalive", client.DefaultKeepAlive, "Interval of the pings keeping the connection alive, 0 disables them")
+	flag.Parse()
+
+	if creds.Password == "" {
+		creds.Password = os.Getenv("TCP_CHAT_PASSWORD")
+	}
+
+	// the prompt shows who comes and goes
+	config := client.Config{
+		Capabilities: []string{protocol.CapFraming, protocol.CapRequestIDs, protocol.CapPresence},
+		KeepAlive:    keepAlive,
+		Reconnect:    reconnect,
+	}
+	if keepAlive == 0 {
+		config.KeepAlive = -1
+	}
+	if useTLS || tlsCA != "" || tlsCert != "" {
+		tlsConfig, err := client.LoadTLSConfig(tlsCA, tlsCert, tlsKey)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		config.TLS = tlsConfig
+	}
+
+	cl := client.NewWithConfig(config)
 	tcpAddr := net.TCPAddr{Port: serverPort}
 
-	err := cl.Connect(&tcpAddr)
+	var err error
+	switch {
+	case creds.Certificate || creds.Token != "" || creds.Username != "":
+		err = cl.ConnectWithCredentials(&tcpAddr, creds)
+		if err == nil && name == "" {
+			// credentials of a user log in already
+			_, name, err = cl.Identity()
+		}
+	default:
+		err = cl.Connect(&tcpAddr)
+	}
 	if err != nil {
 		fmt.Println("connection to server failed: ", err)
 		os.Exit(1)
 	}
 
-	//clientCh := make(chan client.IncomingMessage)
-	//go cl.HandleIncomingMessages(clientCh)
-	//go func() {
-	//	for d := range clientCh {
-	//		fmt.Printf("new message: sender: %d msg:%s\n", d.SenderID, string(d.Body))
-	//	}
-	//}()
+	clientCh := make(chan client.IncomingMessage)
+	go cl.HandleIncomingMessages(clientCh)
+	go func() {
+		for d := range clientCh {
+			if d.Room != "" {
+				fmt.Printf("new message: room: %s sender: %d msg:%s\n", d.Room, d.SenderID, string(d.Body))
+				continue
+			}
+			fmt.Printf("new message: sender: %d msg:%s\n", d.SenderID, string(d.Body))
+		}
+	}()
 
-	id, err := cl.WhoAmI()
-	if err != nil {
-		fmt.Println("WhoAmI message failed:", err)
-		os.Exit(1)
+	presenceCh := make(chan client.PresenceEvent)
+	go cl.HandlePresenceEvents(presenceCh)
+	go func() {
+		for e := range presenceCh {
+			if e.Online {
+				fmt.Println("online:", e.ClientID, e.Name)
+				continue
+			}
+			fmt.Println("offline:", e.ClientID)
+		}
+	}()
+
+	statesCh := make(chan client.StateEvent)
+	go cl.HandleStateChanges(statesCh)
+	go func() {
+		for e := range statesCh {
+			switch e.State {
+			case client.StateReconnecting:
+				fmt.Printf("reconnecting (attempt %d): %s\n", e.Attempt, e.Err)
+			case client.StateConnected:
+				fmt.Println("reconnected")
+			case client.StateClosed:
+				fmt.Println("giving up reconnecting:", e.Err)
+				os.Exit(1)
+			}
+		}
+	}()
+
+	if name != "" {
+		id, err := cl.Login(name)
+		if err != nil {
+			fmt.Println("Login message failed:", err)
+			os.Exit(1)
+		}
+		fmt.Println("logged in as:", name, id)
+	} else {
+		id, token, err := cl.Resume(token)
+		if err != nil {
+			fmt.Println("Resume message failed:", err)
+			os.Exit(1)
+		}
+		fmt.Println("received id:", id)
+		fmt.Println("resume token:", token)
 	}
-	fmt.Println("received id:", id)
 
 	ids, err := cl.ListClientIDs()
 	if err != nil {
@@ -61,36 +158,42 @@ func promptLoop(cl *client.Client) {
 		}
 
 		switch command {
-		case message.IdentityMsg:
-			id, err := cl.WhoAmI()
+		case protocol.IdentityMsg:
+			id, name, err := cl.Identity()
 			if err != nil {
 				fmt.Println("WhoAmI message failed:", err)
-				os.Exit(1)
+				continue
 			}
 
-			fmt.Println("received id:", id)
+			fmt.Println("received id:", id, name)
 
-		case message.ListMsg:
+		case protocol.ListMsg:
 			ids, err := cl.ListClientIDs()
 			if err != nil {
 				fmt.Println("List message failed:", err)
-				os.Exit(1)
+				continue
 			}
 
 			fmt.Println("received ids:", ids)
 
-		case message.SendMsg:
+		case protocol.SendMsg:
 			line, err := r.ReadString('\n')
 			line = strings.TrimSpace(line)
 			if err != nil {
 				panic(err)
 			}
+			room := ""
+			if strings.HasPrefix(line, protocol.RoomPrefix) {
+				room = line[len(protocol.RoomPrefix):]
+			}
 			rr := strings.Split(line, ",")
 			var recipients []uint64
-			for _, id := range rr {
-				i, err := strconv.ParseUint(id, 10, 64)
+			var names []string
+			for _, r := range rr {
+				i, err := strconv.ParseUint(r, 10, 64)
 				if err != nil {
-					panic(err)
+					names = append(names, r)
+					continue
 				}
 				recipients = append(recipients, i)
 			}
@@ -101,10 +204,61 @@ func promptLoop(cl *client.Client) {
 				panic(err)
 			}
 
-			err = cl.SendMsg(recipients, []byte(body))
+			var result *client.SendResult
+			if room != "" {
+				result, err = cl.SendToRoom(room, []byte(body))
+			} else {
+				result, err = cl.SendMsgTo(recipients, names, []byte(body))
+			}
+			if err != nil {
+				fmt.Println("Send message failed:", err)
+				continue
+			}
+			if len(result.Unknown) > 0 {
+				fmt.Println("unknown recipients:", result.Unknown)
+			}
+			if len(result.Failed) > 0 {
+				fmt.Println("delivery failed for:", result.Failed)
+			}
+			if len(result.Queued) > 0 {
+				fmt.Println("queued for offline recipients:", result.Queued)
+			}
+
+		case protocol.JoinMsg, protocol.PartMsg:
+			room, err := r.ReadString('\n')
+			room = strings.TrimSpace(room)
 			if err != nil {
 				panic(err)
 			}
+
+			if command == protocol.JoinMsg {
+				err = cl.Join(room)
+			} else {
+				err = cl.Part(room)
+			}
+			if err != nil {
+				fmt.Println(command, "message failed:", err)
+				continue
+			}
+			fmt.Println("done")
+
+		case protocol.RoomsMsg:
+			rooms, err := cl.Rooms()
+			if err != nil {
+				fmt.Println("Rooms message failed:", err)
+				continue
+			}
+
+			fmt.Println("rooms:", rooms)
+
+		case protocol.PingMsg:
+			rtt, err := cl.Ping()
+			if err != nil {
+				fmt.Println("Ping message failed:", err)
+				continue
+			}
+
+			fmt.Println("pong:", rtt)
 		}
 
 	}
@@ -1,30 +1,196 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"github.com/xesina/tcp-chat/internal/server"
+	"github.com/xesina/tcp-chat/pkg/chat/server"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	var (
-		port  int
-		debug bool
+		port      int
+		debug     bool
+		queueSize int
+		overflow  string
+		storePath string
+		usersPath string
+		passwd    string
+		tokens    string
+
+		idleTimeout     time.Duration
+		shutdownTimeout time.Duration
+
+		logRequests bool
+		rate        float64
+		burst       int
+		limits      server.RateLimits
+
+		maxConns, maxConnsPerIP int
+		allow, deny             string
+
+		metricsAddr string
+
+		tlsCert, tlsKey, tlsClientCA string
+		requireClientCert            bool
 	)
 
 	flag.IntVar(&port, "port", 50000, "Server port")
 	flag.BoolVar(&debug, "debug", false, "Debug mode")
+	flag.IntVar(&queueSize, "queue-size", server.DefaultQueueSize, "Outbound messages buffered per client")
+	flag.StringVar(&overflow, "overflow", server.DropOldest.String(), "What to do when a client queue is full: drop-oldest, drop-new or disconnect")
+	flag.StringVar(&storePath, "store", "", "File keeping the messages of offline clients across restarts, kept in memory when empty")
+	flag.StringVar(&usersPath, "users", "", "File keeping the user accounts across restarts, kept in memory when empty")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 90*time.Second, "Drop connections silent for longer than this, 0 keeps them forever")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "How long to wait for clients to finish on SIGINT or SIGTERM before closing their connections")
+	flag.BoolVar(&logRequests, "log-requests", false, "Log every handled message with the time it took")
+	flag.Float64Var(&rate, "rate", 0, "Messages per second handled for each client, 0 does not limit them")
+	flag.IntVar(&burst, "burst", 20, "Messages a client may send at once before -rate applies")
+	flag.Float64Var(&limits.Commands, "limit-commands", 0, "Messages per second of each client, messages over the limit are rejected with RATE LIMITED, 0 does not limit them")
+	flag.Float64Var(&limits.Bytes, "limit-bytes", 0, "Bytes per second read from each client before its messages are rejected, 0 does not limit them")
+	flag.Float64Var(&limits.Recipients, "limit-recipients", 0, "SEND recipients per minute of each client, 0 does not limit them")
+	flag.IntVar(&limits.Strikes, "limit-strikes", 0, "Rejected messages per minute after which a client is disconnected, 0 never disconnects it")
+
+	flag.IntVar(&maxConns, "max-conns", 0, "Connections served at once, further ones are refused, 0 does not limit them")
+	flag.IntVar(&maxConnsPerIP, "max-conns-per-ip", 0, "Connections served at once from a single address, 0 does not limit them")
+	flag.StringVar(&allow, "allow", "", "Comma separated networks connections are accepted from, like 10.0.0.0/8, any when empty")
+	flag.StringVar(&deny, "deny", "", "Comma separated networks connections are refused from, they win over -allow")
+
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address serving Prometheus metrics over HTTP on /metrics, like localhost:9100, not served when empty")
+
+	flag.StringVar(&passwd, "passwd", "", "htpasswd file with the bcrypt password hashes clients authenticate with")
+	flag.StringVar(&tokens, "tokens", "", "File with the bearer tokens clients authenticate with, one token per line optionally followed by the user name it logs in to")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate file, the server accepts TLS connections only when set")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM key file of -tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "PEM CA bundle client certificates are verified against, verified clients can authenticate with their certificate")
+	flag.BoolVar(&requireClientCert, "tls-require-client-cert", false, "Reject TLS clients without a certificate verified by -tls-client-ca")
 
 	flag.Parse()
 
-	srv := server.New(debug)
-	tcpAddr := net.TCPAddr{Port: port}
+	policy, err := server.ParseOverflowPolicy(overflow)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
 
-	err := srv.Start(&tcpAddr)
+	allowed, err := server.ParseNetworks(allow)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	denied, err := server.ParseNetworks(deny)
 	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	var store server.MessageStore
+	if storePath != "" {
+		store, err = server.OpenFileStore(storePath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var users server.UserStore
+	if usersPath != "" {
+		users, err = server.OpenFileUserStore(usersPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var auth server.Authenticators
+	if passwd != "" {
+		p, err := server.LoadPasswordFile(passwd)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		auth = append(auth, p)
+	}
+	if tokens != "" {
+		t, err := server.LoadBearerTokens(tokens)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		auth = append(auth, t)
+	}
+
+	config := server.Config{
+		Debug:     debug,
+		QueueSize: queueSize,
+		Overflow:  policy,
+		Store:     store,
+		Users:     users,
+
+		IdleTimeout: idleTimeout,
+		Limits:      limits,
+
+		MaxConns:      maxConns,
+		MaxConnsPerIP: maxConnsPerIP,
+		Allow:         allowed,
+		Deny:          denied,
+	}
+	if auth != nil {
+		config.Auth = auth
+	}
+	if tlsCert != "" {
+		config.TLS, err = server.LoadTLSConfig(tlsCert, tlsKey, tlsClientCA, requireClientCert)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	srv := server.NewWithConfig(config)
+	srv.Use(server.Recover())
+	if logRequests {
+		srv.Use(server.Logging())
+	}
+	srv.Use(server.RateLimit(rate, burst))
+	tcpAddr := net.TCPAddr{Port: port}
+
+	if metricsAddr != "" {
+		l, err := net.Listen("tcp", metricsAddr)
+		if err != nil {
+			fmt.Println("serving metrics failed: ", err)
+			os.Exit(1)
+		}
+		go func() {
+			if err := srv.ServeMetrics(l); err != server.ErrServerClosed {
+				fmt.Println("serving metrics failed: ", err)
+			}
+		}()
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		started <- srv.Start(&tcpAddr)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-started:
 		fmt.Println("starting server failed: ", err)
 		os.Exit(1)
+	case sig := <-signals:
+		fmt.Printf("received %s, shutting down\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Println("shutting down server failed: ", err)
+		os.Exit(1)
 	}
 }
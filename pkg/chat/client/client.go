@@ -0,0 +1,950 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IncomingBuffer is the number of delivery receipts and presence events
+// kept by the client until their Handle methods pick them up, once it is
+// full further ones are dropped. Incoming messages are never dropped, they
+// are kept until HandleIncomingMessages picks them up however many there
+// are.
+const IncomingBuffer = 256
+
+// DefaultKeepAlive is the interval of the PING msgs keeping the connection
+// alive when Config.KeepAlive is not set
+const DefaultKeepAlive = 30 * time.Second
+
+// ErrClosed is returned by calls made on, or interrupted by, a closed
+// connection
+var ErrClosed = errors.New("client: connection closed")
+
+// ErrTimeout is returned by calls whose context deadline passed before the
+// response arrived
+var ErrTimeout = errors.New("client: request timed out")
+
+// ErrServer is matched by the errors of calls the server rejected, they
+// hold a *ServerError telling the kind of error
+var ErrServer = errors.New("client: server error")
+
+// ErrRefused is matched by the errors of connections the server refused
+// to serve, they hold a *RefusedError telling why
+var ErrRefused = errors.New("client: connection refused")
+
+// ErrReconnecting is returned by calls made while a reconnecting client
+// has no connection, SEND msgs are queued instead
+var ErrReconnecting = errors.New("client: reconnecting")
+
+// errNoPong is the reason a connection is dropped when the server did not
+// answer a PING within the keepalive interval
+var errNoPong = errors.New("no response to keepalive ping")
+
+// errServerShutdown is the reason a connection is lost after the server
+// announced it is shutting down
+var errServerShutdown = errors.New("server shutting down")
+
+// IncomingMessage represents an incoming msg to a client
+type IncomingMessage struct {
+	SenderID uint64
+	// Room is the room the msg was sent to, it is empty for msgs sent to
+	// the client directly
+	Room string
+	Body []byte
+	// ID is the server assigned msg id, it is only known when acks were
+	// agreed on
+	ID uint64
+}
+
+// DeliveryReceipt tells that a recipient received a msg sent by the client,
+// receipts are only sent when acks were agreed on by both clients
+type DeliveryReceipt struct {
+	MessageID   uint64
+	RecipientID uint64
+}
+
+// PresenceEvent tells that a client came online or went offline, events
+// are only sent when presence was agreed on
+type PresenceEvent struct {
+	ClientID uint64
+	// Name is the user name of logged in clients coming online
+	Name   string
+	Online bool
+}
+
+// SendResult describes the outcome of a SEND msg for every recipient.
+// Servers speaking protocol version 1 only tell that they accepted the msg,
+// all recipients are reported as delivered then.
+type SendResult struct {
+	// MessageID is matched by the MessageID of delivery receipts, it is
+	// zero for protocol version 1
+	MessageID uint64
+	Delivered []uint64
+	Unknown   []uint64
+	Failed    []uint64
+	// Queued recipients are offline and get the msg once they resume
+	Queued []uint64
+}
+
+// Protocol selects how the client talks to the server
+type Protocol int
+
+const (
+	// ProtocolAuto performs the HELLO handshake and uses whatever the
+	// server agrees on, falling back to the line protocol for servers
+	// which predate the handshake
+	ProtocolAuto Protocol = iota
+	// ProtocolLine speaks the line protocol without a handshake
+	ProtocolLine
+	// ProtocolFramed speaks the length-prefixed binary protocol without a
+	// handshake
+	ProtocolFramed
+)
+
+// Config holds the client options
+type Config struct {
+	Protocol Protocol
+	// Capabilities requested during the handshake, framing and request
+	// ids are requested when nil
+	Capabilities []string
+	// TLS makes the client connect using TLS, the server name is taken
+	// from the server address when it is not set
+	TLS *tls.Config
+	// Reconnect makes the client reconnect when the connection is lost,
+	// see Client.Connect
+	Reconnect bool
+	// Backoff paces the reconnect attempts, DefaultBackoff is used when it
+	// is not set
+	Backoff *Backoff
+	// KeepAlive is the interval of the PING msgs sent to the server, the
+	// connection is considered dead and closed when a PING is not answered
+	// within it. DefaultKeepAlive is used when it is not set, a negative
+	// interval disables keepalive.
+	KeepAlive time.Duration
+}
+
+// Credentials authenticate the client with servers requiring it, a
+// connection is authenticated with its TLS client certificate when
+// Certificate is set, with Token when it is set and with Username and
+// Password otherwise
+type Credentials struct {
+	Username    string
+	Password    string
+	Token       string
+	Certificate bool
+}
+
+func (cr Credentials) message() *protocol.Auth {
+	switch {
+	case cr.Certificate:
+		return protocol.NewCertificateAuth()
+	case cr.Token != "":
+		return protocol.NewBearerAuth(cr.Token)
+	}
+	return protocol.NewPasswordAuth(cr.Username, cr.Password)
+}
+
+// Client is implements request side of message protocol to easily connect
+// and communicate with server
+type Client struct {
+	config   Config
+	addr     *net.TCPAddr
+	r        *bufio.Reader
+	framed   bool
+	shutdown chan bool
+	once     *sync.Once
+
+	// wl serializes writes so calls are queued in pending in the same
+	// order their messages reach the server
+	wl *sync.Mutex
+
+	// seq is the last request id guarded by wl, ids are only sent when
+	// the server agreed on echoing them
+	seq        uint64
+	requestIDs bool
+
+	// mu guards the connection state shared with the reader goroutine and
+	// the application, err is set once the client is done for good
+	mu      *sync.Mutex
+	conn    net.Conn
+	welcome protocol.Welcome
+	pending []*Call
+	err     error
+	lost    error
+	// status tells whether calls can be written, alive is closed when the
+	// reader of the current connection stops
+	status status
+	alive  chan struct{}
+	// unsent holds the SEND msgs made while reconnecting, creds, name,
+	// token and rooms restore the session on the next connection
+	unsent []unsentCall
+	creds  *Credentials
+	name   string
+	token  string
+	rooms  map[string]bool
+
+	// dropped counts the receipts and events the application did not
+	// pick up in time
+	dropped  uint64
+	incoming *inbox
+	receipts chan DeliveryReceipt
+	presence chan PresenceEvent
+	states   chan StateEvent
+	done     chan struct{}
+}
+
+// New creates and returns a new Client configured by opts
+func New(opts ...Option) *Client {
+	var config Config
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return NewWithConfig(config)
+}
+
+// NewWithConfig creates and returns a new Client using the given config
+func NewWithConfig(config Config) *Client {
+	return &Client{
+		config:   config,
+		shutdown: make(chan bool),
+		once:     &sync.Once{},
+		wl:       &sync.Mutex{},
+		mu:       &sync.Mutex{},
+		incoming: newInbox(),
+		receipts: make(chan DeliveryReceipt, IncomingBuffer),
+		presence: make(chan PresenceEvent, IncomingBuffer),
+		states:   make(chan StateEvent, IncomingBuffer),
+		rooms:    make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+}
+
+// Connect will try to connect to the TCP server at the given address and
+// port. With Config.Reconnect set a lost connection is restored in the
+// background: the client authenticates again with the credentials it
+// connected with, logs in again or resumes the identity of its last RESUME
+// msg and joins its rooms again. SEND msgs made meanwhile are sent once the
+// connection is back, the other calls fail with ErrReconnecting.
+func (c *Client) Connect(serverAddr *net.TCPAddr) error {
+	return c.ConnectContext(context.Background(), serverAddr)
+}
+
+// ConnectContext is like Connect but gives up connecting when ctx is done,
+// ErrTimeout is returned when its deadline passed
+func (c *Client) ConnectContext(ctx context.Context, serverAddr *net.TCPAddr) error {
+	c.addr = serverAddr
+	c.wl.Lock()
+	conn, err := c.open(ctx)
+	c.wl.Unlock()
+	if err != nil {
+		return err
+	}
+
+	alive := c.serve()
+	c.startKeepAlive(conn, alive)
+
+	return nil
+}
+
+// open dials the server and performs the handshake, the caller must hold
+// wl so nothing is written until the protocol is known
+func (c *Client) open(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr.String())
+	if err != nil {
+		if err := openError(ctx, err); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("client: connection failed: %w", err)
+	}
+	c.mu.Lock()
+	c.conn = conn
+	c.lost = nil
+	c.welcome = protocol.Welcome{Version: protocol.MinProtocolVersion}
+	c.mu.Unlock()
+	select {
+	case <-c.shutdown:
+		// closed while dialing
+		conn.Close()
+		return nil, ErrClosed
+	default:
+	}
+
+	// the handshakes are interrupted once ctx is done
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func(conn net.Conn) {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}(conn)
+	conn, err = c.handshake(conn)
+	close(stop)
+	<-stopped
+	if err != nil {
+		if cerr := openError(ctx, err); cerr != nil {
+			err = cerr
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// openError returns the error of opening a connection which failed with
+// err because ctx is done, or nil when ctx is not the cause. Reads hitting
+// the connection deadline set from ctx usually fail before ctx reports
+// that its deadline passed.
+func openError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("client: connection failed: %w", contextError(ctx.Err()))
+	}
+	var ne net.Error
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) &&
+		errors.As(err, &ne) && ne.Timeout() {
+		return fmt.Errorf("client: connection failed: %w", ErrTimeout)
+	}
+	return nil
+}
+
+// contextError translates the error of a done context, a passed deadline
+// is reported as ErrTimeout
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return err
+}
+
+// serve starts the reader of the connection just opened, the returned
+// channel is closed when it stops
+func (c *Client) serve() chan struct{} {
+	alive := make(chan struct{})
+	c.mu.Lock()
+	c.alive = alive
+	c.mu.Unlock()
+	go c.readLoop(alive)
+	return alive
+}
+
+func (c *Client) startKeepAlive(conn net.Conn, alive chan struct{}) {
+	interval := c.config.KeepAlive
+	if interval == 0 {
+		interval = DefaultKeepAlive
+	}
+	if interval > 0 {
+		go c.keepAlive(conn, interval, alive)
+	}
+}
+
+// handshake performs the TLS handshake when TLS is configured and selects
+// the protocol, the connection is closed when it fails
+func (c *Client) handshake(conn net.Conn) (net.Conn, error) {
+	if c.config.TLS != nil {
+		config := c.config.TLS
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = "localhost"
+			if c.addr.IP != nil {
+				config.ServerName = c.addr.IP.String()
+			}
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("client: TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+	}
+
+	c.r = bufio.NewReader(conn)
+	c.framed, c.requestIDs = false, false
+	var err error
+	switch c.config.Protocol {
+	case ProtocolFramed:
+		_, err = conn.Write([]byte{protocol.FramePreface})
+		if err != nil {
+			err = fmt.Errorf("client: switching to framed protocol failed: %w", err)
+		}
+		c.framed = true
+	case ProtocolAuto:
+		err = c.hello(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ConnectWithCredentials connects to the server like Connect and
+// authenticates the connection, it is closed again when the server rejects
+// the credentials. Clients authenticated as a user are logged in to its
+// account.
+func (c *Client) ConnectWithCredentials(serverAddr *net.TCPAddr, creds Credentials) error {
+	return c.ConnectWithCredentialsContext(context.Background(), serverAddr, creds)
+}
+
+// ConnectWithCredentialsContext is like ConnectWithCredentials but gives up
+// when ctx is done
+func (c *Client) ConnectWithCredentialsContext(ctx context.Context, serverAddr *net.TCPAddr, creds Credentials) error {
+	err := c.ConnectContext(ctx, serverAddr)
+	if err != nil {
+		return err
+	}
+
+	var reply protocol.ClientID
+	err = c.roundTrip(ctx, creds.message(), &reply, protocol.TypeClientID)
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("client: auth message failed: %w", err)
+	}
+
+	c.mu.Lock()
+	c.creds = &creds
+	c.name = reply.Name
+	c.mu.Unlock()
+	return nil
+}
+
+// ProtocolVersion returns the protocol version agreed on with the server
+func (c *Client) ProtocolVersion() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.welcome.Version
+}
+
+// HasCapability reports whether the server agreed on the named capability
+func (c *Client) HasCapability(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.welcome.Has(name)
+}
+
+// hello sends a HELLO msg and applies the agreed version and capabilities
+// from the WELCOME response
+func (c *Client) hello(conn net.Conn) error {
+	caps := c.config.Capabilities
+	if caps == nil {
+		caps = []string{protocol.CapFraming, protocol.CapRequestIDs}
+	}
+	_, err := conn.Write(protocol.NewHello(protocol.ProtocolVersion, caps).Marshal())
+	if err != nil {
+		return fmt.Errorf("client: sending hello message failed: %w", err)
+	}
+
+	name, err := protocol.Read(c.r)
+	if err != nil {
+		return fmt.Errorf("client: reading welcome message failed: %w", err)
+	}
+
+	switch {
+	case name == protocol.WelcomeMsg:
+		var w protocol.Welcome
+		err := w.Unmarshal(c.r)
+		if err != nil {
+			return fmt.Errorf("client: invalid welcome received from the server: %w", err)
+		}
+		if w.Version < protocol.MinProtocolVersion || w.Version > protocol.ProtocolVersion {
+			return &protocol.VersionError{Version: w.Version}
+		}
+		c.mu.Lock()
+		c.welcome = w
+		c.mu.Unlock()
+		c.framed = w.Has(protocol.CapFraming)
+		c.requestIDs = w.Has(protocol.CapRequestIDs)
+	case name == protocol.UnknownMsg:
+		// servers predating the handshake answer each line of the HELLO
+		// msg with UNKNOWN MESSAGE, drain them and stay on the line protocol
+		for i := 0; i < 2; i++ {
+			_, err := protocol.Read(c.r)
+			if err != nil {
+				return fmt.Errorf("client: reading welcome message failed: %w", err)
+			}
+		}
+	case name == protocol.RefusedMsg:
+		var m protocol.Refused
+		if err := m.Unmarshal(c.r); err != nil {
+			return fmt.Errorf("client: reading welcome message failed: %w", err)
+		}
+		return &RefusedError{Reason: m.Reason}
+	case name == protocol.NewErr(protocol.UnsupportedVersion).Error():
+		return &protocol.VersionError{Version: protocol.ProtocolVersion}
+	default:
+		return fmt.Errorf("client: unexpected response to hello message: %s", name)
+	}
+
+	return nil
+}
+
+// Close will terminates connection to the server
+func (c *Client) Close() error {
+	c.once.Do(func() {
+		close(c.shutdown)
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+// Ping sends a PING msg to the server and returns the time it took to get
+// the response
+func (c *Client) Ping() (time.Duration, error) {
+	return c.PingContext(context.Background())
+}
+
+// PingContext is like Ping but gives up waiting when ctx is done
+func (c *Client) PingContext(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	err := c.roundTrip(ctx, protocol.NewPing(), &protocol.Pong{}, protocol.TypePong)
+	if err != nil {
+		return 0, fmt.Errorf("client: ping message failed: %w", err)
+	}
+	return time.Since(start), nil
+}
+
+// keepAlive pings the server every interval until the connection is
+// closed. Half-open connections, e.g. dropped by a NAT or VPN, are only
+// noticed this way, the connection is closed when the previous PING is
+// still unanswered. Servers which do not understand PING are not pinged
+// again.
+func (c *Client) keepAlive(conn net.Conn, interval time.Duration, alive chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var ping *Call
+	for {
+		select {
+		case <-alive:
+			return
+		case <-ticker.C:
+		}
+
+		if ping != nil {
+			select {
+			case <-ping.Done:
+				if ping.Error != nil {
+					return
+				}
+			default:
+				c.lose(conn, errNoPong)
+				return
+			}
+		}
+		ping = c.start(protocol.NewPing(), &protocol.Pong{}, protocol.TypePong, nil)
+	}
+}
+
+// lose closes a connection considered dead, pending and later calls fail
+// with err as the reason
+func (c *Client) lose(conn net.Conn, err error) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.lost = err
+	}
+	c.mu.Unlock()
+	conn.Close()
+}
+
+// WhoAmI will sends a IDENTITY msg to server and returns the current
+// client id
+func (c *Client) WhoAmI() (uint64, error) {
+	return c.WhoAmIContext(context.Background())
+}
+
+// WhoAmIContext is like WhoAmI but gives up waiting when ctx is done
+func (c *Client) WhoAmIContext(ctx context.Context) (uint64, error) {
+	id, _, err := c.IdentityContext(ctx)
+	return id, err
+}
+
+// Identity sends an IDENTITY msg to server and returns the current client
+// id and, once logged in, the user name
+func (c *Client) Identity() (uint64, string, error) {
+	return c.IdentityContext(context.Background())
+}
+
+// IdentityContext is like Identity but gives up waiting when ctx is done
+func (c *Client) IdentityContext(ctx context.Context) (uint64, string, error) {
+	var reply protocol.ClientID
+	err := c.roundTrip(ctx, protocol.NewIdentity(), &reply, protocol.TypeClientID)
+	if err != nil {
+		return 0, "", fmt.Errorf("client: identity message failed: %w", err)
+	}
+
+	return reply.ID, reply.Name, nil
+}
+
+// Login binds the connection to the user account name, creating it on
+// first use, and returns the id of the user. The msgs sent to the user
+// while none of its connections was online are received as incoming msgs
+// afterwards. Servers requiring authentication only accept the name the
+// credentials belong to.
+func (c *Client) Login(name string) (uint64, error) {
+	return c.LoginContext(context.Background(), name)
+}
+
+// LoginContext is like Login but gives up waiting when ctx is done
+func (c *Client) LoginContext(ctx context.Context, name string) (uint64, error) {
+	var reply protocol.ClientID
+	err := c.roundTrip(ctx, protocol.NewLogin(name), &reply, protocol.TypeClientID)
+	if err != nil {
+		return 0, fmt.Errorf("client: login message failed: %w", err)
+	}
+
+	c.mu.Lock()
+	c.name = name
+	c.mu.Unlock()
+	return reply.ID, nil
+}
+
+// WhoAmIAsync sends an IDENTITY msg without waiting for the response, the
+// id is decoded into the *protocol.ClientID reply of the returned call
+func (c *Client) WhoAmIAsync(done chan *Call) *Call {
+	return c.start(protocol.NewIdentity(), &protocol.ClientID{}, protocol.TypeClientID, done)
+}
+
+// ListClientIDs lists all clients connected to server
+func (c *Client) ListClientIDs() ([]uint64, error) {
+	return c.ListClientIDsContext(context.Background())
+}
+
+// ListClientIDsContext is like ListClientIDs but gives up waiting when ctx
+// is done
+func (c *Client) ListClientIDsContext(ctx context.Context) ([]uint64, error) {
+	var ids []uint64
+	var reply protocol.ClientIDs
+	err := c.roundTrip(ctx, protocol.NewList(), &reply, protocol.TypeClientIDs)
+	if err != nil {
+		return ids, fmt.Errorf("client: list message failed: %w", err)
+	}
+
+	return append(ids, reply.IDs...), nil
+}
+
+// ListClientIDsAsync sends a LIST msg without waiting for the response,
+// the ids are decoded into the *protocol.ClientIDs reply of the returned call
+func (c *Client) ListClientIDsAsync(done chan *Call) *Call {
+	return c.start(protocol.NewList(), &protocol.ClientIDs{}, protocol.TypeClientIDs, done)
+}
+
+// Resume claims the identity of an earlier connection using its resume
+// token, the msgs sent to it while it was offline are received as incoming
+// msgs afterwards. With an empty token the current identity is kept and a
+// token to resume it later is issued. It returns the id of the client and
+// its resume token.
+func (c *Client) Resume(token string) (uint64, string, error) {
+	return c.ResumeContext(context.Background(), token)
+}
+
+// ResumeContext is like Resume but gives up waiting when ctx is done
+func (c *Client) ResumeContext(ctx context.Context, token string) (uint64, string, error) {
+	var reply protocol.Resumed
+	err := c.roundTrip(ctx, protocol.NewResume(token), &reply, protocol.TypeResumed)
+	if err != nil {
+		return 0, "", fmt.Errorf("client: resume message failed: %w", err)
+	}
+
+	c.mu.Lock()
+	c.token = reply.Token
+	c.mu.Unlock()
+	return reply.ID, reply.Token, nil
+}
+
+// SendMsg sends a message using SEND msg with given ids and the payload and
+// waits for the server to report the outcome for every recipient
+func (c *Client) SendMsg(recipients []uint64, body []byte) (*SendResult, error) {
+	return c.SendMsgContext(context.Background(), recipients, body)
+}
+
+// SendMsgContext is like SendMsg but gives up waiting when ctx is done,
+// the msg may still be delivered then
+func (c *Client) SendMsgContext(ctx context.Context, recipients []uint64, body []byte) (*SendResult, error) {
+	return c.SendMsgToContext(ctx, recipients, nil, body)
+}
+
+// SendMsgTo is like SendMsg but recipients can also be addressed by user
+// name, their outcome is reported by the id of the user
+func (c *Client) SendMsgTo(recipients []uint64, names []string, body []byte) (*SendResult, error) {
+	return c.SendMsgToContext(context.Background(), recipients, names, body)
+}
+
+// SendMsgToContext is like SendMsgTo but gives up waiting when ctx is done
+func (c *Client) SendMsgToContext(ctx context.Context, recipients []uint64, names []string, body []byte) (*SendResult, error) {
+	return c.sendAndWait(ctx, protocol.NewSendTo(recipients, names, body))
+}
+
+// SendToRoom sends a message to all the members of room, the client must
+// be a member itself. The outcome is reported for every other member.
+func (c *Client) SendToRoom(room string, body []byte) (*SendResult, error) {
+	return c.SendToRoomContext(context.Background(), room, body)
+}
+
+// SendToRoomContext is like SendToRoom but gives up waiting when ctx is
+// done
+func (c *Client) SendToRoomContext(ctx context.Context, room string, body []byte) (*SendResult, error) {
+	return c.sendAndWait(ctx, protocol.NewRoomSend(room, body))
+}
+
+func (c *Client) sendAndWait(ctx context.Context, msg *protocol.Send) (*SendResult, error) {
+	call, err := c.wait(ctx, c.send(ctx, msg, nil))
+	if err != nil {
+		return nil, fmt.Errorf("client: sending message failed: %w", err)
+	}
+
+	reply, ok := call.Reply.(*protocol.Sent)
+	if !ok {
+		return &SendResult{Delivered: msg.Recipients}, nil
+	}
+	return &SendResult{
+		MessageID: reply.MessageID,
+		Delivered: reply.Delivered,
+		Unknown:   reply.Unknown,
+		Failed:    reply.Failed,
+		Queued:    reply.Queued,
+	}, nil
+}
+
+// Join makes the client a member of room, the room is created if it does
+// not exist yet
+func (c *Client) Join(room string) error {
+	return c.JoinContext(context.Background(), room)
+}
+
+// JoinContext is like Join but gives up waiting when ctx is done
+func (c *Client) JoinContext(ctx context.Context, room string) error {
+	err := c.roundTrip(ctx, protocol.NewJoin(room), nil, protocol.TypeDone)
+	if err != nil {
+		return fmt.Errorf("client: join message failed: %w", err)
+	}
+
+	c.mu.Lock()
+	c.rooms[room] = true
+	c.mu.Unlock()
+	return nil
+}
+
+// Part makes the client leave room
+func (c *Client) Part(room string) error {
+	return c.PartContext(context.Background(), room)
+}
+
+// PartContext is like Part but gives up waiting when ctx is done
+func (c *Client) PartContext(ctx context.Context, room string) error {
+	err := c.roundTrip(ctx, protocol.NewPart(room), nil, protocol.TypeDone)
+	if err != nil {
+		return fmt.Errorf("client: part message failed: %w", err)
+	}
+
+	c.mu.Lock()
+	delete(c.rooms, room)
+	c.mu.Unlock()
+	return nil
+}
+
+// Rooms lists the rooms which have members
+func (c *Client) Rooms() ([]string, error) {
+	return c.RoomsContext(context.Background())
+}
+
+// RoomsContext is like Rooms but gives up waiting when ctx is done
+func (c *Client) RoomsContext(ctx context.Context) ([]string, error) {
+	var reply protocol.RoomList
+	err := c.roundTrip(ctx, protocol.NewRooms(), &reply, protocol.TypeRoomList)
+	if err != nil {
+		return nil, fmt.Errorf("client: rooms message failed: %w", err)
+	}
+	return reply.Rooms, nil
+}
+
+// Command sends a msg of a command the server was extended with, args are
+// sent one per line, and returns the body of its TEXT response
+func (c *Client) Command(name string, args ...string) (string, error) {
+	return c.CommandContext(context.Background(), name, args...)
+}
+
+// CommandContext is like Command but gives up waiting when ctx is done
+func (c *Client) CommandContext(ctx context.Context, name string, args ...string) (string, error) {
+	var reply protocol.Text
+	err := c.roundTrip(ctx, protocol.NewCommand(name, args...), &reply, protocol.TypeText)
+	if err != nil {
+		return "", fmt.Errorf("client: %s message failed: %w", name, err)
+	}
+	return reply.Body, nil
+}
+
+// SendMsgAsync sends a SEND msg without waiting for the server to accept
+// it, which allows pipelining many messages on a single connection. If
+// done is nil a new channel is allocated, otherwise it must be buffered.
+// The reply of the returned call is a *protocol.Sent unless the server
+// speaks protocol version 1.
+func (c *Client) SendMsgAsync(recipients []uint64, body []byte, done chan *Call) *Call {
+	return c.send(context.Background(), protocol.NewSend(recipients, body), done)
+}
+
+func (c *Client) send(ctx context.Context, msg *protocol.Send, done chan *Call) *Call {
+	if c.ProtocolVersion() < protocol.SendResultsVersion {
+		return c.begin(ctx, msg, nil, protocol.TypeDone, done, false)
+	}
+	return c.begin(ctx, msg, &protocol.Sent{}, protocol.TypeSent, done, false)
+}
+
+// HandleIncomingMessages forwards the INCOMING msgs received by the client
+// to the given write-only channel until the connection is closed. Responses
+// to the other calls keep flowing while it runs, concurrent calls share the
+// incoming messages between their channels. The msgs received meanwhile
+// wait for it without limit, msgs to acknowledge are only acknowledged once
+// they were written to writeCh.
+func (c *Client) HandleIncomingMessages(writeCh chan<- IncomingMessage) {
+	for {
+		msg, ok := c.incoming.take()
+		if !ok {
+			select {
+			case <-c.shutdown:
+				return
+			case <-c.incoming.ready:
+				continue
+			case <-c.done:
+				// deliver whatever arrived before the connection dropped
+				if msg, ok = c.incoming.take(); !ok {
+					return
+				}
+			}
+		}
+
+		select {
+		case <-c.shutdown:
+			return
+		case writeCh <- msg:
+		}
+
+		// the msg is acknowledged once it was handed to the application
+		if msg.ID != 0 {
+			err := c.notify(protocol.NewDelivered(msg.ID, 0))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// DroppedMessages returns the number of delivery receipts and presence
+// events dropped because the application did not pick them up in time,
+// incoming msgs are never dropped
+func (c *Client) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// HandleDeliveryReceipts forwards the delivery receipts of the msgs sent by
+// the client to the given write-only channel until the connection is
+// closed. Like incoming msgs, receipts not picked up in time are dropped.
+func (c *Client) HandleDeliveryReceipts(writeCh chan<- DeliveryReceipt) {
+	for {
+		var receipt DeliveryReceipt
+		select {
+		case <-c.shutdown:
+			return
+		case receipt = <-c.receipts:
+		case <-c.done:
+			select {
+			case receipt = <-c.receipts:
+			default:
+				return
+			}
+		}
+
+		select {
+		case <-c.shutdown:
+			return
+		case writeCh <- receipt:
+		}
+	}
+}
+
+// HandlePresenceEvents forwards the JOINED and LEFT events of the other
+// clients to the given write-only channel until the connection is closed.
+// Clients have to request the presence capability to receive them, events
+// not picked up in time are dropped.
+func (c *Client) HandlePresenceEvents(writeCh chan<- PresenceEvent) {
+	for {
+		var event PresenceEvent
+		select {
+		case <-c.shutdown:
+			return
+		case event = <-c.presence:
+		case <-c.done:
+			select {
+			case event = <-c.presence:
+			default:
+				return
+			}
+		}
+
+		select {
+		case <-c.shutdown:
+			return
+		case writeCh <- event:
+		}
+	}
+}
+
+// notify writes a msg which has no response, it is dropped while the
+// client is reconnecting
+func (c *Client) notify(m protocol.Message) error {
+	c.wl.Lock()
+	defer c.wl.Unlock()
+	c.mu.Lock()
+	status := c.status
+	c.mu.Unlock()
+	if status != statusConnected {
+		return nil
+	}
+	return c.write(m, 0, time.Time{})
+}
+
+// write writes m to the connection, a write not finished before a non-zero
+// deadline leaves a partial msg behind and the connection is dropped
+func (c *Client) write(m protocol.Message, id uint64, deadline time.Time) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if !deadline.IsZero() {
+		conn.SetWriteDeadline(deadline)
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	var err error
+	if c.framed {
+		err = protocol.WriteFrameWithID(conn, m, id)
+	} else {
+		_, err = conn.Write(protocol.MarshalWithID(m, id))
+	}
+	if err != nil && !deadline.IsZero() {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			c.lose(conn, ErrTimeout)
+			return ErrTimeout
+		}
+	}
+	return err
+}
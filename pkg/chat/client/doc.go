@@ -0,0 +1,9 @@
+// Package client implements a tcp-chat client. Requests can be made
+// synchronously, asynchronously with the Async methods, or with a context
+// using the Context methods. Pushed msgs, like incoming messages, delivery
+// receipts and presence events, are received with the Handle methods.
+//
+// Errors can be matched with errors.Is against ErrTimeout, ErrClosed,
+// ErrReconnecting, ErrRefused and ErrServer, the kind of server errors is
+// told by the Code of the ServerError found with errors.As.
+package client
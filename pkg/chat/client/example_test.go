@@ -0,0 +1,42 @@
+package client_test
+
+import (
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/client"
+	"github.com/xesina/tcp-chat/pkg/chat/server"
+	"net"
+	"time"
+)
+
+func ExampleClient_SendToRoom() {
+	srv := server.New()
+	addr := &net.TCPAddr{Port: 50019}
+	go srv.Start(addr)
+	defer srv.Stop()
+
+	alice := client.New(client.WithKeepAlive(30 * time.Second))
+	for i := 0; i < 50 && alice.Connect(addr) != nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer alice.Close()
+	bob := client.New(client.WithProtocol(client.ProtocolLine))
+	if err := bob.Connect(addr); err != nil {
+		panic(err)
+	}
+	defer bob.Close()
+
+	incoming := make(chan client.IncomingMessage)
+	go bob.HandleIncomingMessages(incoming)
+	for _, c := range []*client.Client{alice, bob} {
+		if err := c.Join("lobby"); err != nil {
+			panic(err)
+		}
+	}
+
+	if _, err := alice.SendToRoom("lobby", []byte("hi all")); err != nil {
+		panic(err)
+	}
+	msg := <-incoming
+	fmt.Printf("%s: %s\n", msg.Room, msg.Body)
+	// Output: lobby: hi all
+}
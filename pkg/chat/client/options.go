@@ -0,0 +1,47 @@
+package client
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Option configures a client created by New
+type Option func(*Config)
+
+// WithProtocol selects how the client talks to the server
+func WithProtocol(p Protocol) Option {
+	return func(c *Config) {
+		c.Protocol = p
+	}
+}
+
+// WithCapabilities sets the capabilities requested during the handshake
+func WithCapabilities(caps ...string) Option {
+	return func(c *Config) {
+		c.Capabilities = caps
+	}
+}
+
+// WithTLS makes the client connect using TLS
+func WithTLS(config *tls.Config) Option {
+	return func(c *Config) {
+		c.TLS = config
+	}
+}
+
+// WithReconnect makes the client reconnect when the connection is lost,
+// pacing the attempts with backoff
+func WithReconnect(backoff Backoff) Option {
+	return func(c *Config) {
+		c.Reconnect = true
+		c.Backoff = &backoff
+	}
+}
+
+// WithKeepAlive sets the interval of the PING msgs sent to the server, a
+// negative interval disables keepalive
+func WithKeepAlive(interval time.Duration) Option {
+	return func(c *Config) {
+		c.KeepAlive = interval
+	}
+}
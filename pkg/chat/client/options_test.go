@@ -0,0 +1,23 @@
+package client
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"testing"
+	"time"
+)
+
+func TestNew_Options(t *testing.T) {
+	c := New(
+		WithProtocol(ProtocolLine),
+		WithCapabilities(protocol.CapPresence),
+		WithReconnect(Backoff{Min: time.Second}),
+		WithKeepAlive(-1),
+	)
+
+	assert.Equal(t, ProtocolLine, c.config.Protocol)
+	assert.Equal(t, []string{protocol.CapPresence}, c.config.Capabilities)
+	assert.True(t, c.config.Reconnect)
+	assert.Equal(t, time.Second, c.config.Backoff.Min)
+	assert.Equal(t, time.Duration(-1), c.config.KeepAlive)
+}
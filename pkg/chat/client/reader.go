@@ -0,0 +1,538 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Call represents a request sent by one of the asynchronous methods, the
+// call itself is sent on Done once its response has been decoded into
+// Reply or Error is set
+type Call struct {
+	RequestID uint64
+	Reply     protocol.Unmarshaler
+	Error     error
+	Done      chan *Call
+
+	// typ is the expected response type, writing the request must finish
+	// before deadline unless it is zero
+	typ      protocol.Type
+	deadline time.Time
+}
+
+// ServerError is the error of calls the server rejected, Code tells the
+// kind of error. Servers speaking a protocol version older than
+// protocol.ErrorCodesVersion only send a text, the code is derived from it.
+type ServerError struct {
+	Code protocol.ErrorCode
+	Text string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error %d: %s", e.Code, e.Text)
+}
+
+// Is reports whether target is ErrServer
+func (e *ServerError) Is(target error) bool {
+	return target == ErrServer
+}
+
+// RefusedError is the error of connections the server refused to serve,
+// Reason tells why, like protocol.RefusedServerFull
+type RefusedError struct {
+	Reason string
+}
+
+func (e *RefusedError) Error() string {
+	return "server refused connection: " + strings.ToLower(e.Reason)
+}
+
+// Is reports whether target is ErrRefused
+func (e *RefusedError) Is(target error) bool {
+	return target == ErrRefused
+}
+
+// lostError is the error of calls interrupted by a lost connection, it
+// matches ErrClosed and the reason the connection was lost
+type lostError struct {
+	cause error
+}
+
+func (e lostError) Error() string {
+	return "client: connection lost: " + e.cause.Error()
+}
+
+// Is reports whether target is ErrClosed
+func (e lostError) Is(target error) bool {
+	return target == ErrClosed
+}
+
+// Unwrap returns why the connection was lost
+func (e lostError) Unwrap() error {
+	return e.cause
+}
+
+func (call *Call) done() {
+	select {
+	case call.Done <- call:
+	default:
+		// like net/rpc it is the caller's job to make Done big enough,
+		// the reader must never block on it
+	}
+}
+
+// decodeFrame decodes a framed response into the call reply
+func (call *Call) decodeFrame(f protocol.Frame) error {
+	switch f.Type {
+	case protocol.TypeError:
+		var e protocol.Error
+		if err := e.UnmarshalBinary(f.Payload); err != nil {
+			return err
+		}
+		return &ServerError{Code: e.Code, Text: e.Text}
+	case protocol.TypeErr:
+		var e protocol.Err
+		if err := e.UnmarshalBinary(f.Payload); err != nil {
+			return err
+		}
+		return &ServerError{Code: e.Code(), Text: e.Text}
+	case protocol.TypeUnknown:
+		return &ServerError{Code: protocol.CodeUnknownMessage, Text: protocol.UnknownMsg}
+	}
+	if f.Type != call.typ {
+		return fmt.Errorf("unexpected %s response", f.Type)
+	}
+	if call.Reply == nil {
+		return nil
+	}
+	return f.Decode(call.Reply)
+}
+
+// decodeLine decodes a line protocol response into the call reply, every
+// response of the line protocol fits in a single line
+func (call *Call) decodeLine(line string) error {
+	upper := strings.ToUpper(line)
+	switch {
+	case strings.HasPrefix(upper, protocol.ErrorMsg+" "):
+		var e protocol.Error
+		if err := e.Unmarshal(bufio.NewReader(strings.NewReader(line + "\n"))); err != nil {
+			return err
+		}
+		return &ServerError{Code: e.Code, Text: e.Text}
+	case strings.HasPrefix(upper, protocol.ErrMsg+" "):
+		e := protocol.Err{Text: line[len(protocol.ErrMsg)+1:]}
+		return &ServerError{Code: e.Code(), Text: e.Text}
+	case upper == protocol.UnknownMsg:
+		return &ServerError{Code: protocol.CodeUnknownMessage, Text: protocol.UnknownMsg}
+	case call.typ == protocol.TypeDone:
+		if upper != protocol.DoneMsg {
+			return fmt.Errorf("unexpected response: %s", line)
+		}
+		return nil
+	}
+	return call.Reply.Unmarshal(bufio.NewReader(strings.NewReader(line + "\n")))
+}
+
+// start writes m and queues a call waiting for its response, t is the
+// expected response type
+func (c *Client) start(m protocol.Message, reply protocol.Unmarshaler, t protocol.Type, done chan *Call) *Call {
+	return c.begin(context.Background(), m, reply, t, done, false)
+}
+
+// begin creates the call of m and dispatches it, restoring calls restore
+// the session on a new connection before anything else may be written.
+// The deadline of ctx limits how long writing m may take.
+func (c *Client) begin(ctx context.Context, m protocol.Message, reply protocol.Unmarshaler, t protocol.Type, done chan *Call, restore bool) *Call {
+	if done == nil {
+		done = make(chan *Call, 1)
+	} else if cap(done) == 0 {
+		panic("client: done channel is unbuffered")
+	}
+	call := &Call{
+		Reply: reply,
+		Done:  done,
+		typ:   t,
+	}
+	if err := ctx.Err(); err != nil {
+		call.Error = contextError(err)
+		call.done()
+		return call
+	}
+	call.deadline, _ = ctx.Deadline()
+	c.wl.Lock()
+	defer c.wl.Unlock()
+	c.dispatch(m, call, restore)
+	return call
+}
+
+// dispatch writes m and queues call waiting for its response, the caller
+// must hold wl. While reconnecting SEND msgs are queued in unsent and the
+// other calls fail.
+func (c *Client) dispatch(m protocol.Message, call *Call, restore bool) {
+	c.mu.Lock()
+	switch {
+	case c.err != nil:
+		call.Error = c.err
+	case c.status == statusConnected:
+	case restore && c.status == statusRestoring:
+		select {
+		case <-c.alive:
+			call.Error = ErrReconnecting
+		default:
+		}
+	default:
+		if _, ok := m.(*protocol.Send); ok && len(c.unsent) < IncomingBuffer {
+			c.unsent = append(c.unsent, unsentCall{m: m, call: call})
+			c.mu.Unlock()
+			return
+		}
+		call.Error = ErrReconnecting
+	}
+	if call.Error != nil {
+		c.mu.Unlock()
+		call.done()
+		return
+	}
+	if c.requestIDs {
+		c.seq++
+		call.RequestID = c.seq
+	}
+	c.pending = append(c.pending, call)
+	c.mu.Unlock()
+
+	err := c.write(m, call.RequestID, call.deadline)
+	if err != nil {
+		if c.takeCall(call) {
+			call.Error = err
+			call.done()
+		}
+	}
+}
+
+// roundTrip writes m and waits for its response until ctx is done
+func (c *Client) roundTrip(ctx context.Context, m protocol.Message, reply protocol.Unmarshaler, t protocol.Type) error {
+	_, err := c.wait(ctx, c.begin(ctx, m, reply, t, nil, false))
+	return err
+}
+
+// wait waits for the response of call until ctx is done, the call is
+// abandoned then
+func (c *Client) wait(ctx context.Context, call *Call) (*Call, error) {
+	select {
+	case <-call.Done:
+		return call, call.Error
+	case <-ctx.Done():
+		c.abandon(call)
+		return call, contextError(ctx.Err())
+	}
+}
+
+// abandon stops waiting for the response of call. Without request ids
+// responses are matched by their order, the call stays pending then and
+// its response is dropped once it arrives.
+func (c *Client) abandon(call *Call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call.RequestID != 0 {
+		for i, p := range c.pending {
+			if p == call {
+				c.pending = append(c.pending[:i], c.pending[i+1:]...)
+				return
+			}
+		}
+	}
+	for i, u := range c.unsent {
+		if u.call == call {
+			c.unsent = append(c.unsent[:i], c.unsent[i+1:]...)
+			return
+		}
+	}
+}
+
+// takeCall removes call from the pending calls and reports whether it was
+// still pending
+func (c *Client) takeCall(call *Call) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.pending {
+		if p == call {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// nextCall pops the pending call waiting for the response to request id.
+// Responses without a request id belong to the oldest call since the
+// server answers in the order the requests were sent.
+func (c *Client) nextCall(id uint64) *Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, call := range c.pending {
+		if id == 0 || call.RequestID == id {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return call
+		}
+	}
+	return nil
+}
+
+// readLoop is the only reader of the connection, it routes responses to
+// the pending calls, INCOMING msgs to HandleIncomingMessages, DELIVERED
+// msgs to HandleDeliveryReceipts and presence events to
+// HandlePresenceEvents. Once the connection is lost the pending calls fail
+// and, if enabled, the client reconnects.
+func (c *Client) readLoop(alive chan struct{}) {
+	var err error
+	for err == nil {
+		if c.framed {
+			err = c.readFrame()
+		} else {
+			err = c.readLine()
+		}
+	}
+
+	c.mu.Lock()
+	close(alive)
+	select {
+	case <-c.shutdown:
+		err = ErrClosed
+	default:
+		if c.lost != nil {
+			err = c.lost
+		}
+		err = lostError{cause: err}
+	}
+	pending := c.pending
+	c.pending = nil
+	status := c.status
+	reconnect := c.config.Reconnect && err != ErrClosed
+	switch {
+	case status == statusRestoring:
+		// reconnect is still waiting for the session to be restored
+	case reconnect:
+		c.status = statusReconnecting
+	default:
+		c.err = err
+	}
+	c.mu.Unlock()
+
+	for _, call := range pending {
+		call.Error = err
+		call.done()
+	}
+	switch {
+	case status == statusRestoring:
+	case reconnect:
+		c.reconnect(err)
+	default:
+		c.finish(err)
+	}
+}
+
+func (c *Client) readFrame() error {
+	f, err := protocol.ReadFrame(c.r)
+	if err != nil {
+		return err
+	}
+
+	// the request id of INCOMING msgs is the msg id to acknowledge
+	switch f.Type {
+	case protocol.TypeIncoming, protocol.TypeRoomIncoming:
+		var m protocol.Incoming
+		if err := f.Decode(&m); err != nil {
+			// a single malformed message is not worth the connection
+			return nil
+		}
+		c.deliver(f.RequestID, &m)
+		return nil
+	case protocol.TypeDelivered:
+		var m protocol.Delivered
+		if err := f.Decode(&m); err != nil {
+			return nil
+		}
+		c.receipt(&m)
+		return nil
+	case protocol.TypeJoined:
+		var m protocol.Joined
+		if err := f.Decode(&m); err != nil {
+			return nil
+		}
+		c.announce(PresenceEvent{ClientID: m.ID, Name: m.Name, Online: true})
+		return nil
+	case protocol.TypeLeft:
+		var m protocol.Left
+		if err := f.Decode(&m); err != nil {
+			return nil
+		}
+		c.announce(PresenceEvent{ClientID: m.ID})
+		return nil
+	case protocol.TypeServerShutdown:
+		c.serverShutdown()
+		return nil
+	case protocol.TypeRefused:
+		var m protocol.Refused
+		if err := f.Decode(&m); err != nil {
+			return nil
+		}
+		c.refused(&m)
+		return nil
+	}
+
+	if call := c.nextCall(f.RequestID); call != nil {
+		call.Error = call.decodeFrame(f)
+		call.done()
+	}
+	return nil
+}
+
+func (c *Client) readLine() error {
+	line, err := protocol.ReadStringArg(c.r)
+	if err != nil {
+		return err
+	}
+
+	id, line := protocol.SplitRequestID(line)
+	switch strings.ToUpper(line) {
+	case protocol.IncomingMsg:
+		var m protocol.Incoming
+		if err := m.Unmarshal(c.r); err != nil {
+			return err
+		}
+		c.deliver(id, &m)
+		return nil
+	case protocol.DeliveredMsg:
+		var m protocol.Delivered
+		if err := m.Unmarshal(c.r); err != nil {
+			return err
+		}
+		c.receipt(&m)
+		return nil
+	case protocol.JoinedMsg:
+		var m protocol.Joined
+		if err := m.Unmarshal(c.r); err != nil {
+			return err
+		}
+		c.announce(PresenceEvent{ClientID: m.ID, Name: m.Name, Online: true})
+		return nil
+	case protocol.LeftMsg:
+		var m protocol.Left
+		if err := m.Unmarshal(c.r); err != nil {
+			return err
+		}
+		c.announce(PresenceEvent{ClientID: m.ID})
+		return nil
+	case protocol.ServerShutdownMsg:
+		c.serverShutdown()
+		return nil
+	case protocol.RefusedMsg:
+		var m protocol.Refused
+		if err := m.Unmarshal(c.r); err != nil {
+			return err
+		}
+		c.refused(&m)
+		return nil
+	}
+
+	if call := c.nextCall(id); call != nil {
+		call.Error = call.decodeLine(line)
+		call.done()
+	}
+	return nil
+}
+
+// serverShutdown records why the connection is about to be closed, the
+// responses to the requests already sent keep coming until then
+func (c *Client) serverShutdown() {
+	c.mu.Lock()
+	c.lost = errServerShutdown
+	c.mu.Unlock()
+}
+
+// refused records that the server refused the connection, it closes the
+// connection right after
+func (c *Client) refused(m *protocol.Refused) {
+	c.mu.Lock()
+	c.lost = &RefusedError{Reason: m.Reason}
+	c.mu.Unlock()
+}
+
+// inbox holds the INCOMING msgs until HandleIncomingMessages picks them
+// up, it grows as needed so msgs are neither lost nor make the reader wait
+// while responses keep flowing
+type inbox struct {
+	mu   *sync.Mutex
+	msgs []IncomingMessage
+	// ready holds a token while msgs may be waiting
+	ready chan struct{}
+}
+
+func newInbox() *inbox {
+	return &inbox{
+		mu:    &sync.Mutex{},
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (b *inbox) put(msg IncomingMessage) {
+	b.mu.Lock()
+	b.msgs = append(b.msgs, msg)
+	b.mu.Unlock()
+	b.signal()
+}
+
+// take pops the oldest msg, it reports false when there is none
+func (b *inbox) take() (IncomingMessage, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.msgs) == 0 {
+		return IncomingMessage{}, false
+	}
+	msg := b.msgs[0]
+	b.msgs[0] = IncomingMessage{}
+	b.msgs = b.msgs[1:]
+	if len(b.msgs) > 0 {
+		// wakes up the other callers of HandleIncomingMessages
+		b.signal()
+	}
+	return msg, true
+}
+
+func (b *inbox) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// deliver hands an INCOMING msg to HandleIncomingMessages, the reader never
+// waits for it so responses keep flowing
+func (c *Client) deliver(id uint64, m *protocol.Incoming) {
+	c.incoming.put(IncomingMessage{SenderID: m.Sender(), Room: m.Room(), Body: m.Body(), ID: id})
+}
+
+// receipt hands a DELIVERED msg to HandleDeliveryReceipts, like presence
+// events it is dropped when the application does not keep up
+func (c *Client) receipt(m *protocol.Delivered) {
+	receipt := DeliveryReceipt{MessageID: m.MessageID, RecipientID: m.Recipient}
+	select {
+	case c.receipts <- receipt:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+func (c *Client) announce(event PresenceEvent) {
+	select {
+	case c.presence <- event:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
@@ -0,0 +1,308 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Backoff paces the reconnect attempts, the delay doubles with every
+// attempt from Min up to Max. Jitter randomly shortens each delay by up to
+// that fraction so clients dropped together do not come back at once. An
+// attempt gives up after Max, or a second when Max is shorter.
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+// DefaultBackoff is used by reconnecting clients without Config.Backoff
+var DefaultBackoff = Backoff{Min: 100 * time.Millisecond, Max: 30 * time.Second, Jitter: 0.5}
+
+// minAttemptTimeout is the least time a reconnect attempt gets to connect
+// and restore the session, attempts otherwise time out after Backoff.Max
+const minAttemptTimeout = time.Second
+
+// attemptTimeout returns how long a reconnect attempt may take, a server
+// accepting the connection but never answering must not stall the client
+func (b Backoff) attemptTimeout() time.Duration {
+	if b.Max < minAttemptTimeout {
+		return minAttemptTimeout
+	}
+	return b.Max
+}
+
+// Delay returns the delay before the given attempt, counting from 1
+func (b Backoff) Delay(attempt int) time.Duration {
+	limit := b.Max
+	if limit < b.Min {
+		limit = b.Min
+	}
+	d := b.Min
+	for i := 1; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	if b.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * b.Jitter * float64(d))
+	}
+	return d
+}
+
+// State is the state of the connection of a reconnecting client
+type State int
+
+const (
+	// StateConnected tells that the connection and the session were
+	// restored
+	StateConnected State = iota
+	// StateReconnecting tells that the connection was lost and the client
+	// is about to try to reconnect
+	StateReconnecting
+	// StateClosed tells that the client gave up reconnecting because the
+	// server rejected it, closing the client is not reported
+	StateClosed
+)
+
+var stateNames = map[State]string{
+	StateConnected:    "connected",
+	StateReconnecting: "reconnecting",
+	StateClosed:       "closed",
+}
+
+// String returns the name of the state
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// StateEvent tells that the connection of the client changed its state
+type StateEvent struct {
+	State State
+	// Attempt counts the reconnect attempts since the connection was lost
+	Attempt int
+	// Err is why the connection was lost or the last attempt failed
+	Err error
+}
+
+// status tells which calls can be written to the connection
+type status int
+
+const (
+	// statusConnected lets every call through
+	statusConnected status = iota
+	// statusRestoring only lets the calls restoring the session through
+	statusRestoring
+	// statusReconnecting lets nothing through
+	statusReconnecting
+)
+
+// unsentCall is a SEND msg made while reconnecting
+type unsentCall struct {
+	m    protocol.Message
+	call *Call
+}
+
+// errRestoreLost is the reason of another attempt when the connection is
+// lost while the session is restored
+var errRestoreLost = errors.New("client: connection lost while restoring the session")
+
+// HandleStateChanges forwards the state changes of a reconnecting client
+// to the given write-only channel until the client is closed. Unlike the
+// other events, changes are dropped when too many of them are not picked
+// up.
+func (c *Client) HandleStateChanges(writeCh chan<- StateEvent) {
+	for {
+		var event StateEvent
+		select {
+		case <-c.shutdown:
+			return
+		case event = <-c.states:
+		case <-c.done:
+			select {
+			case event = <-c.states:
+			default:
+				return
+			}
+		}
+
+		select {
+		case <-c.shutdown:
+			return
+		case writeCh <- event:
+		}
+	}
+}
+
+func (c *Client) changeState(event StateEvent) {
+	select {
+	case c.states <- event:
+	default:
+	}
+}
+
+// reconnect restores the connection lost because of cause, it tries until
+// it succeeds, the client is closed or the server rejects its credentials
+func (c *Client) reconnect(cause error) {
+	backoff := DefaultBackoff
+	if c.config.Backoff != nil {
+		backoff = *c.config.Backoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		c.changeState(StateEvent{State: StateReconnecting, Attempt: attempt, Err: cause})
+		select {
+		case <-c.shutdown:
+			c.giveUp(ErrClosed)
+			return
+		case <-time.After(backoff.Delay(attempt)):
+		}
+
+		c.mu.Lock()
+		c.status = statusRestoring
+		c.mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), backoff.attemptTimeout())
+		c.wl.Lock()
+		conn, err := c.open(ctx)
+		c.wl.Unlock()
+		if err != nil {
+			cancel()
+			cause = err
+			continue
+		}
+
+		alive := c.serve()
+		permanent, err := c.restore(ctx)
+		cancel()
+		if err == nil {
+			err = c.goOnline(alive)
+		}
+		if err == nil {
+			c.startKeepAlive(conn, alive)
+			c.changeState(StateEvent{State: StateConnected, Attempt: attempt})
+			return
+		}
+
+		conn.Close()
+		<-alive
+		if permanent {
+			c.giveUp(err)
+			return
+		}
+		cause = err
+	}
+}
+
+// restore authenticates the new connection and restores the identity and
+// the rooms of the client, it reports whether the failure is permanent
+func (c *Client) restore(ctx context.Context) (bool, error) {
+	c.mu.Lock()
+	creds, name, token := c.creds, c.name, c.token
+	rooms := make([]string, 0, len(c.rooms))
+	for room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+	c.mu.Unlock()
+	sort.Strings(rooms)
+
+	if creds != nil {
+		var reply protocol.ClientID
+		err := c.restoreTrip(ctx, creds.message(), &reply, protocol.TypeClientID)
+		if err != nil {
+			return errors.Is(err, ErrServer), fmt.Errorf("client: auth message failed: %w", err)
+		}
+		if reply.Name == name {
+			// the credentials logged in already
+			name = ""
+		}
+	}
+
+	switch {
+	case name != "":
+		err := c.restoreTrip(ctx, protocol.NewLogin(name), &protocol.ClientID{}, protocol.TypeClientID)
+		if err != nil {
+			return false, fmt.Errorf("client: login message failed: %w", err)
+		}
+	case token != "":
+		var reply protocol.Resumed
+		err := c.restoreTrip(ctx, protocol.NewResume(token), &reply, protocol.TypeResumed)
+		var e *ServerError
+		if errors.As(err, &e) && e.Code == protocol.CodeUnknownToken {
+			// the server forgot the identity, e.g. its store was lost in
+			// a restart, the client goes on with a new one
+			c.mu.Lock()
+			c.token = ""
+			c.mu.Unlock()
+		} else if err != nil {
+			return false, fmt.Errorf("client: resume message failed: %w", err)
+		}
+	}
+
+	for _, room := range rooms {
+		err := c.restoreTrip(ctx, protocol.NewJoin(room), nil, protocol.TypeDone)
+		if err != nil {
+			return false, fmt.Errorf("client: join message failed: %w", err)
+		}
+	}
+	return false, nil
+}
+
+func (c *Client) restoreTrip(ctx context.Context, m protocol.Message, reply protocol.Unmarshaler, t protocol.Type) error {
+	call := <-c.begin(ctx, m, reply, t, nil, true).Done
+	return call.Error
+}
+
+// goOnline lets every call through the restored connection and sends the
+// SEND msgs made meanwhile, unless the connection is lost already
+func (c *Client) goOnline(alive chan struct{}) error {
+	c.wl.Lock()
+	defer c.wl.Unlock()
+
+	c.mu.Lock()
+	select {
+	case <-alive:
+		c.mu.Unlock()
+		return errRestoreLost
+	default:
+	}
+	c.status = statusConnected
+	unsent := c.unsent
+	c.unsent = nil
+	c.mu.Unlock()
+
+	for _, u := range unsent {
+		c.dispatch(u.m, u.call, false)
+	}
+	return nil
+}
+
+// giveUp fails the calls waiting for a connection and finishes the client
+func (c *Client) giveUp(err error) {
+	c.mu.Lock()
+	c.err = err
+	unsent := c.unsent
+	c.unsent = nil
+	c.mu.Unlock()
+
+	for _, u := range unsent {
+		u.call.Error = err
+		u.call.done()
+	}
+	c.finish(err)
+}
+
+// finish tells the Handle methods that no more events follow
+func (c *Client) finish(err error) {
+	if c.config.Reconnect && err != ErrClosed {
+		c.changeState(StateEvent{State: StateClosed, Err: err})
+	}
+	close(c.done)
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// LoadTLSConfig creates the TLS config of a client. The server certificate
+// is verified against the PEM encoded CA bundle in caFile, or against the
+// system roots when it is empty. With certFile and keyFile the client
+// presents their certificate to servers asking for one.
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("client: reading CA file failed: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("client: CA file %s holds no certificate", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client: loading certificate failed: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
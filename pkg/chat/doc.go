@@ -0,0 +1,15 @@
+// Package chat is the root of the tcp-chat Go SDK. Its sub-packages can be
+// imported by other modules:
+//
+//	github.com/xesina/tcp-chat/pkg/chat/protocol  the message codec of both wire formats
+//	github.com/xesina/tcp-chat/pkg/chat/client    a client with sync, async and context-aware calls
+//	github.com/xesina/tcp-chat/pkg/chat/server    an embeddable server which can be extended with commands
+//
+// The exported API of these packages follows semantic versioning as given
+// by Version: within a major version identifiers are only added, never
+// removed or changed incompatibly. The wire protocol is versioned
+// separately by protocol.ProtocolVersion and negotiated with HELLO.
+package chat
+
+// Version is the version of the exported API of the chat packages
+const Version = "1.1.0"
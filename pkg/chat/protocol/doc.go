@@ -0,0 +1,10 @@
+// Package protocol implements the messages of the tcp-chat protocol in
+// both of its wire formats. In the line format a message is its name
+// followed by one line per argument, `#id` after the name tags requests
+// with an id echoed in their response. In the framed format, selected with
+// FramePreface or the framing capability, every message is a frame of a
+// type byte, an optional request id and a length-prefixed payload.
+//
+// Every message implements Message, the ones carrying arguments also
+// implement Unmarshaler.
+package protocol
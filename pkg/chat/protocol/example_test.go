@@ -0,0 +1,36 @@
+package protocol_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+)
+
+func ExampleMarshalWithID() {
+	fmt.Printf("%q\n", protocol.MarshalWithID(protocol.NewJoin("deploys"), 7))
+	fmt.Printf("%q\n", protocol.MarshalWithID(protocol.NewDone(), 7))
+	// Output:
+	// "JOIN #7\ndeploys\n"
+	// "#7 DONE\n"
+}
+
+func ExampleReadFrame() {
+	var buf bytes.Buffer
+	err := protocol.WriteFrameWithID(&buf, protocol.NewError(protocol.CodeNotInRoom), 3)
+	if err != nil {
+		panic(err)
+	}
+
+	f, err := protocol.ReadFrame(bufio.NewReader(&buf))
+	if err != nil {
+		panic(err)
+	}
+	var e protocol.Error
+	if err := f.Decode(&e); err != nil {
+		panic(err)
+	}
+	fmt.Println(f.Type, f.RequestID, e.Code, e.Text)
+	// Output:
+	// ERROR 3 NOT IN ROOM NOT IN ROOM
+}
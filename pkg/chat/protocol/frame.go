@@ -0,0 +1,862 @@
+package protocol
+
+// frame.go implements the length-prefixed binary wire format. Every frame
+// is a single type byte followed by the payload length encoded as an
+// unsigned varint and the payload itself. Unlike the line protocol the
+// payload is never trimmed or split, so bodies may contain any bytes.
+//
+// When the high bit of the type byte is set the frame carries a request
+// id, encoded as an unsigned varint between the type and the length.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FramePreface is the first byte sent by a client that wants to use the
+// framed protocol instead of the line based one. It can never start a
+// line protocol message.
+const FramePreface byte = 0x00
+
+// MaxFrameSize is the largest payload accepted by ReadFrame
+const MaxFrameSize = 2 << 20
+
+// RequestFlag is set on the type byte of frames carrying a request id
+const RequestFlag byte = 0x80
+
+// Type identifies the message carried by a frame
+type Type byte
+
+// Frame types
+const (
+	TypeIdentity Type = iota + 1
+	TypeList
+	TypeSend
+	TypeIncoming
+	TypeClientID
+	TypeClientIDs
+	TypeDone
+	TypeErr
+	TypeUnknown
+	TypeHello
+	TypeWelcome
+	TypeSent
+	TypeDelivered
+	TypeResume
+	TypeResumed
+	TypeLogin
+	TypeAuth
+	TypeJoin
+	TypePart
+	TypeRooms
+	TypeRoomList
+	TypeRoomIncoming
+	TypeJoined
+	TypeLeft
+	TypePing
+	TypePong
+	TypeServerShutdown
+	TypeError
+	TypeCommand
+	TypeText
+	TypeRefused
+)
+
+var typeNames = map[Type]string{
+	TypeIdentity:       IdentityMsg,
+	TypeList:           ListMsg,
+	TypeSend:           SendMsg,
+	TypeIncoming:       IncomingMsg,
+	TypeClientID:       ClientIDMsg,
+	TypeClientIDs:      ClientIDsMsg,
+	TypeDone:           DoneMsg,
+	TypeErr:            ErrMsg,
+	TypeUnknown:        UnknownMsg,
+	TypeHello:          HelloMsg,
+	TypeWelcome:        WelcomeMsg,
+	TypeSent:           SentMsg,
+	TypeDelivered:      DeliveredMsg,
+	TypeResume:         ResumeMsg,
+	TypeResumed:        ResumedMsg,
+	TypeLogin:          LoginMsg,
+	TypeAuth:           AuthMsg,
+	TypeJoin:           JoinMsg,
+	TypePart:           PartMsg,
+	TypeRooms:          RoomsMsg,
+	TypeRoomList:       RoomsMsg,
+	TypeRoomIncoming:   IncomingMsg,
+	TypeJoined:         JoinedMsg,
+	TypeLeft:           LeftMsg,
+	TypePing:           PingMsg,
+	TypePong:           PongMsg,
+	TypeServerShutdown: ServerShutdownMsg,
+	TypeError:          ErrorMsg,
+	TypeCommand:        CommandMsg,
+	TypeText:           TextMsg,
+	TypeRefused:        RefusedMsg,
+}
+
+// String returns the message name associated with t
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE(%d)", byte(t))
+}
+
+// requestTypes are the types of the frames sent by clients, DELIVERED is
+// sent both ways
+var requestTypes = map[Type]bool{
+	TypeIdentity:  true,
+	TypeList:      true,
+	TypeSend:      true,
+	TypeHello:     true,
+	TypeDelivered: true,
+	TypeResume:    true,
+	TypeLogin:     true,
+	TypeAuth:      true,
+	TypeJoin:      true,
+	TypePart:      true,
+	TypeRooms:     true,
+	TypePing:      true,
+	TypeCommand:   true,
+}
+
+// IsRequest tells whether frames of type t are sent by clients, the other
+// types are only sent by servers. Some of them share the name of a
+// request, like TypeRoomList and TypeRooms.
+func (t Type) IsRequest() bool {
+	return requestTypes[t]
+}
+
+var (
+	// ErrFrameTooLarge is returned when a frame payload exceeds MaxFrameSize
+	ErrFrameTooLarge = errors.New("protocol: frame too large")
+	// ErrMalformed is returned when a frame payload can not be decoded
+	ErrMalformed = errors.New("protocol: malformed payload")
+)
+
+// Message is implemented by every message which can be written both in
+// the line and in the framed format
+type Message interface {
+	Type() Type
+	Marshal() []byte
+	MarshalBinary() ([]byte, error)
+}
+
+// Unmarshaler is implemented by messages carrying arguments which can be
+// decoded from both formats
+type Unmarshaler interface {
+	Unmarshal(r *bufio.Reader) error
+	UnmarshalBinary(data []byte) error
+}
+
+// Frame is a raw decoded frame, RequestID is zero when the frame carries
+// no request id
+type Frame struct {
+	Type      Type
+	RequestID uint64
+	Payload   []byte
+}
+
+// AppendFrame appends the frame encoding of m to b
+func AppendFrame(b []byte, m Message) ([]byte, error) {
+	return AppendFrameWithID(b, m, 0)
+}
+
+// AppendFrameWithID appends the frame encoding of m tagged with request id
+// to b, a zero id is left out
+func AppendFrameWithID(b []byte, m Message, id uint64) ([]byte, error) {
+	payload, err := m.MarshalBinary()
+	if err != nil {
+		return b, err
+	}
+	b = appendFrameHeader(b, m.Type(), id, len(payload))
+	return append(b, payload...), nil
+}
+
+// appendFrameHeader appends the type, the request id and the length of a
+// frame carrying n bytes of payload to b
+func appendFrameHeader(b []byte, t Type, id uint64, n int) []byte {
+	if id == 0 {
+		b = append(b, byte(t))
+	} else {
+		b = append(b, byte(t)|RequestFlag)
+		b = appendUvarint(b, id)
+	}
+	return appendUvarint(b, uint64(n))
+}
+
+// MarshalFrame encodes m as a single frame
+func MarshalFrame(m Message) ([]byte, error) {
+	return AppendFrame(nil, m)
+}
+
+// WriteFrame encodes m as a frame and writes it to w
+func WriteFrame(w io.Writer, m Message) error {
+	return WriteFrameWithID(w, m, 0)
+}
+
+// WriteFrameWithID encodes m as a frame tagged with request id and writes
+// it to w
+func WriteFrameWithID(w io.Writer, m Message, id uint64) error {
+	b, err := AppendFrameWithID(nil, m, id)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadFrame reads the next frame from r
+func ReadFrame(r *bufio.Reader) (Frame, error) {
+	t, err := r.ReadByte()
+	if err != nil {
+		return Frame{}, err
+	}
+	var id uint64
+	if t&RequestFlag != 0 {
+		t &^= RequestFlag
+		id, err = binary.ReadUvarint(r)
+		if err != nil {
+			return Frame{}, unexpectedEOF(err)
+		}
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+	if n > MaxFrameSize {
+		return Frame{}, ErrFrameTooLarge
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+	return Frame{Type: Type(t), RequestID: id, Payload: payload}, nil
+}
+
+// Decode decodes the frame payload into m
+func (f Frame) Decode(m Unmarshaler) error {
+	if u, ok := m.(frameUnmarshaler); ok {
+		return u.unmarshalFrame(f.Type, f.Payload)
+	}
+	return m.UnmarshalBinary(f.Payload)
+}
+
+// frameUnmarshaler is implemented by msgs sent using more than one frame
+// type
+type frameUnmarshaler interface {
+	unmarshalFrame(t Type, data []byte) error
+}
+
+// Type returns the frame type of the identity msg
+func (m Identity) Type() Type { return TypeIdentity }
+
+// MarshalBinary encodes the identity msg payload
+func (m Identity) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// Type returns the frame type of the list msg
+func (m List) Type() Type { return TypeList }
+
+// MarshalBinary encodes the list msg payload
+func (m List) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// Type returns the frame type of the send msg
+func (m Send) Type() Type { return TypeSend }
+
+// MarshalBinary encodes the send msg payload as the recipient ids, the
+// recipient names including the prefixed room and the raw body
+func (m Send) MarshalBinary() ([]byte, error) {
+	b := appendIDs(nil, m.Recipients)
+	b = appendStrings(b, m.names())
+	return append(b, m.Body...), nil
+}
+
+// UnmarshalBinary decodes the send msg payload
+func (m *Send) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.Recipients = d.ids()
+	m.Names, m.Room = nil, ""
+	for _, name := range d.strings() {
+		if !strings.HasPrefix(name, RoomPrefix) {
+			m.Names = append(m.Names, name)
+			continue
+		}
+		if !m.addName(name) {
+			d.err = ErrMalformed
+		}
+	}
+	m.Body = d.rest()
+	if d.err != nil {
+		m.Recipients = nil
+		m.Names = nil
+		m.Room = ""
+		m.Body = nil
+	}
+	return d.err
+}
+
+// Type returns the frame type of the incoming msg, msgs sent to a room
+// use their own frame type since the room precedes the sender
+func (m Incoming) Type() Type {
+	if m.room != "" {
+		return TypeRoomIncoming
+	}
+	return TypeIncoming
+}
+
+// MarshalBinary encodes the incoming msg payload as the length-prefixed
+// room of msgs sent to a room, the sender id and the raw body
+func (m Incoming) MarshalBinary() ([]byte, error) {
+	var b []byte
+	if m.room != "" {
+		b = appendBytes(b, []byte(m.room))
+	}
+	b = appendUvarint(b, m.sender)
+	return append(b, m.body...), nil
+}
+
+// AppendFrameHead appends the frame encoding of the incoming msg tagged
+// with id up to its body to b, the raw body completes it
+func (m Incoming) AppendFrameHead(b []byte, id uint64) []byte {
+	n := uvarintLen(m.sender) + len(m.body)
+	if m.room != "" {
+		n += uvarintLen(uint64(len(m.room))) + len(m.room)
+	}
+	b = appendFrameHeader(b, m.Type(), id, n)
+	if m.room != "" {
+		b = appendUvarint(b, uint64(len(m.room)))
+		b = append(b, m.room...)
+	}
+	return appendUvarint(b, m.sender)
+}
+
+// UnmarshalBinary decodes the payload of an incoming msg sent to the
+// client directly
+func (m *Incoming) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.room = ""
+	m.sender = d.uvarint()
+	m.body = d.rest()
+	return d.err
+}
+
+// unmarshalFrame decodes the payload of incoming msgs of both frame types
+func (m *Incoming) unmarshalFrame(t Type, data []byte) error {
+	if t != TypeRoomIncoming {
+		return m.UnmarshalBinary(data)
+	}
+	d := decoder{b: data}
+	m.room = string(d.bytes())
+	m.sender = d.uvarint()
+	m.body = d.rest()
+	return d.err
+}
+
+// Type returns the frame type of the client id msg
+func (m ClientID) Type() Type { return TypeClientID }
+
+// MarshalBinary encodes the client id msg payload as the id and the raw
+// user name
+func (m ClientID) MarshalBinary() ([]byte, error) {
+	b := appendUvarint(nil, m.ID)
+	return append(b, m.Name...), nil
+}
+
+// UnmarshalBinary decodes the client id msg payload
+func (m *ClientID) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.ID = d.uvarint()
+	m.Name = string(d.rest())
+	return d.err
+}
+
+// Type returns the frame type of the client ids msg
+func (m ClientIDs) Type() Type { return TypeClientIDs }
+
+// MarshalBinary encodes the client ids msg payload
+func (m ClientIDs) MarshalBinary() ([]byte, error) {
+	return appendIDs(nil, m.IDs), nil
+}
+
+// UnmarshalBinary decodes the client ids msg payload
+func (m *ClientIDs) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.IDs = d.ids()
+	return d.end()
+}
+
+// Type returns the frame type of the done msg
+func (m Done) Type() Type { return TypeDone }
+
+// MarshalBinary encodes the done msg payload
+func (m Done) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// Type returns the frame type of the err msg
+func (m Err) Type() Type { return TypeErr }
+
+// MarshalBinary encodes the err msg payload
+func (m Err) MarshalBinary() ([]byte, error) {
+	return []byte(m.Text), nil
+}
+
+// UnmarshalBinary decodes the err msg payload
+func (m *Err) UnmarshalBinary(data []byte) error {
+	m.Text = string(data)
+	return nil
+}
+
+// Type returns the frame type of the unknown msg
+func (m Unknown) Type() Type { return TypeUnknown }
+
+// MarshalBinary encodes the unknown msg payload
+func (m Unknown) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// Type returns the frame type of the error msg
+func (m Error) Type() Type { return TypeError }
+
+// MarshalBinary encodes the error msg payload
+func (m Error) MarshalBinary() ([]byte, error) {
+	b := appendUvarint(nil, uint64(m.Code))
+	return append(b, m.Text...), nil
+}
+
+// UnmarshalBinary decodes the error msg payload
+func (m *Error) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.Code = ErrorCode(d.uvarint())
+	m.Text = string(d.rest())
+	return d.err
+}
+
+// Type returns the frame type of the hello msg
+func (m Hello) Type() Type { return TypeHello }
+
+// MarshalBinary encodes the hello msg payload
+func (m Hello) MarshalBinary() ([]byte, error) {
+	b := appendUvarint(nil, m.Version)
+	return appendStrings(b, m.Capabilities), nil
+}
+
+// UnmarshalBinary decodes the hello msg payload
+func (m *Hello) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.Version = d.uvarint()
+	m.Capabilities = d.strings()
+	return d.end()
+}
+
+// Type returns the frame type of the welcome msg
+func (m Welcome) Type() Type { return TypeWelcome }
+
+// MarshalBinary encodes the welcome msg payload
+func (m Welcome) MarshalBinary() ([]byte, error) {
+	b := appendUvarint(nil, m.Version)
+	return appendStrings(b, m.Capabilities), nil
+}
+
+// UnmarshalBinary decodes the welcome msg payload
+func (m *Welcome) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.Version = d.uvarint()
+	m.Capabilities = d.strings()
+	return d.end()
+}
+
+// Type returns the frame type of the sent msg
+func (m Sent) Type() Type { return TypeSent }
+
+// MarshalBinary encodes the sent msg payload as the message id followed by
+// the delivered, unknown, failed and queued recipients
+func (m Sent) MarshalBinary() ([]byte, error) {
+	b := appendUvarint(nil, m.MessageID)
+	b = appendIDs(b, m.Delivered)
+	b = appendIDs(b, m.Unknown)
+	b = appendIDs(b, m.Failed)
+	return appendIDs(b, m.Queued), nil
+}
+
+// UnmarshalBinary decodes the sent msg payload
+func (m *Sent) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.MessageID = d.uvarint()
+	m.Delivered = d.ids()
+	m.Unknown = d.ids()
+	m.Failed = d.ids()
+	m.Queued = d.ids()
+	return d.end()
+}
+
+// Type returns the frame type of the delivered msg
+func (m Delivered) Type() Type { return TypeDelivered }
+
+// MarshalBinary encodes the delivered msg payload
+func (m Delivered) MarshalBinary() ([]byte, error) {
+	b := appendUvarint(nil, m.MessageID)
+	return appendUvarint(b, m.Recipient), nil
+}
+
+// UnmarshalBinary decodes the delivered msg payload
+func (m *Delivered) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.MessageID = d.uvarint()
+	m.Recipient = d.uvarint()
+	return d.end()
+}
+
+// Type returns the frame type of the resume msg
+func (m Resume) Type() Type { return TypeResume }
+
+// MarshalBinary encodes the resume msg payload as the raw token
+func (m Resume) MarshalBinary() ([]byte, error) {
+	return []byte(m.Token), nil
+}
+
+// UnmarshalBinary decodes the resume msg payload
+func (m *Resume) UnmarshalBinary(data []byte) error {
+	m.Token = string(data)
+	return nil
+}
+
+// Type returns the frame type of the resumed msg
+func (m Resumed) Type() Type { return TypeResumed }
+
+// MarshalBinary encodes the resumed msg payload
+func (m Resumed) MarshalBinary() ([]byte, error) {
+	b := appendUvarint(nil, m.ID)
+	return append(b, m.Token...), nil
+}
+
+// UnmarshalBinary decodes the resumed msg payload
+func (m *Resumed) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.ID = d.uvarint()
+	m.Token = string(d.rest())
+	return d.err
+}
+
+// Type returns the frame type of the login msg
+func (m Login) Type() Type { return TypeLogin }
+
+// MarshalBinary encodes the login msg payload as the raw name
+func (m Login) MarshalBinary() ([]byte, error) {
+	return []byte(m.Name), nil
+}
+
+// UnmarshalBinary decodes the login msg payload
+func (m *Login) UnmarshalBinary(data []byte) error {
+	m.Name = string(data)
+	return nil
+}
+
+// Type returns the frame type of the auth msg
+func (m Auth) Type() Type { return TypeAuth }
+
+// MarshalBinary encodes the auth msg payload as the length-prefixed method
+// and user name followed by the raw secret
+func (m Auth) MarshalBinary() ([]byte, error) {
+	b := appendBytes(nil, []byte(m.Method))
+	b = appendBytes(b, []byte(m.Username))
+	return append(b, m.Secret...), nil
+}
+
+// UnmarshalBinary decodes the auth msg payload
+func (m *Auth) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.Method = string(d.bytes())
+	m.Username = string(d.bytes())
+	m.Secret = string(d.rest())
+	return d.err
+}
+
+// Type returns the frame type of the join msg
+func (m Join) Type() Type { return TypeJoin }
+
+// MarshalBinary encodes the join msg payload as the raw room
+func (m Join) MarshalBinary() ([]byte, error) {
+	return []byte(m.Room), nil
+}
+
+// UnmarshalBinary decodes the join msg payload
+func (m *Join) UnmarshalBinary(data []byte) error {
+	m.Room = string(data)
+	return nil
+}
+
+// Type returns the frame type of the part msg
+func (m Part) Type() Type { return TypePart }
+
+// MarshalBinary encodes the part msg payload as the raw room
+func (m Part) MarshalBinary() ([]byte, error) {
+	return []byte(m.Room), nil
+}
+
+// UnmarshalBinary decodes the part msg payload
+func (m *Part) UnmarshalBinary(data []byte) error {
+	m.Room = string(data)
+	return nil
+}
+
+// Type returns the frame type of the rooms msg
+func (m Rooms) Type() Type { return TypeRooms }
+
+// MarshalBinary encodes the rooms msg, it has no payload
+func (m Rooms) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// Type returns the frame type of the room list response
+func (m RoomList) Type() Type { return TypeRoomList }
+
+// MarshalBinary encodes the room list response payload as the rooms
+func (m RoomList) MarshalBinary() ([]byte, error) {
+	return appendStrings(nil, m.Rooms), nil
+}
+
+// UnmarshalBinary decodes the room list response payload
+func (m *RoomList) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.Rooms = d.strings()
+	return d.end()
+}
+
+// Type returns the frame type of the joined event
+func (m Joined) Type() Type { return TypeJoined }
+
+// MarshalBinary encodes the joined event payload like a client id
+func (m Joined) MarshalBinary() ([]byte, error) {
+	return NewUserID(m.ID, m.Name).MarshalBinary()
+}
+
+// UnmarshalBinary decodes the joined event payload
+func (m *Joined) UnmarshalBinary(data []byte) error {
+	var id ClientID
+	err := id.UnmarshalBinary(data)
+	m.ID, m.Name = id.ID, id.Name
+	return err
+}
+
+// Type returns the frame type of the left event
+func (m Left) Type() Type { return TypeLeft }
+
+// MarshalBinary encodes the left event payload as the client id
+func (m Left) MarshalBinary() ([]byte, error) {
+	return appendUvarint(nil, m.ID), nil
+}
+
+// UnmarshalBinary decodes the left event payload
+func (m *Left) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	m.ID = d.uvarint()
+	return d.end()
+}
+
+// Type returns the frame type of the command msg
+func (m Command) Type() Type { return TypeCommand }
+
+// MarshalBinary encodes the command msg payload as the list of the name
+// and the arguments
+func (m Command) MarshalBinary() ([]byte, error) {
+	return appendStrings(nil, append([]string{m.Name}, m.Args...)), nil
+}
+
+// UnmarshalBinary decodes the command msg payload
+func (m *Command) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	ss := d.strings()
+	if err := d.end(); err != nil {
+		return err
+	}
+	if len(ss) == 0 {
+		return ErrMalformed
+	}
+	m.Name, m.Args = ss[0], ss[1:]
+	return nil
+}
+
+// Type returns the frame type of the text msg
+func (m Text) Type() Type { return TypeText }
+
+// MarshalBinary encodes the text msg payload
+func (m Text) MarshalBinary() ([]byte, error) {
+	return []byte(m.Body), nil
+}
+
+// UnmarshalBinary decodes the text msg payload
+func (m *Text) UnmarshalBinary(data []byte) error {
+	m.Body = string(data)
+	return nil
+}
+
+// Type returns the frame type of the ping msg
+func (m Ping) Type() Type { return TypePing }
+
+// MarshalBinary encodes the ping msg, it has no payload
+func (m Ping) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// Type returns the frame type of the pong response
+func (m Pong) Type() Type { return TypePong }
+
+// MarshalBinary encodes the pong response, it has no payload
+func (m Pong) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// UnmarshalBinary decodes the pong response
+func (m *Pong) UnmarshalBinary(data []byte) error {
+	d := decoder{b: data}
+	return d.end()
+}
+
+// Type returns the frame type of the server shutdown event
+func (m ServerShutdown) Type() Type { return TypeServerShutdown }
+
+// MarshalBinary encodes the server shutdown event, it has no payload
+func (m ServerShutdown) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// Type returns the frame type of the refused event
+func (m Refused) Type() Type { return TypeRefused }
+
+// MarshalBinary encodes the refused event payload as the raw reason
+func (m Refused) MarshalBinary() ([]byte, error) {
+	return []byte(m.Reason), nil
+}
+
+// UnmarshalBinary decodes the refused event payload
+func (m *Refused) UnmarshalBinary(data []byte) error {
+	m.Reason = string(data)
+	return nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// uvarintLen returns the number of bytes appendUvarint appends for v
+func uvarintLen(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+func appendIDs(b []byte, ids []uint64) []byte {
+	b = appendUvarint(b, uint64(len(ids)))
+	for _, id := range ids {
+		b = appendUvarint(b, id)
+	}
+	return b
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendStrings(b []byte, ss []string) []byte {
+	b = appendUvarint(b, uint64(len(ss)))
+	for _, s := range ss {
+		b = appendBytes(b, []byte(s))
+	}
+	return b
+}
+
+// decoder reads values from a frame payload and keeps the first error so
+// callers can check it once after decoding all the fields
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrMalformed
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) ids() []uint64 {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	// every id takes at least one byte, anything else is a lie
+	if n > uint64(len(d.b)) {
+		d.err = ErrMalformed
+		return nil
+	}
+	var ids []uint64
+	for i := uint64(0); i < n; i++ {
+		ids = append(ids, d.uvarint())
+	}
+	if d.err != nil {
+		return nil
+	}
+	return ids
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)) {
+		d.err = ErrMalformed
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) strings() []string {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)) {
+		d.err = ErrMalformed
+		return nil
+	}
+	var ss []string
+	for i := uint64(0); i < n; i++ {
+		ss = append(ss, string(d.bytes()))
+	}
+	if d.err != nil {
+		return nil
+	}
+	return ss
+}
+
+func (d *decoder) rest() []byte {
+	if d.err != nil {
+		return nil
+	}
+	v := d.b
+	d.b = nil
+	return v
+}
+
+func (d *decoder) end() error {
+	if d.err == nil && len(d.b) != 0 {
+		d.err = ErrMalformed
+	}
+	return d.err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,326 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestMarshalFrame(t *testing.T) {
+	tt := []struct {
+		given Message
+		want  []byte
+	}{
+		{
+			given: NewIdentity(),
+			want:  []byte{byte(TypeIdentity), 0},
+		},
+		{
+			given: NewList(),
+			want:  []byte{byte(TypeList), 0},
+		},
+		{
+			given: NewSend([]uint64{1, 300}, []byte("Hi\n")),
+			want:  []byte{byte(TypeSend), 8, 2, 1, 0xac, 0x02, 0, 'H', 'i', '\n'},
+		},
+		{
+			given: NewSendTo([]uint64{1}, []string{"bob"}, []byte("Hi")),
+			want:  []byte{byte(TypeSend), 9, 1, 1, 1, 3, 'b', 'o', 'b', 'H', 'i'},
+		},
+		{
+			given: NewIncoming(2, []byte(" Hi ")),
+			want:  []byte{byte(TypeIncoming), 5, 2, ' ', 'H', 'i', ' '},
+		},
+		{
+			given: NewClientIDs([]uint64{}),
+			want:  []byte{byte(TypeClientIDs), 1, 0},
+		},
+	}
+
+	for _, tc := range tt {
+		actual, err := MarshalFrame(tc.given)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, actual)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	tt := []struct {
+		given []byte
+		want  Frame
+		err   error
+	}{
+		{
+			given: []byte{byte(TypeList), 0},
+			want:  Frame{Type: TypeList, Payload: []byte{}},
+			err:   nil,
+		},
+		{
+			given: []byte{byte(TypeErr), 2, 'N', 'O'},
+			want:  Frame{Type: TypeErr, Payload: []byte("NO")},
+			err:   nil,
+		},
+		{
+			given: []byte{},
+			want:  Frame{},
+			err:   io.EOF,
+		},
+		{
+			given: []byte{byte(TypeErr), 3, 'N', 'O'},
+			want:  Frame{},
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			given: []byte{byte(TypeSend), 0xff, 0xff, 0xff, 0x7f},
+			want:  Frame{},
+			err:   ErrFrameTooLarge,
+		},
+	}
+
+	for _, tc := range tt {
+		f, err := ReadFrame(bufio.NewReader(bytes.NewBuffer(tc.given)))
+		assert.Equal(t, tc.err, err)
+		assert.Equal(t, tc.want, f)
+	}
+}
+
+func TestSend_UnmarshalBinary(t *testing.T) {
+	tt := []struct {
+		given      []byte
+		recipients []uint64
+		names      []string
+		body       []byte
+		hasErr     bool
+	}{
+		{
+			given:      []byte{2, 1, 2, 0, ' ', 'H', 'i', '\n', '\n'},
+			recipients: []uint64{1, 2},
+			names:      []string(nil),
+			body:       []byte(" Hi\n\n"),
+			hasErr:     false,
+		},
+		{
+			given:      []byte{1, 3, 0},
+			recipients: []uint64{3},
+			names:      []string(nil),
+			body:       []byte{},
+			hasErr:     false,
+		},
+		{
+			given:      []byte{0, 1, 2, 'b', 'o'},
+			recipients: []uint64(nil),
+			names:      []string{"bo"},
+			body:       []byte{},
+			hasErr:     false,
+		},
+		{
+			given:      []byte{5, 1},
+			recipients: []uint64(nil),
+			names:      []string(nil),
+			body:       []byte(nil),
+			hasErr:     true,
+		},
+		{
+			given:      []byte{},
+			recipients: []uint64(nil),
+			names:      []string(nil),
+			body:       []byte(nil),
+			hasErr:     true,
+		},
+	}
+
+	for _, tc := range tt {
+		msg := Send{}
+		err := msg.UnmarshalBinary(tc.given)
+		if tc.hasErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.EqualValues(t, tc.recipients, msg.Recipients)
+		assert.Equal(t, tc.names, msg.Names)
+		assert.Equal(t, tc.body, msg.Body)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	body := []byte("\tline 1\n  line 2\n")
+	assert.NoError(t, WriteFrame(buf, NewIncoming(42, body)))
+	assert.NoError(t, WriteFrame(buf, NewClientID(7)))
+
+	r := bufio.NewReader(buf)
+	f, err := ReadFrame(r)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeIncoming, f.Type)
+	incoming := Incoming{}
+	assert.NoError(t, f.Decode(&incoming))
+	assert.Equal(t, uint64(42), incoming.Sender())
+	assert.Equal(t, body, incoming.Body())
+
+	f, err = ReadFrame(r)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeClientID, f.Type)
+	id := ClientID{}
+	assert.NoError(t, f.Decode(&id))
+	assert.Equal(t, uint64(7), id.ID)
+}
+
+func TestHello_BinaryRoundTrip(t *testing.T) {
+	b, err := NewHello(3, []string{CapFraming, CapAcks}).MarshalBinary()
+	assert.NoError(t, err)
+
+	msg := Hello{}
+	assert.NoError(t, msg.UnmarshalBinary(b))
+	assert.Equal(t, uint64(3), msg.Version)
+	assert.Equal(t, []string{CapFraming, CapAcks}, msg.Capabilities)
+
+	assert.Equal(t, ErrMalformed, msg.UnmarshalBinary([]byte{1, 2, 9}))
+}
+
+func TestFrameWithID(t *testing.T) {
+	b, err := AppendFrameWithID(nil, NewDone(), 300)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{byte(TypeDone) | RequestFlag, 0xac, 0x02, 0}, b)
+
+	f, err := ReadFrame(bufio.NewReader(bytes.NewBuffer(b)))
+	assert.NoError(t, err)
+	assert.Equal(t, Frame{Type: TypeDone, RequestID: 300, Payload: []byte{}}, f)
+}
+
+func TestIncoming_AppendFrameHead(t *testing.T) {
+	body := make([]byte, 300)
+	for _, msg := range []*Incoming{NewIncoming(7, []byte("Hi")), NewRoomIncoming(300, "deploys", body)} {
+		for _, id := range []uint64{0, 42} {
+			want, err := AppendFrameWithID(nil, msg, id)
+			assert.NoError(t, err)
+			b := append(msg.AppendFrameHead(nil, id), msg.Body()...)
+			assert.Equal(t, want, b)
+		}
+	}
+}
+
+func TestSent_BinaryRoundTrip(t *testing.T) {
+	given := NewSent(300, []uint64{1}, []uint64{2, 3}, nil, []uint64{4})
+	b, err := given.MarshalBinary()
+	assert.NoError(t, err)
+
+	actual := Sent{}
+	assert.NoError(t, actual.UnmarshalBinary(b))
+	assert.Equal(t, *given, actual)
+}
+
+func TestAuth_BinaryRoundTrip(t *testing.T) {
+	for _, given := range []*Auth{NewPasswordAuth("alice", " wonder\nland "), NewBearerAuth("t0k3n")} {
+		b, err := given.MarshalBinary()
+		assert.NoError(t, err)
+
+		actual := Auth{}
+		assert.NoError(t, actual.UnmarshalBinary(b))
+		assert.Equal(t, *given, actual)
+	}
+
+	assert.Equal(t, ErrMalformed, (&Auth{}).UnmarshalBinary([]byte{9, 'p'}))
+}
+
+func TestRoomFrames(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, WriteFrame(buf, NewRoomIncoming(42, "deploys", []byte("Hi"))))
+	assert.NoError(t, WriteFrame(buf, NewRoomSend("deploys", []byte("Hi"))))
+
+	r := bufio.NewReader(buf)
+	f, err := ReadFrame(r)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeRoomIncoming, f.Type)
+	incoming := Incoming{}
+	assert.NoError(t, f.Decode(&incoming))
+	assert.Equal(t, *NewRoomIncoming(42, "deploys", []byte("Hi")), incoming)
+
+	f, err = ReadFrame(r)
+	assert.NoError(t, err)
+	send := Send{}
+	assert.NoError(t, f.Decode(&send))
+	assert.Equal(t, "deploys", send.Room)
+	assert.Empty(t, send.Names)
+
+	b, err := NewSendTo(nil, []string{"#a", "#b"}, nil).MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, ErrMalformed, send.UnmarshalBinary(b))
+}
+
+func TestPresence_BinaryRoundTrip(t *testing.T) {
+	b, err := NewJoined(300, "alice").MarshalBinary()
+	assert.NoError(t, err)
+	joined := Joined{}
+	assert.NoError(t, joined.UnmarshalBinary(b))
+	assert.Equal(t, *NewJoined(300, "alice"), joined)
+
+	b, err = NewLeft(300).MarshalBinary()
+	assert.NoError(t, err)
+	left := Left{}
+	assert.NoError(t, left.UnmarshalBinary(b))
+	assert.Equal(t, *NewLeft(300), left)
+	assert.Equal(t, ErrMalformed, left.UnmarshalBinary(append(b, 0)))
+}
+
+func TestPing_Frames(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteFrameWithID(&buf, NewPing(), 3))
+	assert.NoError(t, WriteFrameWithID(&buf, NewPong(), 3))
+	r := bufio.NewReader(&buf)
+
+	f, err := ReadFrame(r)
+	assert.NoError(t, err)
+	assert.Equal(t, PingMsg, f.Type.String())
+	assert.Equal(t, uint64(3), f.RequestID)
+
+	f, err = ReadFrame(r)
+	assert.NoError(t, err)
+	assert.Equal(t, TypePong, f.Type)
+	assert.NoError(t, f.Decode(&Pong{}))
+	assert.Equal(t, ErrMalformed, (&Pong{}).UnmarshalBinary([]byte{0}))
+}
+
+func TestError_BinaryRoundTrip(t *testing.T) {
+	b, err := NewErrorDetail(CodeUnknownUser, "bob").MarshalBinary()
+	assert.NoError(t, err)
+	e := Error{}
+	assert.NoError(t, e.UnmarshalBinary(b))
+	assert.Equal(t, *NewErrorDetail(CodeUnknownUser, "bob"), e)
+	assert.Equal(t, ErrMalformed, e.UnmarshalBinary(nil))
+	assert.Equal(t, ErrorMsg, TypeError.String())
+}
+
+func TestCommand_BinaryRoundTrip(t *testing.T) {
+	b, err := NewCommand("DEPLOY-STATUS", "prod", "").MarshalBinary()
+	assert.NoError(t, err)
+	m := Command{}
+	assert.NoError(t, m.UnmarshalBinary(b))
+	assert.Equal(t, *NewCommand("DEPLOY-STATUS", "prod", ""), m)
+	assert.Equal(t, ErrMalformed, m.UnmarshalBinary([]byte{0}))
+
+	b, err = NewText("all green").MarshalBinary()
+	assert.NoError(t, err)
+	text := Text{}
+	assert.NoError(t, text.UnmarshalBinary(b))
+	assert.Equal(t, "all green", text.Body)
+}
+
+func TestRefused(t *testing.T) {
+	msg := NewRefused(RefusedServerFull)
+	assert.Equal(t, "REFUSED\nSERVER FULL\n", string(msg.Marshal()))
+	actual := Refused{}
+	assert.NoError(t, actual.Unmarshal(bufio.NewReader(bytes.NewBufferString("SERVER FULL\n"))))
+	assert.Equal(t, *msg, actual)
+
+	b, err := MarshalFrame(msg)
+	assert.NoError(t, err)
+	f, err := ReadFrame(bufio.NewReader(bytes.NewBuffer(b)))
+	assert.NoError(t, err)
+	assert.Equal(t, RefusedMsg, f.Type.String())
+	actual = Refused{}
+	assert.NoError(t, f.Decode(&actual))
+	assert.Equal(t, *msg, actual)
+}
@@ -0,0 +1,1405 @@
+package protocol
+
+// message package represents the protocol
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// IdentityMsg message name
+	IdentityMsg = "IDENTITY"
+	// ListMsg message name
+	ListMsg = "LIST"
+	// SendMsg message name
+	SendMsg = "SEND"
+	// IncomingMsg message name
+	IncomingMsg = "INCOMING"
+	// ClientIDMsg response name
+	ClientIDMsg = "CLIENT-ID"
+	// ClientIDsMsg response name
+	ClientIDsMsg = "CLIENT-IDS"
+	// DoneMsg response name
+	DoneMsg = "DONE"
+	// ErrMsg response name
+	ErrMsg = "ERR"
+	// UnknownMsg response name
+	UnknownMsg = "UNKNOWN MESSAGE"
+	// ErrorMsg response name
+	ErrorMsg = "ERROR"
+	// CommandMsg names the frames carrying custom commands
+	CommandMsg = "COMMAND"
+	// TextMsg response name
+	TextMsg = "TEXT"
+	// HelloMsg message name
+	HelloMsg = "HELLO"
+	// WelcomeMsg response name
+	WelcomeMsg = "WELCOME"
+	// SentMsg response name
+	SentMsg = "SENT"
+	// DeliveredMsg message name
+	DeliveredMsg = "DELIVERED"
+	// ResumeMsg message name
+	ResumeMsg = "RESUME"
+	// ResumedMsg response name
+	ResumedMsg = "RESUMED"
+	// LoginMsg message name
+	LoginMsg = "LOGIN"
+	// AuthMsg message name
+	AuthMsg = "AUTH"
+	// JoinMsg message name
+	JoinMsg = "JOIN"
+	// PartMsg message name
+	PartMsg = "PART"
+	// RoomsMsg message and response name
+	RoomsMsg = "ROOMS"
+	// JoinedMsg event name
+	JoinedMsg = "JOINED"
+	// LeftMsg event name
+	LeftMsg = "LEFT"
+	// PingMsg message name
+	PingMsg = "PING"
+	// PongMsg response name
+	PongMsg = "PONG"
+	// ServerShutdownMsg event name
+	ServerShutdownMsg = "SERVER_SHUTDOWN"
+	// RefusedMsg event name
+	RefusedMsg = "REFUSED"
+)
+
+// Reasons of REFUSED events
+const (
+	RefusedServerFull    = "SERVER FULL"
+	RefusedTooManyFromIP = "TOO MANY CONNECTIONS FROM ADDRESS"
+	RefusedAddressDenied = "ADDRESS NOT ALLOWED"
+)
+
+// RoomPrefix marks room names where they can be mistaken for user names,
+// like the recipients of SEND msgs (`#deploys`)
+const RoomPrefix = "#"
+
+const (
+	// ProtocolVersion is the newest protocol version implemented by this
+	// package
+	ProtocolVersion uint64 = 3
+	// MinProtocolVersion is the oldest protocol version still supported
+	MinProtocolVersion uint64 = 1
+
+	// SendResultsVersion is the first protocol version answering SEND
+	// msgs with SENT instead of DONE
+	SendResultsVersion uint64 = 2
+	// ErrorCodesVersion is the first protocol version answering failed
+	// msgs with ERROR instead of ERR and UNKNOWN MESSAGE
+	ErrorCodesVersion uint64 = 3
+)
+
+// Capabilities which can be negotiated with HELLO
+const (
+	// CapFraming switches the connection to the framed protocol once the
+	// handshake is done
+	CapFraming = "framing"
+	// CapAcks enables delivery acknowledgements
+	CapAcks = "acks"
+	// CapRequestIDs tells the client every response echoes the request id
+	// of its request
+	CapRequestIDs = "request-ids"
+	// CapPresence subscribes the client to the JOINED and LEFT events of
+	// the other clients
+	CapPresence = "presence"
+)
+
+// Authentication methods of AUTH msgs
+const (
+	// AuthPassword authenticates a user name with its password
+	AuthPassword = "password"
+	// AuthBearer authenticates with a pre-shared token
+	AuthBearer = "bearer"
+	// AuthCertificate authenticates with the certificate the client
+	// presented during the TLS handshake, it carries no secret
+	AuthCertificate = "certificate"
+)
+
+// UnsupportedVersion is the ERR response text sent when a HELLO msg
+// carries a version the server can not speak
+const UnsupportedVersion = "UNSUPPORTED VERSION"
+
+// VersionError is returned when client and server can not agree on a
+// protocol version
+type VersionError struct {
+	Version uint64
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("protocol: unsupported protocol version %d, supported %d-%d",
+		e.Version, MinProtocolVersion, ProtocolVersion)
+}
+
+// ReadStringArg reads a string terminated in `newline` from `r`
+// trims the `newline`
+func ReadStringArg(r *bufio.Reader) (string, error) {
+	arg, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	arg = strings.TrimSpace(arg)
+	return arg, nil
+}
+
+// ReadBytesArg reads an array of bytes terminated in `newline` from `r`
+// trims the `newline`
+func ReadBytesArg(r *bufio.Reader) ([]byte, error) {
+	arg, err := r.ReadBytes('\n')
+	if err != nil {
+		return []byte{}, err
+	}
+	arg = bytes.TrimSpace(arg)
+	return arg, nil
+}
+
+// Read reads a message or command from r, trims it and convert it
+// to uppercase and then return it
+func Read(r *bufio.Reader) (string, error) {
+	msg, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return CommandName(msg), nil
+}
+
+// CommandName returns the name of the command or message msg, trimmed and
+// converted to uppercase like Read does
+func CommandName(msg string) string {
+	return strings.ToUpper(strings.TrimSpace(msg))
+}
+
+// RequestIDPrefix marks the request id of a line protocol message, it is
+// appended to the command line of requests (`LIST #7`) and prepended to
+// the line of their responses (`#7 1,2`)
+const RequestIDPrefix = "#"
+
+// ReadCommand reads a message or command like Read and splits the optional
+// request id off it, a zero id means the command had none
+func ReadCommand(r *bufio.Reader) (string, uint64, error) {
+	msg, err := Read(r)
+	if err != nil {
+		return "", 0, err
+	}
+	i := strings.LastIndex(msg, " "+RequestIDPrefix)
+	if i < 0 {
+		return msg, 0, nil
+	}
+	id, err := strconv.ParseUint(msg[i+len(RequestIDPrefix)+1:], 10, 64)
+	if err != nil {
+		return msg, 0, nil
+	}
+	return strings.TrimSpace(msg[:i]), id, nil
+}
+
+// SplitRequestID splits the request id prefix off a response line, a zero
+// id means the response had none
+func SplitRequestID(line string) (uint64, string) {
+	if !strings.HasPrefix(line, RequestIDPrefix) {
+		return 0, line
+	}
+	i := strings.Index(line, " ")
+	if i < 0 {
+		i = len(line)
+	}
+	id, err := strconv.ParseUint(line[len(RequestIDPrefix):i], 10, 64)
+	if err != nil {
+		return 0, line
+	}
+	return id, strings.TrimSpace(line[i:])
+}
+
+// MarshalWithID encodes m in the line protocol tagged with request id, a
+// zero id is left out
+func MarshalWithID(m Message, id uint64) []byte {
+	b := m.Marshal()
+	if id == 0 {
+		return b
+	}
+	tag := RequestIDPrefix + strconv.FormatUint(id, 10)
+	if !isRequest(m.Type()) {
+		return append([]byte(tag+" "), b...)
+	}
+	i := bytes.IndexByte(b, '\n')
+	out := make([]byte, 0, len(b)+len(tag)+1)
+	out = append(out, b[:i]...)
+	out = append(out, ' ')
+	out = append(out, tag...)
+	return append(out, b[i:]...)
+}
+
+// isRequest reports whether messages of type t are sent by clients
+func isRequest(t Type) bool {
+	switch t {
+	case TypeIdentity, TypeList, TypeSend, TypeHello, TypeResume, TypeLogin, TypeAuth,
+		TypeJoin, TypePart, TypeRooms, TypePing, TypeCommand:
+		return true
+	}
+	return false
+}
+
+// Identity represents an IDENTITY msg structure
+type Identity struct{}
+
+// NewIdentity creates a new instance of identity message
+func NewIdentity() *Identity {
+	return &Identity{}
+}
+
+// Marshal encodes the identity msg
+func (m Identity) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n", IdentityMsg))
+}
+
+// List represents an LIST msg structure
+type List struct{}
+
+// NewList creates a new instance of list message
+func NewList() *List {
+	return &List{}
+}
+
+// Marshal encodes the list msg
+func (m List) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n", ListMsg))
+}
+
+// Send represents an SEND msg structure, recipients are addressed by id or
+// by user name. Msgs sent to a room reach all its members, the room is
+// given as a recipient prefixed with RoomPrefix.
+type Send struct {
+	Recipients []uint64
+	Names      []string
+	Room       string
+	Body       []byte
+}
+
+// NewSend creates a new instance of send message
+func NewSend(rr []uint64, b []byte) *Send {
+	return &Send{
+		Recipients: rr,
+		Body:       b,
+	}
+}
+
+// NewSendTo creates a new instance of send message addressing recipients
+// by id and by name
+func NewSendTo(rr []uint64, names []string, b []byte) *Send {
+	return &Send{
+		Recipients: rr,
+		Names:      names,
+		Body:       b,
+	}
+}
+
+// NewRoomSend creates a new instance of send message addressing the
+// members of room
+func NewRoomSend(room string, b []byte) *Send {
+	return &Send{
+		Room: room,
+		Body: b,
+	}
+}
+
+// Marshal encodes the send msg
+func (m Send) Marshal() []byte {
+	rr := joinRecipients(m.Recipients)
+	for _, name := range m.names() {
+		if rr != "" {
+			rr += ","
+		}
+		rr += name
+	}
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n", SendMsg, rr, string(m.Body)))
+}
+
+// Unmarshal decodes the send msg, recipients which are not numbers are
+// user names
+func (m *Send) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	rr := strings.Split(s, ",")
+
+	var parseErr error
+	for _, recipient := range rr {
+		id, err := strconv.ParseUint(recipient, 10, 64)
+		if err == nil {
+			m.Recipients = append(m.Recipients, id)
+			continue
+		}
+		if !m.addName(recipient) {
+			m.Recipients = nil
+			m.Names = nil
+			m.Room = ""
+			parseErr = fmt.Errorf("protocol: invalid recipient %q", recipient)
+			break
+		}
+	}
+
+	// the body is consumed even when the recipients are invalid so the
+	// next message can still be read
+	m.Body, err = ReadBytesArg(r)
+	if err != nil || parseErr != nil {
+		m.Body = nil
+	}
+	if parseErr != nil {
+		return parseErr
+	}
+	return err
+}
+
+// names returns the user names followed by the prefixed room
+func (m Send) names() []string {
+	if m.Room == "" {
+		return m.Names
+	}
+	return append(m.Names[:len(m.Names):len(m.Names)], RoomPrefix+m.Room)
+}
+
+// addName adds a user name or a prefixed room to the recipients, a msg is
+// sent to a single room at most
+func (m *Send) addName(name string) bool {
+	if !strings.HasPrefix(name, RoomPrefix) {
+		if !ValidName(name) {
+			return false
+		}
+		m.Names = append(m.Names, name)
+		return true
+	}
+	room := name[len(RoomPrefix):]
+	if m.Room != "" || !ValidName(room) {
+		return false
+	}
+	m.Room = room
+	return true
+}
+
+// Incoming represents an INCOMING msg structure. Clients which agreed on
+// CapAcks get it tagged with the msg id to acknowledge, the same way
+// responses are tagged with request ids. Msgs sent to a room carry its name
+// after the sender (`7 #deploys`).
+type Incoming struct {
+	sender uint64
+	room   string
+	body   []byte
+}
+
+// NewIncoming creates a new instance of incoming message
+func NewIncoming(s uint64, b []byte) *Incoming {
+	return &Incoming{
+		sender: s,
+		body:   b,
+	}
+}
+
+// NewRoomIncoming creates a new instance of incoming message sent to room
+func NewRoomIncoming(s uint64, room string, b []byte) *Incoming {
+	return &Incoming{
+		sender: s,
+		room:   room,
+		body:   b,
+	}
+}
+
+// Sender returns the id of the client who sent the msg
+func (m Incoming) Sender() uint64 {
+	return m.sender
+}
+
+// Room returns the room the msg was sent to, it is empty for msgs sent to
+// the client directly
+func (m Incoming) Room() string {
+	return m.room
+}
+
+// Body returns the msg payload
+func (m Incoming) Body() []byte {
+	return m.body
+}
+
+// Marshal encodes the incoming msg
+func (m Incoming) Marshal() []byte {
+	b := make([]byte, 0, len(IncomingMsg)+len(m.room)+len(m.body)+24)
+	b = m.AppendHead(b, 0)
+	b = append(b, m.body...)
+	return append(b, '\n')
+}
+
+// AppendHead appends the line encoding of the incoming msg tagged with id
+// up to its body to b, the body and a newline complete it. Servers fanning
+// a msg out to many clients write the body shared by all of them after
+// the head instead of copying it.
+func (m Incoming) AppendHead(b []byte, id uint64) []byte {
+	if id != 0 {
+		b = append(b, RequestIDPrefix...)
+		b = strconv.AppendUint(b, id, 10)
+		b = append(b, ' ')
+	}
+	b = append(b, IncomingMsg...)
+	b = append(b, '\n')
+	b = strconv.AppendUint(b, m.sender, 10)
+	if m.room != "" {
+		b = append(b, ' ')
+		b = append(b, RoomPrefix...)
+		b = append(b, m.room...)
+	}
+	return append(b, '\n')
+}
+
+// Unmarshal decodes the incoming msg arguments, the INCOMING line itself
+// must already be consumed from r
+func (m *Incoming) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	m.room = ""
+	if i := strings.Index(s, " "+RoomPrefix); i >= 0 {
+		m.room = s[i+1+len(RoomPrefix):]
+		s = s[:i]
+	}
+	m.sender, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	m.body, err = ReadBytesArg(r)
+	if err != nil {
+		m.body = nil
+		return err
+	}
+	return nil
+}
+
+// ClientID represents the response to an IDENTITY or LOGIN msg, Name is
+// only set for logged in clients
+type ClientID struct {
+	ID   uint64
+	Name string
+}
+
+// NewClientID creates a new instance of client id response
+func NewClientID(id uint64) *ClientID {
+	return &ClientID{ID: id}
+}
+
+// NewUserID creates a new instance of client id response for a logged in
+// client
+func NewUserID(id uint64, name string) *ClientID {
+	return &ClientID{ID: id, Name: name}
+}
+
+// Marshal encodes the client id response, the name follows the id
+func (m ClientID) Marshal() []byte {
+	if m.Name == "" {
+		return []byte(fmt.Sprintf("%d\n", m.ID))
+	}
+	return []byte(fmt.Sprintf("%d %s\n", m.ID, m.Name))
+}
+
+// Unmarshal decodes the client id response
+func (m *ClientID) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("protocol: malformed client id response: %s", s)
+	}
+	m.ID, err = strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 2 {
+		m.Name = fields[1]
+	}
+	return nil
+}
+
+// ClientIDs represents the response to a LIST msg
+type ClientIDs struct {
+	IDs []uint64
+}
+
+// NewClientIDs creates a new instance of client ids response
+func NewClientIDs(ids []uint64) *ClientIDs {
+	return &ClientIDs{IDs: ids}
+}
+
+// Marshal encodes the client ids response
+func (m ClientIDs) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n", joinRecipients(m.IDs)))
+}
+
+// Unmarshal decodes the client ids response
+func (m *ClientIDs) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	m.IDs, err = splitIDs(s)
+	return err
+}
+
+// Done represents the response to a successful SEND msg
+type Done struct{}
+
+// NewDone creates a new instance of done response
+func NewDone() *Done {
+	return &Done{}
+}
+
+// Marshal encodes the done response
+func (m Done) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n", DoneMsg))
+}
+
+// Sent represents the response to a SEND msg for protocol version 2 and
+// newer, it tells the outcome for every recipient
+type Sent struct {
+	// MessageID identifies the msg in DELIVERED acknowledgements
+	MessageID uint64
+	// Delivered recipients had the msg queued for them
+	Delivered []uint64
+	// Unknown recipients are not connected
+	Unknown []uint64
+	// Failed recipients are connected but could not take the msg
+	Failed []uint64
+	// Queued recipients are offline, the msg is stored until they resume
+	Queued []uint64
+}
+
+// NewSent creates a new instance of sent response
+func NewSent(id uint64, delivered, unknown, failed, queued []uint64) *Sent {
+	return &Sent{
+		MessageID: id,
+		Delivered: delivered,
+		Unknown:   unknown,
+		Failed:    failed,
+		Queued:    queued,
+	}
+}
+
+// Marshal encodes the sent response in a single line, empty recipient
+// lists are written as `-`
+func (m Sent) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s %d %s %s %s %s\n", SentMsg, m.MessageID,
+		joinIDList(m.Delivered), joinIDList(m.Unknown), joinIDList(m.Failed), joinIDList(m.Queued)))
+}
+
+// Unmarshal decodes the sent response
+func (m *Sent) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 6 || strings.ToUpper(fields[0]) != SentMsg {
+		return fmt.Errorf("protocol: malformed %s response: %s", SentMsg, s)
+	}
+	m.MessageID, err = strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	lists := make([][]uint64, 4)
+	for i, f := range fields[2:] {
+		if f == "-" {
+			continue
+		}
+		lists[i], err = splitIDs(f)
+		if err != nil {
+			return err
+		}
+	}
+	m.Delivered, m.Unknown, m.Failed, m.Queued = lists[0], lists[1], lists[2], lists[3]
+	return nil
+}
+
+// Delivered acknowledges that a client received the msg MessageID. Clients
+// which agreed on CapAcks send it for every INCOMING msg and the server
+// relays it to the sender with Recipient set.
+type Delivered struct {
+	MessageID uint64
+	Recipient uint64
+}
+
+// NewDelivered creates a new instance of delivered message
+func NewDelivered(id, recipient uint64) *Delivered {
+	return &Delivered{
+		MessageID: id,
+		Recipient: recipient,
+	}
+}
+
+// Marshal encodes the delivered msg
+func (m Delivered) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n%d\n", DeliveredMsg, m.MessageID, m.Recipient))
+}
+
+// Unmarshal decodes the delivered msg arguments, the DELIVERED line itself
+// must already be consumed from r
+func (m *Delivered) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	m.MessageID, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	s, err = ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	m.Recipient, err = strconv.ParseUint(s, 10, 64)
+	return err
+}
+
+// Joined represents a JOINED event pushed when a client comes online, Name
+// is set for users. A user logged in more than once is online as long as
+// one of its connections is.
+type Joined struct {
+	ID   uint64
+	Name string
+}
+
+// NewJoined creates a new instance of joined event
+func NewJoined(id uint64, name string) *Joined {
+	return &Joined{ID: id, Name: name}
+}
+
+// Marshal encodes the joined event
+func (m Joined) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n%s", JoinedMsg, NewUserID(m.ID, m.Name).Marshal()))
+}
+
+// Unmarshal decodes the joined event arguments, the JOINED line itself
+// must already be consumed from r
+func (m *Joined) Unmarshal(r *bufio.Reader) error {
+	var id ClientID
+	err := id.Unmarshal(r)
+	m.ID, m.Name = id.ID, id.Name
+	return err
+}
+
+// Left represents a LEFT event pushed when the last connection of a client
+// is gone
+type Left struct {
+	ID uint64
+}
+
+// NewLeft creates a new instance of left event
+func NewLeft(id uint64) *Left {
+	return &Left{ID: id}
+}
+
+// Marshal encodes the left event
+func (m Left) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n", LeftMsg, m.ID))
+}
+
+// Unmarshal decodes the left event arguments, the LEFT line itself must
+// already be consumed from r
+func (m *Left) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	m.ID, err = strconv.ParseUint(s, 10, 64)
+	return err
+}
+
+// Command represents a msg of a command the server was extended with, it
+// is written like the built-in msgs, the name followed by one line per
+// argument. The framed protocol carries it in a COMMAND frame.
+type Command struct {
+	Name string
+	Args []string
+}
+
+// NewCommand creates a new instance of command message
+func NewCommand(name string, args ...string) *Command {
+	return &Command{Name: name, Args: args}
+}
+
+// Marshal encodes the command message
+func (m Command) Marshal() []byte {
+	var b []byte
+	b = append(b, m.Name...)
+	b = append(b, '\n')
+	for _, arg := range m.Args {
+		b = append(b, arg...)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// Text represents the free-form single line response of a command the
+// server was extended with
+type Text struct {
+	Body string
+}
+
+// NewText creates a new instance of text response
+func NewText(body string) *Text {
+	return &Text{Body: body}
+}
+
+// Marshal encodes the text response
+func (m Text) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s %s\n", TextMsg, m.Body))
+}
+
+// Unmarshal decodes the text response
+func (m *Text) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(strings.ToUpper(s), TextMsg+" ") {
+		return fmt.Errorf("protocol: malformed %s response: %s", TextMsg, s)
+	}
+	m.Body = s[len(TextMsg)+1:]
+	return nil
+}
+
+// Ping represents a PING msg which keeps an idle connection alive
+type Ping struct{}
+
+// NewPing creates a new instance of ping message
+func NewPing() *Ping {
+	return &Ping{}
+}
+
+// Marshal encodes the ping msg
+func (m Ping) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n", PingMsg))
+}
+
+// Pong represents the response to a PING msg
+type Pong struct{}
+
+// NewPong creates a new instance of pong response
+func NewPong() *Pong {
+	return &Pong{}
+}
+
+// Marshal encodes the pong response
+func (m Pong) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n", PongMsg))
+}
+
+// Unmarshal decodes the pong response
+func (m *Pong) Unmarshal(r *bufio.Reader) error {
+	s, err := Read(r)
+	if err != nil {
+		return err
+	}
+	if s != PongMsg {
+		return fmt.Errorf("protocol: unexpected pong response %q", s)
+	}
+	return nil
+}
+
+// ServerShutdown represents a SERVER_SHUTDOWN event pushed to every client
+// when the server is going down, the requests already sent are still
+// answered before the connection is closed
+type ServerShutdown struct{}
+
+// NewServerShutdown creates a new instance of server shutdown event
+func NewServerShutdown() *ServerShutdown {
+	return &ServerShutdown{}
+}
+
+// Marshal encodes the server shutdown event
+func (m ServerShutdown) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n", ServerShutdownMsg))
+}
+
+// Refused represents a REFUSED event written to connections the server does
+// not accept, the connection is closed right after it. Reason tells why,
+// like RefusedServerFull.
+type Refused struct {
+	Reason string
+}
+
+// NewRefused creates a new instance of refused event
+func NewRefused(reason string) *Refused {
+	return &Refused{Reason: reason}
+}
+
+// Marshal encodes the refused event
+func (m Refused) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n", RefusedMsg, m.Reason))
+}
+
+// Unmarshal decodes the refused event arguments, the REFUSED line itself
+// must already be consumed from r
+func (m *Refused) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	m.Reason = s
+	return nil
+}
+
+// Resume represents a RESUME msg which claims the identity, and the msgs
+// stored for it while it was offline, of an earlier connection. An empty
+// token asks for the token of the current identity instead.
+type Resume struct {
+	Token string
+}
+
+// NewResume creates a new instance of resume message
+func NewResume(token string) *Resume {
+	return &Resume{Token: token}
+}
+
+// Marshal encodes the resume msg
+func (m Resume) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n", ResumeMsg, m.Token))
+}
+
+// Unmarshal decodes the resume msg
+func (m *Resume) Unmarshal(r *bufio.Reader) error {
+	var err error
+	m.Token, err = ReadStringArg(r)
+	return err
+}
+
+// Resumed represents the response to a RESUME msg carrying the identity
+// of the connection and the token to resume it later
+type Resumed struct {
+	ID    uint64
+	Token string
+}
+
+// NewResumed creates a new instance of resumed response
+func NewResumed(id uint64, token string) *Resumed {
+	return &Resumed{
+		ID:    id,
+		Token: token,
+	}
+}
+
+// Marshal encodes the resumed response
+func (m Resumed) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s %d %s\n", ResumedMsg, m.ID, m.Token))
+}
+
+// Unmarshal decodes the resumed response
+func (m *Resumed) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 3 || strings.ToUpper(fields[0]) != ResumedMsg {
+		return fmt.Errorf("protocol: malformed %s response: %s", ResumedMsg, s)
+	}
+	m.ID, err = strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	m.Token = fields[2]
+	return nil
+}
+
+// MaxNameLength is the longest user name accepted
+const MaxNameLength = 32
+
+// ValidName reports whether name can be used as a user name, names are
+// made of letters, digits, `_`, `-` and `.` and are never numbers so they
+// can not be mistaken for ids
+func ValidName(name string) bool {
+	if name == "" || len(name) > MaxNameLength {
+		return false
+	}
+	digits := true
+	for _, r := range name {
+		switch {
+		case r >= '0' && r <= '9':
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == '-', r == '.':
+			digits = false
+		default:
+			return false
+		}
+	}
+	return !digits
+}
+
+// Login represents a LOGIN msg which binds the connection to the user
+// account name, the account is created on first use
+type Login struct {
+	Name string
+}
+
+// NewLogin creates a new instance of login message
+func NewLogin(name string) *Login {
+	return &Login{Name: name}
+}
+
+// Marshal encodes the login msg
+func (m Login) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n", LoginMsg, m.Name))
+}
+
+// Unmarshal decodes the login msg
+func (m *Login) Unmarshal(r *bufio.Reader) error {
+	var err error
+	m.Name, err = ReadStringArg(r)
+	return err
+}
+
+// Auth represents an AUTH msg which authenticates the connection. Password
+// authentication carries the user name along with the method, bearer
+// tokens go without one. The secret takes a line of its own and has its
+// surrounding white space trimmed like every other argument.
+type Auth struct {
+	Method   string
+	Username string
+	Secret   string
+}
+
+// NewPasswordAuth creates a new instance of auth message authenticating
+// user name with password
+func NewPasswordAuth(name, password string) *Auth {
+	return &Auth{Method: AuthPassword, Username: name, Secret: password}
+}
+
+// NewBearerAuth creates a new instance of auth message authenticating with
+// token
+func NewBearerAuth(token string) *Auth {
+	return &Auth{Method: AuthBearer, Secret: token}
+}
+
+// NewCertificateAuth creates a new instance of auth message authenticating
+// with the TLS client certificate
+func NewCertificateAuth() *Auth {
+	return &Auth{Method: AuthCertificate}
+}
+
+// Marshal encodes the auth msg
+func (m Auth) Marshal() []byte {
+	method := m.Method
+	if m.Username != "" {
+		method += " " + m.Username
+	}
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n", AuthMsg, method, m.Secret))
+}
+
+// Unmarshal decodes the auth msg
+func (m *Auth) Unmarshal(r *bufio.Reader) error {
+	method, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	m.Secret, err = ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(method)
+	if len(fields) < 1 || len(fields) > 2 {
+		return fmt.Errorf("protocol: malformed auth method %q", method)
+	}
+	m.Method = fields[0]
+	m.Username = ""
+	if len(fields) == 2 {
+		m.Username = fields[1]
+	}
+	return nil
+}
+
+// Join represents a JOIN msg which makes the client a member of room, the
+// room is created by its first member
+type Join struct {
+	Room string
+}
+
+// NewJoin creates a new instance of join message
+func NewJoin(room string) *Join {
+	return &Join{Room: room}
+}
+
+// Marshal encodes the join msg
+func (m Join) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n", JoinMsg, m.Room))
+}
+
+// Unmarshal decodes the join msg
+func (m *Join) Unmarshal(r *bufio.Reader) error {
+	var err error
+	m.Room, err = ReadStringArg(r)
+	return err
+}
+
+// Part represents a PART msg which makes the client leave room, the room
+// is gone once its last member left
+type Part struct {
+	Room string
+}
+
+// NewPart creates a new instance of part message
+func NewPart(room string) *Part {
+	return &Part{Room: room}
+}
+
+// Marshal encodes the part msg
+func (m Part) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n", PartMsg, m.Room))
+}
+
+// Unmarshal decodes the part msg
+func (m *Part) Unmarshal(r *bufio.Reader) error {
+	var err error
+	m.Room, err = ReadStringArg(r)
+	return err
+}
+
+// Rooms represents a ROOMS msg structure
+type Rooms struct{}
+
+// NewRooms creates a new instance of rooms message
+func NewRooms() *Rooms {
+	return &Rooms{}
+}
+
+// Marshal encodes the rooms msg
+func (m Rooms) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n", RoomsMsg))
+}
+
+// RoomList represents the response to a ROOMS msg listing the rooms
+// (`ROOMS deploys,general`)
+type RoomList struct {
+	Rooms []string
+}
+
+// NewRoomList creates a new instance of room list response
+func NewRoomList(rooms []string) *RoomList {
+	return &RoomList{Rooms: rooms}
+}
+
+// Marshal encodes the room list response
+func (m RoomList) Marshal() []byte {
+	if len(m.Rooms) == 0 {
+		return []byte(fmt.Sprintf("%s\n", RoomsMsg))
+	}
+	return []byte(fmt.Sprintf("%s %s\n", RoomsMsg, strings.Join(m.Rooms, ",")))
+}
+
+// Unmarshal decodes the room list response
+func (m *RoomList) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(s)
+	if len(fields) < 1 || len(fields) > 2 || strings.ToUpper(fields[0]) != RoomsMsg {
+		return fmt.Errorf("protocol: malformed room list %q", s)
+	}
+	m.Rooms = nil
+	if len(fields) == 2 {
+		m.Rooms = strings.Split(fields[1], ",")
+	}
+	return nil
+}
+
+// Err represents an error response
+type Err struct {
+	Text string
+}
+
+// NewErr creates a new instance of error response
+func NewErr(text string) *Err {
+	return &Err{Text: text}
+}
+
+// Marshal encodes the error response
+func (m Err) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s %s\n", ErrMsg, m.Text))
+}
+
+// Error implements the error interface
+func (m Err) Error() string {
+	return fmt.Sprintf("%s %s", ErrMsg, m.Text)
+}
+
+// Unknown represents the response to an unknown msg
+type Unknown struct{}
+
+// NewUnknown creates a new instance of unknown response
+func NewUnknown() *Unknown {
+	return &Unknown{}
+}
+
+// Marshal encodes the unknown response
+func (m Unknown) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n", UnknownMsg))
+}
+
+// ErrorCode identifies the kind of an ERROR response, codes never change
+// their meaning once assigned
+type ErrorCode uint64
+
+// Error codes of ERROR responses, the hundreds group them into protocol,
+// authentication and identity, SEND and room, limit and server errors
+const (
+	// CodeUndefined is the code of ERR responses which can not be
+	// classified
+	CodeUndefined ErrorCode = 0
+
+	CodeUnknownMessage     ErrorCode = 100
+	CodeMalformedMessage   ErrorCode = 101
+	CodeHelloNotFirst      ErrorCode = 102
+	CodeUnsupportedVersion ErrorCode = 103
+
+	CodeAuthRequired         ErrorCode = 200
+	CodeAuthFailed           ErrorCode = 201
+	CodeAuthNotEnabled       ErrorCode = 202
+	CodeAlreadyAuthenticated ErrorCode = 203
+	CodeAlreadyLoggedIn      ErrorCode = 204
+	CodeInvalidName          ErrorCode = 205
+	CodeLoginFailed          ErrorCode = 206
+	CodeUnknownToken         ErrorCode = 207
+	CodeIdentityInUse        ErrorCode = 208
+	CodeResumeFailed         ErrorCode = 209
+
+	CodeInvalidRecipients ErrorCode = 300
+	CodeRoomNotAlone      ErrorCode = 301
+	CodeBodyTooLarge      ErrorCode = 302
+	CodeUnknownUser       ErrorCode = 303
+	CodeInvalidRoom       ErrorCode = 304
+	CodeNotInRoom         ErrorCode = 305
+
+	CodeRateLimited ErrorCode = 400
+
+	CodeInternal ErrorCode = 500
+)
+
+// errorTexts holds the text of every code, it is also the ERR text older
+// protocol versions get
+var errorTexts = map[ErrorCode]string{
+	CodeUnknownMessage:       UnknownMsg,
+	CodeMalformedMessage:     "MALFORMED MESSAGE",
+	CodeHelloNotFirst:        "HELLO MUST BE FIRST",
+	CodeUnsupportedVersion:   UnsupportedVersion,
+	CodeAuthRequired:         "AUTH REQUIRED",
+	CodeAuthFailed:           "AUTH FAILED",
+	CodeAuthNotEnabled:       "AUTH NOT ENABLED",
+	CodeAlreadyAuthenticated: "ALREADY AUTHENTICATED",
+	CodeAlreadyLoggedIn:      "ALREADY LOGGED IN",
+	CodeInvalidName:          "INVALID NAME",
+	CodeLoginFailed:          "LOGIN FAILED",
+	CodeUnknownToken:         "UNKNOWN TOKEN",
+	CodeIdentityInUse:        "IDENTITY IN USE",
+	CodeResumeFailed:         "RESUME FAILED",
+	CodeInvalidRecipients:    "RECIPIENTS 1-255",
+	CodeRoomNotAlone:         "ROOM MUST BE THE ONLY RECIPIENT",
+	CodeBodyTooLarge:         "TOO LARGE BODY 1M",
+	CodeUnknownUser:          "UNKNOWN USER",
+	CodeInvalidRoom:          "INVALID ROOM",
+	CodeNotInRoom:            "NOT IN ROOM",
+	CodeRateLimited:          "RATE LIMITED",
+	CodeInternal:             "INTERNAL ERROR",
+}
+
+// String returns the text of the code
+func (c ErrorCode) String() string {
+	if text, ok := errorTexts[c]; ok {
+		return text
+	}
+	return fmt.Sprintf("CODE(%d)", uint64(c))
+}
+
+// Code classifies the ERR response by its text, CodeUndefined is returned
+// for texts no code was assigned to
+func (m Err) Code() ErrorCode {
+	for code, text := range errorTexts {
+		if m.Text == text || strings.HasPrefix(m.Text, text+" ") {
+			return code
+		}
+	}
+	return CodeUndefined
+}
+
+// Error represents an error response carrying the code of the error and a
+// human-readable text, which may add details to the text of the code
+type Error struct {
+	Code ErrorCode
+	Text string
+}
+
+// NewError creates a new instance of error response with the text of code
+func NewError(code ErrorCode) *Error {
+	return &Error{Code: code, Text: code.String()}
+}
+
+// NewErrorDetail creates a new instance of error response with detail
+// appended to the text of code
+func NewErrorDetail(code ErrorCode, detail string) *Error {
+	return &Error{Code: code, Text: code.String() + " " + detail}
+}
+
+// Marshal encodes the error response
+func (m Error) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s %d %s\n", ErrorMsg, m.Code, m.Text))
+}
+
+// Unmarshal decodes the error response
+func (m *Error) Unmarshal(r *bufio.Reader) error {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return err
+	}
+	fields := strings.SplitN(s, " ", 3)
+	if len(fields) != 3 || strings.ToUpper(fields[0]) != ErrorMsg {
+		return fmt.Errorf("protocol: malformed %s response: %s", ErrorMsg, s)
+	}
+	code, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("protocol: malformed %s response: %s", ErrorMsg, s)
+	}
+	m.Code = ErrorCode(code)
+	m.Text = fields[2]
+	return nil
+}
+
+// Error implements the error interface
+func (m Error) Error() string {
+	return fmt.Sprintf("%s %d %s", ErrorMsg, m.Code, m.Text)
+}
+
+// Legacy returns the response older protocol versions get instead
+func (m Error) Legacy() Message {
+	if m.Code == CodeUnknownMessage {
+		return NewUnknown()
+	}
+	return NewErr(m.Text)
+}
+
+// Hello represents a HELLO msg structure, it must be the first message of
+// a connection
+type Hello struct {
+	Version      uint64
+	Capabilities []string
+}
+
+// NewHello creates a new instance of hello message
+func NewHello(version uint64, caps []string) *Hello {
+	return &Hello{
+		Version:      version,
+		Capabilities: caps,
+	}
+}
+
+// Marshal encodes the hello msg
+func (m Hello) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n%s\n", HelloMsg, m.Version, strings.Join(m.Capabilities, ",")))
+}
+
+// Unmarshal decodes the hello msg
+func (m *Hello) Unmarshal(r *bufio.Reader) error {
+	var err error
+	m.Version, m.Capabilities, err = readVersionAndCaps(r)
+	return err
+}
+
+// Welcome represents the response to a HELLO msg carrying the agreed
+// protocol version and capabilities
+type Welcome struct {
+	Version      uint64
+	Capabilities []string
+}
+
+// NewWelcome creates a new instance of welcome response
+func NewWelcome(version uint64, caps []string) *Welcome {
+	return &Welcome{
+		Version:      version,
+		Capabilities: caps,
+	}
+}
+
+// Marshal encodes the welcome response
+func (m Welcome) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n%s\n", WelcomeMsg, m.Version, strings.Join(m.Capabilities, ",")))
+}
+
+// Unmarshal decodes the welcome response
+func (m *Welcome) Unmarshal(r *bufio.Reader) error {
+	var err error
+	m.Version, m.Capabilities, err = readVersionAndCaps(r)
+	return err
+}
+
+// Has reports whether capability c was agreed on
+func (m Welcome) Has(c string) bool {
+	for _, v := range m.Capabilities {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+func readVersionAndCaps(r *bufio.Reader) (uint64, []string, error) {
+	s, err := ReadStringArg(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	version, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	s, err = ReadStringArg(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var caps []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+			caps = append(caps, c)
+		}
+	}
+	return version, caps, nil
+}
+
+func splitIDs(s string) ([]uint64, error) {
+	var ids []uint64
+	if s == "" {
+		return ids, nil
+	}
+	for _, id := range strings.Split(s, ",") {
+		i, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, i)
+	}
+	return ids, nil
+}
+
+func joinIDList(ids []uint64) string {
+	if len(ids) == 0 {
+		return "-"
+	}
+	return joinRecipients(ids)
+}
+
+func joinRecipients(rr []uint64) string {
+	var jr []string
+	for _, id := range rr {
+		jr = append(jr, strconv.FormatUint(id, 10))
+	}
+	return strings.Join(jr, ",")
+}
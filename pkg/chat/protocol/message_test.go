@@ -0,0 +1,756 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	tt := []struct {
+		given *bufio.Reader
+		want  string
+		err   error
+	}{
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("identity\n"))),
+			want:  IdentityMsg,
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("IDENTITY\n"))),
+			want:  IdentityMsg,
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("TEST"))),
+			want:  "",
+			err:   io.EOF,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("\n"))),
+			want:  "",
+			err:   nil,
+		},
+	}
+
+	for _, tc := range tt {
+		msg, err := Read(tc.given)
+		assert.Equal(t, tc.err, err)
+		assert.Equal(t, tc.want, msg)
+	}
+}
+
+func TestReadStringArg(t *testing.T) {
+	tt := []struct {
+		given *bufio.Reader
+		want  string
+		err   error
+	}{
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("arg1\n"))),
+			want:  "arg1",
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("ARG1\n"))),
+			want:  "ARG1",
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("ARG1    \n"))),
+			want:  "ARG1",
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("1,2,3,4,5\n"))),
+			want:  "1,2,3,4,5",
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("TEST"))),
+			want:  "",
+			err:   io.EOF,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("\n"))),
+			want:  "",
+			err:   nil,
+		},
+	}
+
+	for _, tc := range tt {
+		msg, err := ReadStringArg(tc.given)
+		assert.Equal(t, tc.err, err)
+		assert.Equal(t, tc.want, msg)
+	}
+}
+
+func TestReadBytesArg(t *testing.T) {
+	tt := []struct {
+		given *bufio.Reader
+		want  []byte
+		err   error
+	}{
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("arg1\n"))),
+			want:  []byte("arg1"),
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("ARG1\n"))),
+			want:  []byte("ARG1"),
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("ARG1    \n"))),
+			want:  []byte("ARG1"),
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("1,2,3,4,5\n"))),
+			want:  []byte("1,2,3,4,5"),
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("TEST"))),
+			want:  []byte(""),
+			err:   io.EOF,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("\n"))),
+			want:  []byte(nil),
+			err:   nil,
+		},
+	}
+
+	for _, tc := range tt {
+		msg, err := ReadBytesArg(tc.given)
+		assert.Equal(t, tc.err, err)
+		assert.Equal(t, tc.want, msg)
+	}
+}
+
+func TestIdentity_Marshal(t *testing.T) {
+	expected := []byte("IDENTITY\n")
+	msg := NewIdentity()
+	actual := msg.Marshal()
+	assert.Equal(t, expected, actual)
+}
+
+func TestList_Marshal(t *testing.T) {
+	expected := []byte("LIST\n")
+	msg := NewList()
+	actual := msg.Marshal()
+	assert.Equal(t, expected, actual)
+}
+
+func TestSend_Marshal(t *testing.T) {
+	tt := []struct {
+		recipients []uint64
+		body       []byte
+		want       []byte
+	}{
+		{
+			recipients: []uint64{1, 2},
+			body:       []byte("Hello"),
+			want:       []byte("SEND\n1,2\nHello\n"),
+		},
+		{
+			recipients: []uint64{},
+			body:       []byte("Hello"),
+			want:       []byte("SEND\n\nHello\n"),
+		},
+		{
+			recipients: []uint64{1},
+			body:       []byte("Hello\n"),
+			want:       []byte("SEND\n1\nHello\n\n"),
+		},
+		{
+			recipients: []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			body:       []byte("Hello Friend!"),
+			want:       []byte("SEND\n1,2,3,4,5,6,7,8,9,10\nHello Friend!\n"),
+		},
+	}
+
+	for _, tc := range tt {
+		msg := NewSend(tc.recipients, tc.body)
+		actual := msg.Marshal()
+		assert.Equal(t, tc.want, actual)
+	}
+}
+
+func TestSend_Unmarshal(t *testing.T) {
+	tt := []struct {
+		given      *bufio.Reader
+		recipients []uint64
+		body       []byte
+		hasErr     bool
+	}{
+		{
+			given:      bufio.NewReader(bytes.NewBuffer([]byte("1,2\nHi\n"))),
+			recipients: []uint64{1, 2},
+			body:       []byte("Hi"),
+			hasErr:     false,
+		},
+		{
+			given:      bufio.NewReader(bytes.NewBuffer([]byte("1\nHi\n"))),
+			recipients: []uint64{1},
+			body:       []byte("Hi"),
+			hasErr:     false,
+		},
+		{
+			given:      bufio.NewReader(bytes.NewBuffer([]byte("\nHi\n"))),
+			recipients: []uint64(nil),
+			body:       []byte(nil),
+			hasErr:     true,
+		},
+		{
+			given:      bufio.NewReader(bytes.NewBuffer([]byte("1,2,3,4\n\n"))),
+			recipients: []uint64{1, 2, 3, 4},
+			body:       []byte(nil),
+			hasErr:     false,
+		},
+		{
+			given:      bufio.NewReader(bytes.NewBuffer([]byte(""))),
+			recipients: []uint64(nil),
+			body:       []byte(nil),
+			hasErr:     true,
+		},
+		{
+			given:      bufio.NewReader(bytes.NewBuffer([]byte("1,2\n"))),
+			recipients: []uint64{1,2},
+			body:       []byte(nil),
+			hasErr:     true,
+		},
+	}
+
+	for _, tc := range tt {
+		msg := Send{}
+		err := msg.Unmarshal(tc.given)
+		if tc.hasErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.EqualValues(t, tc.recipients, msg.Recipients)
+		assert.Equal(t, tc.body, msg.Body)
+	}
+}
+
+func TestIncoming_Marshal(t *testing.T) {
+	tt := []struct {
+		sender uint64
+		body   []byte
+		want   []byte
+	}{
+		{
+			sender: 1,
+			body:   []byte("Hello"),
+			want:   []byte("INCOMING\n1\nHello\n"),
+		},
+		{
+			sender: 1,
+			body:   []byte(""),
+			want:   []byte("INCOMING\n1\n\n"),
+		},
+		{
+			sender: 122,
+			body:   []byte("FOOOBAAR\n"),
+			want:   []byte("INCOMING\n122\nFOOOBAAR\n\n"),
+		},
+	}
+
+	for _, tc := range tt {
+		msg := NewIncoming(tc.sender, tc.body)
+		actual := msg.Marshal()
+		assert.Equal(t, tc.want, actual)
+	}
+}
+
+func TestIncoming_AppendHead(t *testing.T) {
+	for _, msg := range []*Incoming{NewIncoming(7, []byte("Hi")), NewRoomIncoming(7, "deploys", []byte("Hi\n"))} {
+		for _, id := range []uint64{0, 42} {
+			b := msg.AppendHead(nil, id)
+			b = append(append(b, msg.Body()...), '\n')
+			assert.Equal(t, string(MarshalWithID(msg, id)), string(b))
+		}
+	}
+}
+
+func TestJoinRecipients(t *testing.T) {
+	tt := []struct {
+		given []uint64
+		want  string
+	}{
+		{
+			[]uint64{1},
+			"1",
+		},
+		{
+			[]uint64{},
+			"",
+		},
+		{
+			[]uint64{1, 2, 3, 4},
+			"1,2,3,4",
+		},
+	}
+
+	for _, tc := range tt {
+		actual := joinRecipients(tc.given)
+		assert.Equal(t, tc.want, actual)
+	}
+}
+
+func TestHello_Marshal(t *testing.T) {
+	tt := []struct {
+		version uint64
+		caps    []string
+		want    []byte
+	}{
+		{
+			version: 1,
+			caps:    []string{CapFraming, CapAcks},
+			want:    []byte("HELLO\n1\nframing,acks\n"),
+		},
+		{
+			version: 2,
+			caps:    nil,
+			want:    []byte("HELLO\n2\n\n"),
+		},
+	}
+
+	for _, tc := range tt {
+		msg := NewHello(tc.version, tc.caps)
+		actual := msg.Marshal()
+		assert.Equal(t, tc.want, actual)
+	}
+}
+
+func TestHello_Unmarshal(t *testing.T) {
+	tt := []struct {
+		given   *bufio.Reader
+		version uint64
+		caps    []string
+		hasErr  bool
+	}{
+		{
+			given:   bufio.NewReader(bytes.NewBuffer([]byte("1\nframing, ACKS\n"))),
+			version: 1,
+			caps:    []string{CapFraming, CapAcks},
+			hasErr:  false,
+		},
+		{
+			given:   bufio.NewReader(bytes.NewBuffer([]byte("1\n\n"))),
+			version: 1,
+			caps:    []string(nil),
+			hasErr:  false,
+		},
+		{
+			given:   bufio.NewReader(bytes.NewBuffer([]byte("one\n\n"))),
+			version: 0,
+			caps:    []string(nil),
+			hasErr:  true,
+		},
+		{
+			given:   bufio.NewReader(bytes.NewBuffer([]byte("1\n"))),
+			version: 0,
+			caps:    []string(nil),
+			hasErr:  true,
+		},
+	}
+
+	for _, tc := range tt {
+		msg := Hello{}
+		err := msg.Unmarshal(tc.given)
+		if tc.hasErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, tc.version, msg.Version)
+		assert.Equal(t, tc.caps, msg.Capabilities)
+	}
+}
+
+func TestWelcome_Has(t *testing.T) {
+	msg := NewWelcome(1, []string{CapFraming})
+	assert.True(t, msg.Has(CapFraming))
+	assert.False(t, msg.Has(CapAcks))
+}
+
+func TestReadCommand(t *testing.T) {
+	tt := []struct {
+		given *bufio.Reader
+		want  string
+		id    uint64
+		err   error
+	}{
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("list\n"))),
+			want:  ListMsg,
+			id:    0,
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("SEND #42\n"))),
+			want:  SendMsg,
+			id:    42,
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("SEND #abc\n"))),
+			want:  "SEND #ABC",
+			id:    0,
+			err:   nil,
+		},
+		{
+			given: bufio.NewReader(bytes.NewBuffer([]byte("LIST #1"))),
+			want:  "",
+			id:    0,
+			err:   io.EOF,
+		},
+	}
+
+	for _, tc := range tt {
+		msg, id, err := ReadCommand(tc.given)
+		assert.Equal(t, tc.err, err)
+		assert.Equal(t, tc.want, msg)
+		assert.Equal(t, tc.id, id)
+	}
+}
+
+func TestSplitRequestID(t *testing.T) {
+	tt := []struct {
+		given string
+		id    uint64
+		want  string
+	}{
+		{given: "#7 DONE", id: 7, want: "DONE"},
+		{given: "#7 ERR TOO LARGE BODY 1M", id: 7, want: "ERR TOO LARGE BODY 1M"},
+		{given: "#12", id: 12, want: ""},
+		{given: "1,2,3", id: 0, want: "1,2,3"},
+		{given: "#x DONE", id: 0, want: "#x DONE"},
+	}
+
+	for _, tc := range tt {
+		id, line := SplitRequestID(tc.given)
+		assert.Equal(t, tc.id, id)
+		assert.Equal(t, tc.want, line)
+	}
+}
+
+func TestMarshalWithID(t *testing.T) {
+	tt := []struct {
+		given Message
+		id    uint64
+		want  []byte
+	}{
+		{given: NewList(), id: 0, want: []byte("LIST\n")},
+		{given: NewList(), id: 3, want: []byte("LIST #3\n")},
+		{given: NewSend([]uint64{1}, []byte("Hi")), id: 4, want: []byte("SEND #4\n1\nHi\n")},
+		{given: NewClientIDs([]uint64{1, 2}), id: 5, want: []byte("#5 1,2\n")},
+		{given: NewDone(), id: 6, want: []byte("#6 DONE\n")},
+	}
+
+	for _, tc := range tt {
+		assert.Equal(t, tc.want, MarshalWithID(tc.given, tc.id))
+	}
+}
+
+func TestSent_Marshal(t *testing.T) {
+	tt := []struct {
+		given *Sent
+		want  string
+	}{
+		{
+			given: NewSent(7, []uint64{1, 2}, nil, []uint64{5}, []uint64{3}),
+			want:  "SENT 7 1,2 - 5 3\n",
+		},
+		{
+			given: NewSent(1, nil, nil, nil, nil),
+			want:  "SENT 1 - - - -\n",
+		},
+	}
+
+	for _, tc := range tt {
+		assert.Equal(t, tc.want, string(tc.given.Marshal()))
+
+		actual := Sent{}
+		err := actual.Unmarshal(bufio.NewReader(bytes.NewBufferString(tc.want)))
+		assert.NoError(t, err)
+		assert.Equal(t, *tc.given, actual)
+	}
+
+	err := (&Sent{}).Unmarshal(bufio.NewReader(bytes.NewBufferString("DONE\n")))
+	assert.Error(t, err)
+}
+
+func TestDelivered_Unmarshal(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBuffer(NewDelivered(9, 3).Marshal()))
+	name, err := Read(r)
+	assert.NoError(t, err)
+	assert.Equal(t, DeliveredMsg, name)
+
+	actual := Delivered{}
+	assert.NoError(t, actual.Unmarshal(r))
+	assert.Equal(t, Delivered{MessageID: 9, Recipient: 3}, actual)
+}
+
+func TestResumed_Unmarshal(t *testing.T) {
+	tt := []struct {
+		given  string
+		want   Resumed
+		hasErr bool
+	}{
+		{given: "RESUMED 3 abc\n", want: Resumed{ID: 3, Token: "abc"}, hasErr: false},
+		{given: "RESUMED 3\n", want: Resumed{}, hasErr: true},
+		{given: "RESUMED x abc\n", want: Resumed{}, hasErr: true},
+	}
+
+	for _, tc := range tt {
+		actual := Resumed{}
+		err := actual.Unmarshal(bufio.NewReader(bytes.NewBufferString(tc.given)))
+		if tc.hasErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, tc.given, string(actual.Marshal()))
+		}
+		assert.Equal(t, tc.want, actual)
+	}
+}
+
+func TestSend_UnmarshalNames(t *testing.T) {
+	tt := []struct {
+		given      string
+		recipients []uint64
+		names      []string
+		hasErr     bool
+	}{
+		{given: "1,2,alice,bob\nHi\n", recipients: []uint64{1, 2}, names: []string{"alice", "bob"}, hasErr: false},
+		{given: "alice\nHi\n", recipients: []uint64(nil), names: []string{"alice"}, hasErr: false},
+		{given: "1,al ice\nHi\n", recipients: []uint64(nil), names: []string(nil), hasErr: true},
+	}
+
+	for _, tc := range tt {
+		msg := Send{}
+		err := msg.Unmarshal(bufio.NewReader(bytes.NewBufferString(tc.given)))
+		if tc.hasErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, "SEND\n"+tc.given, string(msg.Marshal()))
+		}
+		assert.Equal(t, tc.recipients, msg.Recipients)
+		assert.Equal(t, tc.names, msg.Names)
+	}
+}
+
+func TestValidName(t *testing.T) {
+	tt := []struct {
+		given string
+		want  bool
+	}{
+		{given: "alice", want: true},
+		{given: "bob_2.0-rc", want: true},
+		{given: "42", want: false},
+		{given: "", want: false},
+		{given: "al ice", want: false},
+		{given: "al,ice", want: false},
+		{given: "abcdefghijklmnopqrstuvwxyz0123456", want: false},
+	}
+
+	for _, tc := range tt {
+		assert.Equal(t, tc.want, ValidName(tc.given), tc.given)
+	}
+}
+
+func TestClientID_Unmarshal(t *testing.T) {
+	tt := []struct {
+		given  string
+		want   ClientID
+		hasErr bool
+	}{
+		{given: "7\n", want: ClientID{ID: 7}, hasErr: false},
+		{given: "7 alice\n", want: ClientID{ID: 7, Name: "alice"}, hasErr: false},
+		{given: "\n", want: ClientID{}, hasErr: true},
+		{given: "7 alice bob\n", want: ClientID{}, hasErr: true},
+	}
+
+	for _, tc := range tt {
+		actual := ClientID{}
+		err := actual.Unmarshal(bufio.NewReader(bytes.NewBufferString(tc.given)))
+		if tc.hasErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, tc.given, string(actual.Marshal()))
+		}
+		assert.Equal(t, tc.want, actual)
+	}
+}
+
+func TestAuth_Unmarshal(t *testing.T) {
+	tt := []struct {
+		given  string
+		want   Auth
+		hasErr bool
+	}{
+		{given: "password alice\nwonder land\n", want: Auth{Method: AuthPassword, Username: "alice", Secret: "wonder land"}, hasErr: false},
+		{given: "bearer\nt0k3n\n", want: Auth{Method: AuthBearer, Secret: "t0k3n"}, hasErr: false},
+		{given: "certificate\n\n", want: Auth{Method: AuthCertificate}, hasErr: false},
+		{given: "\nt0k3n\n", want: Auth{Secret: "t0k3n"}, hasErr: true},
+		{given: "password alice bob\nt0k3n\n", want: Auth{Secret: "t0k3n"}, hasErr: true},
+	}
+
+	for _, tc := range tt {
+		actual := Auth{}
+		err := actual.Unmarshal(bufio.NewReader(bytes.NewBufferString(tc.given)))
+		if tc.hasErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, "AUTH\n"+tc.given, string(actual.Marshal()))
+		}
+		assert.Equal(t, tc.want, actual)
+	}
+}
+
+func TestSend_UnmarshalRoom(t *testing.T) {
+	tt := []struct {
+		given  string
+		room   string
+		names  []string
+		hasErr bool
+	}{
+		{given: "#deploys\nHi\n", room: "deploys", names: []string(nil), hasErr: false},
+		{given: "alice,#deploys\nHi\n", room: "deploys", names: []string{"alice"}, hasErr: false},
+		{given: "#deploys,#general\nHi\n", room: "", names: []string(nil), hasErr: true},
+		{given: "#\nHi\n", room: "", names: []string(nil), hasErr: true},
+	}
+
+	for _, tc := range tt {
+		msg := Send{}
+		err := msg.Unmarshal(bufio.NewReader(bytes.NewBufferString(tc.given)))
+		if tc.hasErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, "SEND\n"+tc.given, string(msg.Marshal()))
+		}
+		assert.Equal(t, tc.room, msg.Room)
+		assert.Equal(t, tc.names, msg.Names)
+	}
+}
+
+func TestIncoming_Room(t *testing.T) {
+	msg := NewRoomIncoming(7, "deploys", []byte("Hi"))
+	assert.Equal(t, "INCOMING\n7 #deploys\nHi\n", string(msg.Marshal()))
+
+	actual := Incoming{}
+	err := actual.Unmarshal(bufio.NewReader(bytes.NewBufferString("7 #deploys\nHi\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, *msg, actual)
+
+	err = actual.Unmarshal(bufio.NewReader(bytes.NewBufferString("7\nHi\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, "", actual.Room())
+}
+
+func TestRoomList_Unmarshal(t *testing.T) {
+	tt := []struct {
+		given  string
+		want   []string
+		hasErr bool
+	}{
+		{given: "ROOMS deploys,general\n", want: []string{"deploys", "general"}, hasErr: false},
+		{given: "ROOMS\n", want: []string(nil), hasErr: false},
+		{given: "deploys,general\n", want: []string(nil), hasErr: true},
+	}
+
+	for _, tc := range tt {
+		actual := RoomList{}
+		err := actual.Unmarshal(bufio.NewReader(bytes.NewBufferString(tc.given)))
+		if tc.hasErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, tc.given, string(actual.Marshal()))
+		}
+		assert.Equal(t, tc.want, actual.Rooms)
+	}
+}
+
+func TestPresence_Unmarshal(t *testing.T) {
+	joined := Joined{}
+	err := joined.Unmarshal(bufio.NewReader(bytes.NewBufferString("7 alice\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, *NewJoined(7, "alice"), joined)
+	assert.Equal(t, "JOINED\n7 alice\n", string(joined.Marshal()))
+	assert.Equal(t, "JOINED\n8\n", string(NewJoined(8, "").Marshal()))
+
+	left := Left{}
+	err = left.Unmarshal(bufio.NewReader(bytes.NewBufferString("7\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, *NewLeft(7), left)
+	assert.Equal(t, "LEFT\n7\n", string(left.Marshal()))
+	assert.Error(t, left.Unmarshal(bufio.NewReader(bytes.NewBufferString("alice\n"))))
+}
+
+func TestPong_Unmarshal(t *testing.T) {
+	pong := Pong{}
+	assert.NoError(t, pong.Unmarshal(bufio.NewReader(bytes.NewBufferString("PONG\n"))))
+	assert.Error(t, pong.Unmarshal(bufio.NewReader(bytes.NewBufferString("DONE\n"))))
+	assert.Equal(t, "PING\n", string(NewPing().Marshal()))
+	assert.Equal(t, "PONG\n", string(NewPong().Marshal()))
+}
+
+func TestError_Unmarshal(t *testing.T) {
+	tt := []struct {
+		given  string
+		want   Error
+		hasErr bool
+	}{
+		{given: "ERROR 305 NOT IN ROOM\n", want: Error{Code: CodeNotInRoom, Text: "NOT IN ROOM"}, hasErr: false},
+		{given: "ERROR 303 UNKNOWN USER bob\n", want: Error{Code: CodeUnknownUser, Text: "UNKNOWN USER bob"}, hasErr: false},
+		{given: "ERROR NOT IN ROOM\n", want: Error{}, hasErr: true},
+		{given: "ERR NOT IN ROOM\n", want: Error{}, hasErr: true},
+	}
+
+	for _, tc := range tt {
+		actual := Error{}
+		err := actual.Unmarshal(bufio.NewReader(bytes.NewBufferString(tc.given)))
+		if tc.hasErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, actual)
+		assert.Equal(t, tc.given, string(actual.Marshal()))
+	}
+
+	assert.Equal(t, *NewErrorDetail(CodeUnknownUser, "bob"), Error{Code: CodeUnknownUser, Text: "UNKNOWN USER bob"})
+	assert.Equal(t, NewErr("NOT IN ROOM"), NewError(CodeNotInRoom).Legacy())
+	assert.Equal(t, NewUnknown(), NewError(CodeUnknownMessage).Legacy())
+}
+
+func TestErr_Code(t *testing.T) {
+	assert.Equal(t, CodeBodyTooLarge, Err{Text: "TOO LARGE BODY 1M"}.Code())
+	assert.Equal(t, CodeUnknownUser, Err{Text: "UNKNOWN USER bob"}.Code())
+	assert.Equal(t, CodeUndefined, Err{Text: "SOMETHING ELSE"}.Code())
+}
+
+func TestCommand_Marshal(t *testing.T) {
+	assert.Equal(t, "DEPLOY-STATUS\nprod\n", string(NewCommand("DEPLOY-STATUS", "prod").Marshal()))
+	assert.Equal(t, "DEPLOY-STATUS #4\nprod\n", string(MarshalWithID(NewCommand("DEPLOY-STATUS", "prod"), 4)))
+
+	text := Text{}
+	assert.NoError(t, text.Unmarshal(bufio.NewReader(bytes.NewBufferString("TEXT all green\n"))))
+	assert.Equal(t, "all green", text.Body)
+	assert.Equal(t, "TEXT all green\n", string(text.Marshal()))
+	assert.Error(t, text.Unmarshal(bufio.NewReader(bytes.NewBufferString("DONE\n"))))
+}
@@ -0,0 +1,137 @@
+package server
+
+// maxPendingAcks is the number of msgs of a session waiting for acks, once
+// it is reached the oldest one stops waiting so recipients which never ack
+// can not make the server hold on to msgs forever
+const maxPendingAcks = 1024
+
+// pendingAck is a msg whose sender waits for DELIVERED acknowledgements
+type pendingAck struct {
+	sender  *session
+	waiting map[uint64]bool
+}
+
+// expectAcks starts waiting for the recipients to acknowledge msg id, it
+// must be called before the msg is delivered so no ack is missed
+func (server *Server) expectAcks(id uint64, sender *session, recipients []uint64) {
+	if len(recipients) == 0 {
+		return
+	}
+	waiting := make(map[uint64]bool, len(recipients))
+	for _, r := range recipients {
+		waiting[r] = true
+	}
+	server.al.Lock()
+	defer server.al.Unlock()
+
+	sent := server.sentAcks[sender]
+	if sent == nil {
+		sent = make(map[uint64]bool)
+		server.sentAcks[sender] = sent
+	}
+	if len(sent) >= maxPendingAcks {
+		// msg ids grow, the smallest is the oldest
+		oldest := id
+		for i := range sent {
+			if i < oldest {
+				oldest = i
+			}
+		}
+		server.removeAck(oldest)
+	}
+	sent[id] = true
+	for r := range waiting {
+		owed := server.owedAcks[r]
+		if owed == nil {
+			owed = make(map[uint64]bool)
+			server.owedAcks[r] = owed
+		}
+		owed[id] = true
+	}
+	server.acks[id] = &pendingAck{sender: sender, waiting: waiting}
+}
+
+// ack marks msg id as received by recipient and returns the sender to
+// relay the acknowledgement to, acks nobody waits for are ignored
+func (server *Server) ack(id, recipient uint64) (*session, bool) {
+	server.al.Lock()
+	defer server.al.Unlock()
+	p, ok := server.acks[id]
+	if !ok || !p.waiting[recipient] {
+		return nil, false
+	}
+	server.stopWaiting(id, recipient)
+	return p.sender, true
+}
+
+// cancelAck stops waiting for recipient to acknowledge msg id
+func (server *Server) cancelAck(id, recipient uint64) {
+	server.al.Lock()
+	defer server.al.Unlock()
+	server.stopWaiting(id, recipient)
+}
+
+// forgetAcks drops the pending acks of a deregistered session, the ones
+// it waits for and, when it was the last session of its id, the ones it
+// owes
+func (server *Server) forgetAcks(sess *session, last bool) {
+	server.al.Lock()
+	defer server.al.Unlock()
+	for id := range server.sentAcks[sess] {
+		server.removeAck(id)
+	}
+	if last {
+		for id := range server.owedAcks[sess.id] {
+			server.stopWaiting(id, sess.id)
+		}
+	}
+}
+
+// stopWaiting stops waiting for recipient to acknowledge msg id, the msg is
+// forgotten once nobody is left to acknowledge it. The caller holds al.
+func (server *Server) stopWaiting(id, recipient uint64) {
+	p, ok := server.acks[id]
+	if !ok {
+		return
+	}
+	delete(p.waiting, recipient)
+	server.forgetOwed(recipient, id)
+	if len(p.waiting) == 0 {
+		server.removeAck(id)
+	}
+}
+
+// removeAck forgets msg id and its index entries, the caller holds al
+func (server *Server) removeAck(id uint64) {
+	p, ok := server.acks[id]
+	if !ok {
+		return
+	}
+	for r := range p.waiting {
+		server.forgetOwed(r, id)
+	}
+	if sent := server.sentAcks[p.sender]; sent != nil {
+		delete(sent, id)
+		if len(sent) == 0 {
+			delete(server.sentAcks, p.sender)
+		}
+	}
+	delete(server.acks, id)
+}
+
+// forgetOwed removes msg id from the acks owed by recipient, the caller
+// holds al
+func (server *Server) forgetOwed(recipient, id uint64) {
+	owed := server.owedAcks[recipient]
+	delete(owed, id)
+	if len(owed) == 0 {
+		delete(server.owedAcks, recipient)
+	}
+}
+
+// pendingAcks returns the number of msgs still waiting for acks
+func (server *Server) pendingAcks() int {
+	server.al.Lock()
+	defer server.al.Unlock()
+	return len(server.acks)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// refuseTimeout bounds how long writing the REFUSED event to a refused
+// connection may take, including waiting for the client to tell which
+// protocol it speaks
+const refuseTimeout = time.Second
+
+// maxRefusing is the number of connections told at once why they are
+// refused, connections refused beyond it are closed right away so a flood
+// of them holds neither goroutines nor sockets
+const maxRefusing = 64
+
+// ConnectionStats counts the connections accepted and the ones refused by
+// reason
+type ConnectionStats struct {
+	Accepted uint64
+	// Full were refused since the server served Config.MaxConns
+	// connections, TooManyFromIP since their address had
+	// Config.MaxConnsPerIP connections and Denied since their address was
+	// not allowed
+	Full          uint64
+	TooManyFromIP uint64
+	Denied        uint64
+}
+
+// ConnectionStats returns the number of connections accepted and refused
+// so far
+func (server *Server) ConnectionStats() ConnectionStats {
+	return ConnectionStats{
+		Accepted:      atomic.LoadUint64(&server.connStats.Accepted),
+		Full:          atomic.LoadUint64(&server.connStats.Full),
+		TooManyFromIP: atomic.LoadUint64(&server.connStats.TooManyFromIP),
+		Denied:        atomic.LoadUint64(&server.connStats.Denied),
+	}
+}
+
+// ParseNetworks parses a comma separated list of CIDR networks, plain IP
+// addresses are networks of their own
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("server: invalid network %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("server: invalid network %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// connIP returns the IP address of the peer of conn, it is nil for
+// connections without one like in-memory ones
+func connIP(conn net.Conn) net.IP {
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIn decides whether conn is served and counts it in, it returns the
+// reason a refused connection gets. Connections without an IP address are
+// only subject to Config.MaxConns.
+func (server *Server) checkIn(conn net.Conn) string {
+	ip := connIP(conn)
+	if ip != nil {
+		if containsIP(server.config.Deny, ip) ||
+			len(server.config.Allow) > 0 && !containsIP(server.config.Allow, ip) {
+			atomic.AddUint64(&server.connStats.Denied, 1)
+			return protocol.RefusedAddressDenied
+		}
+	}
+
+	server.sl.Lock()
+	defer server.sl.Unlock()
+	if server.config.MaxConns > 0 && server.conns >= server.config.MaxConns {
+		atomic.AddUint64(&server.connStats.Full, 1)
+		return protocol.RefusedServerFull
+	}
+	if ip != nil {
+		key := ip.String()
+		if server.config.MaxConnsPerIP > 0 && server.connsPerIP[key] >= server.config.MaxConnsPerIP {
+			atomic.AddUint64(&server.connStats.TooManyFromIP, 1)
+			return protocol.RefusedTooManyFromIP
+		}
+		server.connsPerIP[key]++
+	}
+	server.conns++
+	atomic.AddUint64(&server.connStats.Accepted, 1)
+	return ""
+}
+
+// checkOut forgets a connection counted in by checkIn
+func (server *Server) checkOut(conn net.Conn) {
+	server.sl.Lock()
+	defer server.sl.Unlock()
+	server.conns--
+	if ip := connIP(conn); ip != nil {
+		key := ip.String()
+		server.connsPerIP[key]--
+		if server.connsPerIP[key] <= 0 {
+			delete(server.connsPerIP, key)
+		}
+	}
+}
+
+// reject refuses conn for reason, unless too many connections are being
+// refused already it is told why in the background
+func (server *Server) reject(conn net.Conn, reason string) {
+	select {
+	case server.refusing <- struct{}{}:
+		go server.refuse(conn, reason)
+	default:
+		conn.Close()
+	}
+}
+
+// refuse writes the REFUSED event telling why to conn and closes it. The
+// event is framed for clients starting with protocol.FramePreface, clients
+// which say nothing get it in the line format.
+func (server *Server) refuse(conn net.Conn, reason string) {
+	defer func() { <-server.refusing }()
+	defer conn.Close()
+	server.logger.Infof("server: refusing connection from %s: %s", conn.RemoteAddr(), strings.ToLower(reason))
+	conn.SetDeadline(time.Now().Add(refuseTimeout))
+
+	m := protocol.NewRefused(reason)
+	b := m.Marshal()
+	first := make([]byte, 1)
+	if n, _ := conn.Read(first); n == 1 && first[0] == protocol.FramePreface {
+		b, _ = protocol.MarshalFrame(m)
+	}
+	if _, err := conn.Write(b); err != nil {
+		return
+	}
+
+	// closing with unread data resets the connection, which may discard
+	// the event before the client read it
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+	io.Copy(ioutil.Discard, conn)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// addrConn is a connection from addr
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func connFrom(ip string) net.Conn {
+	return addrConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+}
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := ParseNetworks(" 10.0.0.0/8, 192.168.1.7,,::1 ")
+	assert.NoError(t, err)
+	assert.Len(t, nets, 3)
+	assert.Equal(t, "10.0.0.0/8", nets[0].String())
+	assert.Equal(t, "192.168.1.7/32", nets[1].String())
+	assert.Equal(t, "::1/128", nets[2].String())
+
+	nets, err = ParseNetworks("")
+	assert.NoError(t, err)
+	assert.Empty(t, nets)
+
+	_, err = ParseNetworks("10.0.0.0/8,localhost")
+	assert.Error(t, err)
+	_, err = ParseNetworks("10.0.0.0/33")
+	assert.Error(t, err)
+}
+
+func TestServer_CheckIn(t *testing.T) {
+	allow, _ := ParseNetworks("10.0.0.0/8")
+	deny, _ := ParseNetworks("10.0.0.66")
+	server := New(WithMaxConns(3, 2), WithAllow(allow...), WithDeny(deny...))
+
+	a1, a2, a3 := connFrom("10.0.0.1"), connFrom("10.0.0.1"), connFrom("10.0.0.1")
+	assert.Equal(t, "", server.checkIn(a1))
+	assert.Equal(t, "", server.checkIn(a2))
+	assert.Equal(t, protocol.RefusedTooManyFromIP, server.checkIn(a3))
+	assert.Equal(t, protocol.RefusedAddressDenied, server.checkIn(connFrom("10.0.0.66")))
+	assert.Equal(t, protocol.RefusedAddressDenied, server.checkIn(connFrom("172.16.0.1")))
+
+	// connections without an address only count towards the total
+	b, _ := net.Pipe()
+	defer b.Close()
+	assert.Equal(t, "", server.checkIn(b))
+	assert.Equal(t, protocol.RefusedServerFull, server.checkIn(connFrom("10.0.0.2")))
+
+	server.checkOut(a1)
+	assert.Equal(t, "", server.checkIn(a3))
+	server.checkOut(a2)
+	server.checkOut(a3)
+	server.checkOut(b)
+	assert.Equal(t, 0, server.conns)
+	assert.Empty(t, server.connsPerIP)
+
+	assert.Equal(t, ConnectionStats{Accepted: 4, Full: 1, TooManyFromIP: 1, Denied: 2}, server.ConnectionStats())
+}
+
+func TestServer_Reject(t *testing.T) {
+	server := New()
+	for i := 0; i < maxRefusing; i++ {
+		server.refusing <- struct{}{}
+	}
+
+	// connections refused beyond the limit are closed without a word
+	a, b := net.Pipe()
+	defer b.Close()
+	server.reject(a, protocol.RefusedServerFull)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := b.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	<-server.refusing
+	a, b = net.Pipe()
+	defer b.Close()
+	server.reject(a, protocol.RefusedServerFull)
+	_, err = b.Write([]byte("I"))
+	assert.NoError(t, err)
+	r := bufio.NewReader(b)
+	line, err := r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, protocol.RefusedMsg+"\n", line)
+}
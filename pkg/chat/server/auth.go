@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// maxAuthAttempts is the number of failed AUTH msgs a connection may send
+// before it is closed
+const maxAuthAttempts = 3
+
+// ErrAuthFailed is returned by authenticators for unknown users, wrong
+// secrets and methods they do not implement
+var ErrAuthFailed = errors.New("server: authentication failed")
+
+// Authenticator checks the credentials of AUTH msgs. Once it is set in
+// the server config every connection has to authenticate before anything
+// but HELLO and PING is handled.
+type Authenticator interface {
+	// Authenticate returns the name of the user the credentials belong
+	// to, the connection is logged in to its account. An empty name
+	// authenticates the connection without logging it in.
+	Authenticate(method, username, secret string) (string, error)
+}
+
+// Authenticators tries each of its authenticators in turn until one of
+// them accepts the credentials, e.g. to allow both passwords and tokens
+type Authenticators []Authenticator
+
+// Authenticate returns the user name of the first authenticator accepting
+// the credentials
+func (aa Authenticators) Authenticate(method, username, secret string) (string, error) {
+	err := ErrAuthFailed
+	for _, a := range aa {
+		var name string
+		name, err = a.Authenticate(method, username, secret)
+		if err == nil {
+			return name, nil
+		}
+	}
+	return "", err
+}
+
+// dummyHash is compared against the passwords of unknown users so they
+// take about as long to reject as wrong passwords
+var (
+	dummyHash     []byte
+	dummyHashOnce = &sync.Once{}
+)
+
+// PasswordFile authenticates users with the bcrypt password hashes of an
+// htpasswd style file
+type PasswordFile struct {
+	hashes map[string][]byte
+}
+
+// LoadPasswordFile reads the `name:hash` lines of the file in path, as
+// written by `htpasswd -B`. Empty lines and lines starting with `#` are
+// skipped, hashes other than bcrypt are rejected.
+func LoadPasswordFile(path string) (*PasswordFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("server: opening password file failed: %s", err)
+	}
+	defer file.Close()
+
+	p := &PasswordFile{hashes: make(map[string][]byte)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.IndexByte(text, ':')
+		if i < 0 || !protocol.ValidName(text[:i]) {
+			return nil, fmt.Errorf("server: password file %s:%d is malformed", path, line)
+		}
+		hash := []byte(text[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("server: password file %s:%d has no bcrypt hash", path, line)
+		}
+		p.hashes[text[:i]] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("server: reading password file failed: %s", err)
+	}
+	return p, nil
+}
+
+// Authenticate checks the password of username
+func (p *PasswordFile) Authenticate(method, username, secret string) (string, error) {
+	if method != protocol.AuthPassword {
+		return "", ErrAuthFailed
+	}
+	hash, ok := p.hashes[username]
+	if !ok {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(secret))
+		return "", ErrAuthFailed
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(secret)) != nil {
+		return "", ErrAuthFailed
+	}
+	return username, nil
+}
+
+// BearerTokens authenticates connections with pre-shared tokens, each
+// token may log the connection in to a user account
+type BearerTokens struct {
+	// tokens maps the tokens to their user names
+	tokens map[string]string
+}
+
+// NewBearerTokens creates an authenticator accepting the keys of tokens,
+// their values are the user names, empty for tokens which do not log in
+func NewBearerTokens(tokens map[string]string) *BearerTokens {
+	t := &BearerTokens{tokens: make(map[string]string, len(tokens))}
+	for token, name := range tokens {
+		t.tokens[token] = name
+	}
+	return t
+}
+
+// LoadBearerTokens reads the `token [name]` lines of the file in path.
+// Empty lines and lines starting with `#` are skipped.
+func LoadBearerTokens(path string) (*BearerTokens, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("server: opening token file failed: %s", err)
+	}
+	defer file.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 || len(fields) == 2 && !protocol.ValidName(fields[1]) {
+			return nil, fmt.Errorf("server: token file %s:%d is malformed", path, line)
+		}
+		tokens[fields[0]] = ""
+		if len(fields) == 2 {
+			tokens[fields[0]] = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("server: reading token file failed: %s", err)
+	}
+	return &BearerTokens{tokens: tokens}, nil
+}
+
+// Authenticate checks the token, every known token is compared so the
+// time taken does not tell how much of a token was right
+func (t *BearerTokens) Authenticate(method, username, secret string) (string, error) {
+	if method != protocol.AuthBearer {
+		return "", ErrAuthFailed
+	}
+	name, ok := "", false
+	for token, n := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+			name, ok = n, true
+		}
+	}
+	if !ok {
+		return "", ErrAuthFailed
+	}
+	return name, nil
+}
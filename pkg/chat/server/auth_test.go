@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/xesina/tcp-chat/pkg/chat/client"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+const authTestAddr = "localhost:50008"
+
+func writePasswordFile(t *testing.T, path string, passwords map[string]string) {
+	content := "# users\n\n"
+	for name, password := range passwords {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content += name + ":" + string(hash) + "\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+	writePasswordFile(t, path, map[string]string{"alice": "wonderland", "bob": "builder"})
+
+	p, err := LoadPasswordFile(path)
+	assert.NoError(t, err)
+
+	tt := []struct {
+		method, username, secret string
+		want                     string
+		hasErr                   bool
+	}{
+		{method: protocol.AuthPassword, username: "alice", secret: "wonderland", want: "alice", hasErr: false},
+		{method: protocol.AuthPassword, username: "bob", secret: "builder", want: "bob", hasErr: false},
+		{method: protocol.AuthPassword, username: "alice", secret: "builder", want: "", hasErr: true},
+		{method: protocol.AuthPassword, username: "carol", secret: "builder", want: "", hasErr: true},
+		{method: protocol.AuthBearer, username: "", secret: "wonderland", want: "", hasErr: true},
+	}
+
+	for _, tc := range tt {
+		name, err := p.Authenticate(tc.method, tc.username, tc.secret)
+		if tc.hasErr {
+			assert.Equal(t, ErrAuthFailed, err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, tc.want, name)
+	}
+}
+
+func TestLoadPasswordFile_Malformed(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	for _, content := range []string{"alice\n", "alice:{SHA}kd/Z3bQZiv/FwZTNjObTOP3kcOI=\n", "al ice:$2y$05$abc\n"} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		_, err := LoadPasswordFile(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestBearerTokens(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+	assert.NoError(t, ioutil.WriteFile(path, []byte("# tokens\nt0k3n alice\n\nanon\n"), 0600))
+
+	tokens, err := LoadBearerTokens(path)
+	assert.NoError(t, err)
+
+	name, err := tokens.Authenticate(protocol.AuthBearer, "", "t0k3n")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", name)
+	name, err = tokens.Authenticate(protocol.AuthBearer, "", "anon")
+	assert.NoError(t, err)
+	assert.Equal(t, "", name)
+	_, err = tokens.Authenticate(protocol.AuthBearer, "", "t0k3")
+	assert.Equal(t, ErrAuthFailed, err)
+	_, err = tokens.Authenticate(protocol.AuthPassword, "alice", "t0k3n")
+	assert.Equal(t, ErrAuthFailed, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("t0k3n alice bob\n"), 0600))
+	_, err = LoadBearerTokens(path)
+	assert.Error(t, err)
+}
+
+func TestServer_Auth(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+	writePasswordFile(t, path, map[string]string{"alice": "wonderland"})
+	passwords, err := LoadPasswordFile(path)
+	assert.NoError(t, err)
+
+	server := NewWithConfig(Config{
+		Auth: Authenticators{passwords, NewBearerTokens(map[string]string{"anon": ""})},
+	})
+	tcpAddr, err := net.ResolveTCPAddr("tcp", authTestAddr)
+	assert.NoError(t, err)
+	go server.Start(tcpAddr)
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", authTestAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// unauthenticated clients are neither listed nor served
+	raw, err := net.Dial("tcp", authTestAddr)
+	assert.NoError(t, err)
+	defer raw.Close()
+	r := bufio.NewReader(raw)
+
+	anon := client.New()
+	err = anon.ConnectWithCredentials(tcpAddr, client.Credentials{Token: "anon"})
+	assert.NoError(t, err)
+	defer anon.Close()
+	anonID, name, err := anon.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, "", name)
+
+	alice := client.NewWithConfig(client.Config{Protocol: client.ProtocolLine})
+	err = alice.ConnectWithCredentials(tcpAddr, client.Credentials{Username: "alice", Password: "wonderland"})
+	assert.NoError(t, err)
+	defer alice.Close()
+	aliceID, name, err := alice.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", name)
+	_, err = alice.Login("bob")
+	assert.Error(t, err)
+
+	ids, err := alice.ListClientIDs()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{anonID}, ids)
+	result, err := anon.SendMsg([]uint64{aliceID}, []byte("Hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{aliceID}, result.Delivered)
+
+	_, err = raw.Write([]byte("LIST\n"))
+	assert.NoError(t, err)
+	line, err := r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "ERR AUTH REQUIRED\n", line)
+	_, err = r.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+
+	wrong := client.New()
+	err = wrong.ConnectWithCredentials(tcpAddr, client.Credentials{Username: "alice", Password: "builder"})
+	assert.Error(t, err)
+
+	// the connection is closed after too many failed attempts
+	raw, err = net.Dial("tcp", authTestAddr)
+	assert.NoError(t, err)
+	defer raw.Close()
+	r = bufio.NewReader(raw)
+	for i := 0; i < maxAuthAttempts; i++ {
+		_, err = raw.Write(protocol.NewPasswordAuth("alice", "builder").Marshal())
+		assert.NoError(t, err)
+		line, err := r.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "ERR AUTH FAILED\n", line)
+	}
+	_, err = r.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+}
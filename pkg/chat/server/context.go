@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+)
+
+// Context is passed to the handlers of msgs, it reads the arguments of the
+// msg and writes the responses to the client which sent it. A Context is
+// only valid until its handler returns.
+type Context struct {
+	id  uint64
+	msg string
+	seq uint64
+
+	// reqID is the optional request id chosen by the client, it is echoed
+	// in every response written through the context
+	reqID uint64
+
+	// r reads the arguments in the line format, for frames it is created
+	// from the payload on first use
+	r      *bufio.Reader
+	sess   *session
+	server *Server
+
+	// name is the name the handler was registered with, protocol.UnknownMsg
+	// for msgs without one, and handler is the handler of the msg wrapped
+	// in its own middleware
+	name    string
+	handler HandlerFunc
+
+	// frame is set when the message was received using the framed protocol
+	frame *protocol.Frame
+}
+
+// ID returns the id of the client which sent the msg
+func (c *Context) ID() uint64 {
+	return c.id
+}
+
+// UserName returns the name of the user the client is logged in to, it is
+// empty for anonymous clients
+func (c *Context) UserName() string {
+	// name is only changed by the handlers of this connection
+	return c.sess.name
+}
+
+// Command returns the name the handler of the msg was registered with, it
+// is protocol.UnknownMsg for msgs without a handler
+func (c *Context) Command() string {
+	return c.name
+}
+
+// RequestID returns the request id chosen by the client, it is zero when
+// the client did not send one
+func (c *Context) RequestID() uint64 {
+	return c.reqID
+}
+
+// ProtocolVersion returns the protocol version agreed on with the client
+func (c *Context) ProtocolVersion() uint64 {
+	return c.sess.protocolVersion()
+}
+
+// HasCapability reports whether the client agreed on the named capability
+func (c *Context) HasCapability(name string) bool {
+	return c.sess.hasCap(name)
+}
+
+// Server returns the server handling the msg, e.g. to list the connected
+// clients
+func (c *Context) Server() *Server {
+	return c.server
+}
+
+// Context returns the context of the connection, it is cancelled once the
+// connection is closed or the server gives up waiting for it to finish
+func (c *Context) Context() context.Context {
+	return c.sess.ctx
+}
+
+// Reader returns the reader of the arguments of the msg, one line per
+// argument. Handlers must read all of them before returning.
+func (c *Context) Reader() *bufio.Reader {
+	if c.r == nil {
+		c.r = bufio.NewReader(bytes.NewReader(c.frame.Payload))
+	}
+	return c.r
+}
+
+// ReadArg reads the next argument of the msg
+func (c *Context) ReadArg() (string, error) {
+	return protocol.ReadStringArg(c.Reader())
+}
+
+// Decode reads the arguments of the current message into m
+func (c *Context) Decode(m protocol.Unmarshaler) error {
+	if c.frame != nil {
+		return c.frame.Decode(m)
+	}
+	return m.Unmarshal(c.Reader())
+}
+
+// Reply sends m as the response of the current message
+func (c *Context) Reply(m protocol.Message) error {
+	return c.sess.reply(c.reqID, m)
+}
+
+// ReplyText sends the TEXT response body, which must fit in a single line
+func (c *Context) ReplyText(body string) error {
+	return c.Reply(protocol.NewText(body))
+}
+
+// ReplyDone sends the DONE response
+func (c *Context) ReplyDone() error {
+	return c.Reply(protocol.NewDone())
+}
+
+// ReplyError sends e as the response of the current message, sessions
+// speaking a protocol version older than ErrorCodesVersion get the ERR or
+// UNKNOWN MESSAGE response instead
+func (c *Context) ReplyError(e *protocol.Error) error {
+	if c.sess.protocolVersion() < protocol.ErrorCodesVersion {
+		return c.Reply(e.Legacy())
+	}
+	return c.Reply(e)
+}
+
+// Hangup closes the connection once the responses queued so far are
+// written, no more msgs of the client are handled
+func (c *Context) Hangup() {
+	c.sess.hangup()
+}
@@ -0,0 +1,5 @@
+// Package server implements an embeddable tcp-chat server. Besides the
+// built-in msgs it handles the commands registered with HandleFunc, whose
+// handlers read the arguments and reply through a Context, and every
+// handler can be wrapped in Middleware.
+package server
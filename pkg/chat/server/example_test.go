@@ -0,0 +1,39 @@
+package server_test
+
+import (
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/client"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"github.com/xesina/tcp-chat/pkg/chat/server"
+	"net"
+	"strings"
+	"time"
+)
+
+func ExampleServer_HandleFunc() {
+	srv := server.New(server.WithIdleTimeout(time.Minute))
+	srv.HandleFunc("ECHO", func(c *server.Context) error {
+		text, err := c.ReadArg()
+		if err != nil {
+			return c.ReplyError(protocol.NewError(protocol.CodeMalformedMessage))
+		}
+		return c.ReplyText(strings.ToUpper(text))
+	})
+
+	addr := &net.TCPAddr{Port: 50018}
+	go srv.Start(addr)
+	defer srv.Stop()
+
+	cl := client.New()
+	for i := 0; i < 50 && cl.Connect(addr) != nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer cl.Close()
+
+	text, err := cl.Command("ECHO", "hello")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(text)
+	// Output: HELLO
+}
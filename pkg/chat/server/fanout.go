@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"sync"
+	"sync/atomic"
+)
+
+var fanoutPool = sync.Pool{
+	New: func() interface{} { return new(fanout) },
+}
+
+// newline completes the line encoding of msgs after their body
+var newline = []byte{'\n'}
+
+// fanout is an INCOMING msg delivered to many sessions. It is encoded once
+// for every wire format and ack tag the recipients need, the encodings
+// share the body of the msg which is never copied. Every queued encoding
+// holds a reference, the fanout goes back to fanoutPool once the last one
+// was written or dropped.
+type fanout struct {
+	m   *protocol.Incoming
+	tag uint64
+	// multiline msgs can not be written in the line protocol
+	multiline bool
+
+	// head holds the heads of the encodings, vecs the encodings indexed
+	// by variant. They are only used by the goroutine delivering the msg.
+	head []byte
+	vecs [4][3][]byte
+	n    [4]int
+
+	refs int32
+}
+
+// newFanout returns the fanout of m, recipients which agreed on acks get it
+// tagged with tag. The caller holds the first reference.
+func newFanout(m *protocol.Incoming, tag uint64) *fanout {
+	f := fanoutPool.Get().(*fanout)
+	f.m = m
+	f.tag = tag
+	f.multiline = bytes.IndexByte(m.Body(), '\n') >= 0
+	f.refs = 1
+	return f
+}
+
+// encoding returns the encoding of the msg in the line or the framed
+// protocol, tagged with the msg id or not. The returned slices must not be
+// modified.
+func (f *fanout) encoding(framed, tagged bool) [][]byte {
+	v := 0
+	if framed {
+		v |= 1
+	}
+	if tagged {
+		v |= 2
+	}
+	if f.n[v] > 0 {
+		return f.vecs[v][:f.n[v]]
+	}
+
+	var tag uint64
+	if tagged {
+		tag = f.tag
+	}
+	// heads appended after a reallocation of head leave the earlier ones
+	// in the old array, which stays valid for the slices pointing to it
+	start := len(f.head)
+	if framed {
+		f.head = f.m.AppendFrameHead(f.head, tag)
+	} else {
+		f.head = f.m.AppendHead(f.head, tag)
+	}
+	f.vecs[v][0] = f.head[start:len(f.head):len(f.head)]
+	f.vecs[v][1] = f.m.Body()
+	f.n[v] = 2
+	if !framed {
+		f.vecs[v][2] = newline
+		f.n[v] = 3
+	}
+	return f.vecs[v][:f.n[v]]
+}
+
+func (f *fanout) retain() {
+	atomic.AddInt32(&f.refs, 1)
+}
+
+// release drops a reference, f must not be used by the caller afterwards
+func (f *fanout) release() {
+	if atomic.AddInt32(&f.refs, -1) != 0 {
+		return
+	}
+	f.m = nil
+	f.head = f.head[:0]
+	f.vecs = [4][3][]byte{}
+	f.n = [4]int{}
+	fanoutPool.Put(f)
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// file store log records
+const (
+	recordRegister byte = iota + 1
+	recordPush
+	recordDrain
+)
+
+// maxRecordSize bounds the records read back from the log, a body is at
+// most 1M
+const maxRecordSize = 2 << 20
+
+// compactSize is the size the log may grow to before it is compacted, it
+// is compacted once most of it is msgs which have been drained
+const compactSize = 1 << 20
+
+var errCorruptLog = errors.New("server: corrupt message store log")
+
+// FileStore is a MessageStore which survives restarts. Every change is
+// appended to a log file which is replayed when the store is opened. Once
+// the log is mostly drained msgs it is rewritten with the records the store
+// still needs.
+type FileStore struct {
+	mem  *MemoryStore
+	path string
+
+	// wl serializes appending to the log with updating mem so the log
+	// order always matches the order the changes were applied
+	wl   *sync.Mutex
+	file *os.File
+
+	// size is the size of the log, live the size of the records the store
+	// still needs of it and pushed the size of the push records of every
+	// identity. They are guarded by wl.
+	size   int64
+	live   int64
+	pushed map[uint64]int64
+}
+
+// OpenFileStore opens the store logged to path, creating it if needed
+func OpenFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("server: opening message store failed: %s", err)
+	}
+
+	s := &FileStore{
+		mem:    NewMemoryStore(),
+		path:   path,
+		wl:     &sync.Mutex{},
+		file:   file,
+		pushed: make(map[uint64]int64),
+	}
+	err = s.replay(file)
+	if err == io.ErrUnexpectedEOF {
+		// the server stopped while appending the last record, cut it off
+		// so the next record does not end up behind it
+		err = file.Truncate(s.size)
+	}
+	if err == nil {
+		err = s.compact()
+	}
+	if err != nil {
+		s.file.Close()
+		return nil, fmt.Errorf("server: reading message store failed: %s", err)
+	}
+	return s, nil
+}
+
+// Register issues the resume token of identity id
+func (s *FileStore) Register(id uint64) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	n, err := s.append(recordRegister, id, []byte(token))
+	if err != nil {
+		return "", err
+	}
+	s.live += n
+	s.mem.register(id, token)
+	s.compact()
+	return token, nil
+}
+
+// Claim returns the identity a resume token was issued for
+func (s *FileStore) Claim(token string) (uint64, error) {
+	return s.mem.Claim(token)
+}
+
+// Registered reports whether a resume token was issued for id
+func (s *FileStore) Registered(id uint64) bool {
+	return s.mem.Registered(id)
+}
+
+// Push stores m for the offline identity id
+func (s *FileStore) Push(id uint64, m StoredMessage) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	// check first so the log never holds msgs the store rejected
+	if !s.mem.Registered(id) {
+		return ErrNotRegistered
+	}
+	s.mem.mu.Lock()
+	full := len(s.mem.pending[id]) >= MaxStoredMessages
+	s.mem.mu.Unlock()
+	if full {
+		return ErrStoreFull
+	}
+
+	n, err := s.append(recordPush, id, pushData(m))
+	if err != nil {
+		return err
+	}
+	s.live += n
+	s.pushed[id] += n
+	err = s.mem.Push(id, m)
+	s.compact()
+	return err
+}
+
+// Drain removes and returns the msgs stored for id
+func (s *FileStore) Drain(id uint64) ([]StoredMessage, error) {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	s.mem.mu.Lock()
+	empty := len(s.mem.pending[id]) == 0
+	s.mem.mu.Unlock()
+	if empty {
+		return nil, nil
+	}
+
+	_, err := s.append(recordDrain, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.live -= s.pushed[id]
+	delete(s.pushed, id)
+	return s.mem.Drain(id)
+}
+
+// LastID returns the highest identity known to the store
+func (s *FileStore) LastID() uint64 {
+	return s.mem.LastID()
+}
+
+// Close closes the log file
+func (s *FileStore) Close() error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	return s.file.Close()
+}
+
+// pushData encodes m as the data of a push record, the sender as an
+// unsigned varint followed by the body
+func pushData(m StoredMessage) []byte {
+	b := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(m.Body))
+	n := binary.PutUvarint(b, m.Sender)
+	return append(b[:n], m.Body...)
+}
+
+// appendRecord appends a record to b, records are the kind byte followed
+// by the identity and the length of the data as unsigned varints and the
+// data
+func appendRecord(b []byte, kind byte, id uint64, data []byte) []byte {
+	var head [1 + 2*binary.MaxVarintLen64]byte
+	head[0] = kind
+	n := 1
+	n += binary.PutUvarint(head[n:], id)
+	n += binary.PutUvarint(head[n:], uint64(len(data)))
+	b = append(b, head[:n]...)
+	return append(b, data...)
+}
+
+// append writes a record to the log and returns its size
+func (s *FileStore) append(kind byte, id uint64, data []byte) (int64, error) {
+	n, err := s.file.Write(appendRecord(nil, kind, id, data))
+	s.size += int64(n)
+	if err != nil {
+		return 0, fmt.Errorf("server: writing message store failed: %s", err)
+	}
+	return int64(n), nil
+}
+
+// compact rewrites the log with the records the store still needs once it
+// is larger than compactSize and most of it is not needed anymore. The new
+// log replaces the old one when it is complete so a crash leaves one or the
+// other, when compacting fails the old one is kept. It is done when the
+// store is opened and after registering and pushing, which unlike draining
+// are not done by the server while binding an identity. The caller holds
+// wl.
+func (s *FileStore) compact() error {
+	if s.size < compactSize || s.size < 2*s.live {
+		return nil
+	}
+
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("server: compacting message store failed: %s", err)
+	}
+	w := bufio.NewWriter(file)
+	var size int64
+	pushed := make(map[uint64]int64)
+	write := func(kind byte, id uint64, data []byte) {
+		b := appendRecord(nil, kind, id, data)
+		w.Write(b)
+		size += int64(len(b))
+		if kind == recordPush {
+			pushed[id] += int64(len(b))
+		}
+	}
+	s.mem.mu.Lock()
+	for token, id := range s.mem.tokens {
+		write(recordRegister, id, []byte(token))
+	}
+	for id, msgs := range s.mem.pending {
+		for _, m := range msgs {
+			write(recordPush, id, pushData(m))
+		}
+	}
+	s.mem.mu.Unlock()
+
+	err = w.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("server: compacting message store failed: %s", err)
+	}
+	s.file.Close()
+	s.file = file
+	s.size, s.live, s.pushed = size, size, pushed
+	return nil
+}
+
+// replay applies the records of the log to the in-memory state, size
+// ends up as the size of the complete records read
+func (s *FileStore) replay(file io.Reader) error {
+	var read int64
+	r := bufio.NewReader(countingReader{r: file, n: &read})
+	for {
+		kind, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id, data, err := readRecord(r)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		n := read - int64(r.Buffered()) - s.size
+
+		switch kind {
+		case recordRegister:
+			s.mem.register(id, string(data))
+			s.live += n
+		case recordPush:
+			sender, k := binary.Uvarint(data)
+			if k <= 0 {
+				return errCorruptLog
+			}
+			s.mem.mu.Lock()
+			s.mem.pending[id] = append(s.mem.pending[id], StoredMessage{Sender: sender, Body: data[k:]})
+			s.mem.mu.Unlock()
+			s.live += n
+			s.pushed[id] += n
+		case recordDrain:
+			s.mem.Drain(id)
+			s.live -= s.pushed[id]
+			delete(s.pushed, id)
+		default:
+			return errCorruptLog
+		}
+		s.size += n
+	}
+}
+
+// readRecord reads the identity and the data of a record after its kind
+func readRecord(r *bufio.Reader) (uint64, []byte, error) {
+	id, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > maxRecordSize {
+		return 0, nil, errCorruptLog
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return id, data, nil
+}
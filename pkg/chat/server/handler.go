@@ -0,0 +1,621 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"sync/atomic"
+)
+
+const (
+	receiveLogTpl  = "server: received %s message"
+	responseLogTpl = "server: sent %s message response: %s"
+)
+
+// HandlerFunc is a message/command handler
+type HandlerFunc func(*Context) error
+
+func (server *Server) handleUnknown(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, "UNKNOWN")
+
+	err := c.ReplyError(protocol.NewError(protocol.CodeUnknownMessage))
+	if err != nil {
+		return err
+	}
+	server.logger.Debugf(responseLogTpl, "UNKNOWN", protocol.UnknownMsg)
+
+	return nil
+}
+
+// capabilities lists the HELLO capabilities implemented by the server
+var capabilities = []string{protocol.CapFraming, protocol.CapRequestIDs, protocol.CapAcks, protocol.CapPresence}
+
+func (server *Server) handleHello(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.HelloMsg)
+
+	m := protocol.Hello{}
+	err := c.Decode(&m)
+	if err != nil {
+		return err
+	}
+
+	if c.seq != 1 {
+		return c.ReplyError(protocol.NewError(protocol.CodeHelloNotFirst))
+	}
+
+	if m.Version < protocol.MinProtocolVersion {
+		err := c.ReplyError(protocol.NewError(protocol.CodeUnsupportedVersion))
+		if err != nil {
+			return err
+		}
+		c.sess.hangup()
+		return &protocol.VersionError{Version: m.Version}
+	}
+
+	// newer clients are downgraded to the newest version we speak and
+	// have to decide themselves whether they can live with it
+	version := m.Version
+	if version > protocol.ProtocolVersion {
+		version = protocol.ProtocolVersion
+	}
+
+	var agreed []string
+	for _, requested := range m.Capabilities {
+		for _, supported := range capabilities {
+			if requested == supported {
+				agreed = append(agreed, requested)
+			}
+		}
+	}
+
+	err = c.sess.welcome(c.reqID, protocol.NewWelcome(version, agreed))
+	if err != nil {
+		return err
+	}
+	server.logger.Debugf(responseLogTpl, protocol.HelloMsg, fmt.Sprintf("%d %v", version, agreed))
+
+	return nil
+}
+
+func (server *Server) handleIdentity(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.IdentityMsg)
+
+	// name is only changed by the handlers of this connection
+	err := c.Reply(protocol.NewUserID(c.id, c.sess.name))
+	if err != nil {
+		return err
+	}
+	server.logger.Debugf(responseLogTpl, protocol.IdentityMsg, fmt.Sprint(c.id, " ", c.sess.name))
+
+	return nil
+}
+
+func (server *Server) handleList(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.ListMsg)
+
+	ids := server.ListClientIDs()
+	var response []uint64
+	for _, id := range ids {
+		if id == c.id {
+			continue
+		}
+		response = append(response, id)
+	}
+
+	err := c.Reply(protocol.NewClientIDs(response))
+	if err != nil {
+		return err
+	}
+	server.logger.Debugf(responseLogTpl, protocol.ListMsg, fmt.Sprint(response))
+
+	return nil
+}
+
+func (server *Server) handleSend(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.SendMsg)
+
+	m := protocol.Send{}
+	err := c.Decode(&m)
+	if err != nil {
+		if err := c.ReplyError(protocol.NewError(protocol.CodeMalformedMessage)); err != nil {
+			return err
+		}
+		return err
+	}
+
+	n := len(m.Recipients) + len(m.Names)
+	if m.Room != "" && n > 0 {
+		return c.ReplyError(protocol.NewError(protocol.CodeRoomNotAlone))
+	}
+	if m.Room == "" && (n == 0 || n > 255) {
+		return c.ReplyError(protocol.NewError(protocol.CodeInvalidRecipients))
+	}
+
+	if len(m.Body) > 1<<20 {
+		return c.ReplyError(protocol.NewError(protocol.CodeBodyTooLarge))
+	}
+
+	// the outcome of every recipient is reported once in the order they
+	// were given, names are resolved to the ids of their accounts
+	var ids []uint64
+	seen := make(map[uint64]bool, len(m.Recipients)+len(m.Names))
+	for _, id := range m.Recipients {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, name := range m.Names {
+		u, ok := server.users.Lookup(name)
+		if !ok {
+			return c.ReplyError(protocol.NewErrorDetail(protocol.CodeUnknownUser, name))
+		}
+		if !seen[u.ID] {
+			seen[u.ID] = true
+			ids = append(ids, u.ID)
+		}
+	}
+
+	incoming := protocol.NewIncoming(c.id, m.Body)
+	server.cl.RLock()
+	if m.Room != "" {
+		if !server.rooms.isMember(m.Room, c.id) {
+			server.cl.RUnlock()
+			return c.ReplyError(protocol.NewError(protocol.CodeNotInRoom))
+		}
+		ids = server.rooms.memberIDs(m.Room)
+		incoming = protocol.NewRoomIncoming(c.id, m.Room, m.Body)
+	}
+	if ok, err := server.admitRecipients(c, len(ids)); !ok {
+		server.cl.RUnlock()
+		return err
+	}
+	server.metrics.fanout.observe(float64(len(ids)))
+
+	msgID := atomic.AddUint64(&server.msgID, 1)
+	acks := c.sess.hasCap(protocol.CapAcks)
+	// encoded once for all the recipients, recipients which agreed on
+	// acks get the msg id to acknowledge
+	f := newFanout(incoming, msgID)
+	var delivered, unknown, failed, queued, offline []uint64
+
+	// the sender of a room msg is a member itself, its other sessions
+	// get the msg but it is not reported as a recipient
+	self := m.Room != ""
+
+	if acks {
+		var expected []uint64
+		for _, id := range ids {
+			if self && id == c.id {
+				continue
+			}
+			for _, sess := range server.clients.lookup(id) {
+				if sess != c.sess && sess.hasCap(protocol.CapAcks) {
+					expected = append(expected, id)
+					break
+				}
+			}
+		}
+		server.expectAcks(msgID, c.sess, expected)
+	}
+
+	for _, id := range ids {
+		sessions := server.clients.lookup(id)
+		if len(sessions) == 0 {
+			offline = append(offline, id)
+			continue
+		}
+
+		// every session of a user gets the msg, users sending to
+		// themselves reach their other sessions
+		ok := false
+		for _, sess := range sessions {
+			if sess == c.sess {
+				continue
+			}
+			if server.deliverFanout(sess, f) == nil {
+				ok = true
+			}
+		}
+		if self && id == c.id {
+			continue
+		}
+		if !ok {
+			failed = append(failed, id)
+			server.cancelAck(msgID, id)
+			continue
+		}
+		delivered = append(delivered, id)
+	}
+	server.cl.RUnlock()
+	f.release()
+
+	// stored without holding cl so logging in and resuming do not wait
+	// for the store
+	for _, id := range offline {
+		err := server.store.Push(id, StoredMessage{Sender: c.id, Body: m.Body})
+		switch err {
+		case nil:
+			queued = append(queued, id)
+			server.redeliver(id)
+		case ErrNotRegistered:
+			unknown = append(unknown, id)
+		default:
+			server.logger.Debugf("server: storing message for %d failed: %s", id, err)
+			failed = append(failed, id)
+		}
+	}
+
+	if c.sess.protocolVersion() < protocol.SendResultsVersion {
+		err = c.Reply(protocol.NewDone())
+		if err != nil {
+			return err
+		}
+		server.logger.Debugf(responseLogTpl, protocol.SendMsg, protocol.DoneMsg)
+		return nil
+	}
+
+	err = c.Reply(protocol.NewSent(msgID, delivered, unknown, failed, queued))
+	if err != nil {
+		return err
+	}
+	server.logger.Debugf(responseLogTpl, protocol.SendMsg,
+		fmt.Sprintf("delivered %v unknown %v failed %v queued %v", delivered, unknown, failed, queued))
+
+	return nil
+}
+
+func (server *Server) handleDelivered(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.DeliveredMsg)
+
+	m := protocol.Delivered{}
+	err := c.Decode(&m)
+	if err != nil {
+		return err
+	}
+
+	// acknowledgements have no response, they are relayed to the sender
+	// of the msg if it is still waiting for them
+	sender, ok := server.ack(m.MessageID, c.id)
+	if !ok {
+		return nil
+	}
+	return server.deliver(sender, 0, protocol.NewDelivered(m.MessageID, c.id))
+}
+
+func (server *Server) handleResume(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.ResumeMsg)
+
+	m := protocol.Resume{}
+	err := c.Decode(&m)
+	if err != nil {
+		return err
+	}
+
+	// logged in clients get their stored msgs with LOGIN
+	if c.sess.name != "" {
+		return c.ReplyError(protocol.NewError(protocol.CodeAlreadyLoggedIn))
+	}
+
+	if m.Token == "" {
+		token, err := server.store.Register(c.id)
+		if err != nil {
+			server.logger.Errorf("server: issuing resume token failed: %s", err)
+			return c.ReplyError(protocol.NewError(protocol.CodeResumeFailed))
+		}
+		return c.Reply(protocol.NewResumed(c.id, token))
+	}
+
+	id, err := server.store.Claim(m.Token)
+	if err == ErrUnknownToken {
+		return c.ReplyError(protocol.NewError(protocol.CodeUnknownToken))
+	}
+	if err == nil {
+		err = server.bind(c, id, "", protocol.NewResumed(id, m.Token))
+	}
+	if err == errIdentityInUse {
+		return c.ReplyError(protocol.NewError(protocol.CodeIdentityInUse))
+	}
+	if err != nil {
+		server.logger.Errorf("server: resuming %d failed: %s", id, err)
+		return c.ReplyError(protocol.NewError(protocol.CodeResumeFailed))
+	}
+	server.logger.Debugf(responseLogTpl, protocol.ResumeMsg, fmt.Sprint(id))
+
+	return nil
+}
+
+func (server *Server) handleLogin(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.LoginMsg)
+
+	m := protocol.Login{}
+	err := c.Decode(&m)
+	if err != nil {
+		return err
+	}
+
+	if !protocol.ValidName(m.Name) {
+		return c.ReplyError(protocol.NewError(protocol.CodeInvalidName))
+	}
+	if c.sess.name == m.Name {
+		return c.Reply(protocol.NewUserID(c.id, c.sess.name))
+	}
+	if c.sess.name != "" {
+		return c.ReplyError(protocol.NewError(protocol.CodeAlreadyLoggedIn))
+	}
+	// clients proving who they are with AUTH are logged in to the account
+	// their credentials belong to, they may not pick another one
+	if server.authenticates() {
+		return c.ReplyError(protocol.NewError(protocol.CodeAuthRequired))
+	}
+
+	u, err := server.login(c, m.Name)
+	if err != nil {
+		server.logger.Errorf("server: logging in %s failed: %s", m.Name, err)
+		return c.ReplyError(protocol.NewError(protocol.CodeLoginFailed))
+	}
+	server.logger.Debugf(responseLogTpl, protocol.LoginMsg, fmt.Sprint(u.ID, " ", u.Name))
+
+	return nil
+}
+
+// login binds the session of c to the account name, creating it on first
+// use, and replies with the id of the user
+func (server *Server) login(c *Context, name string) (User, error) {
+	var err error
+	u, ok := server.users.Lookup(name)
+	if !ok {
+		u, err = server.createUser(name)
+	}
+	if err == nil {
+		err = server.bind(c, u.ID, u.Name, protocol.NewUserID(u.ID, u.Name))
+	}
+	return u, err
+}
+
+func (server *Server) handleAuth(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.AuthMsg)
+
+	m := protocol.Auth{}
+	err := c.Decode(&m)
+	if err != nil {
+		return err
+	}
+
+	var name string
+	switch {
+	case m.Method == protocol.AuthCertificate:
+		// logs clients which needed no authentication in as well
+		if c.sess.name != "" {
+			return c.ReplyError(protocol.NewError(protocol.CodeAlreadyLoggedIn))
+		}
+		name, err = server.certificateUser(c.sess)
+	case server.config.Auth == nil:
+		return c.ReplyError(protocol.NewError(protocol.CodeAuthNotEnabled))
+	case c.sess.authed:
+		return c.ReplyError(protocol.NewError(protocol.CodeAlreadyAuthenticated))
+	default:
+		name, err = server.config.Auth.Authenticate(m.Method, m.Username, m.Secret)
+	}
+	if err != nil {
+		c.sess.authFailures++
+		server.logger.Infof("server: authentication of client %d failed: %s", c.id, err)
+		err := c.ReplyError(protocol.NewError(protocol.CodeAuthFailed))
+		if err != nil {
+			return err
+		}
+		if c.sess.authFailures >= maxAuthAttempts {
+			c.sess.hangup()
+			return ErrAuthFailed
+		}
+		return nil
+	}
+
+	if !c.sess.authed {
+		c.sess.authed = true
+		server.admit(c.sess)
+	}
+	if name == "" {
+		err = c.Reply(protocol.NewClientID(c.id))
+	} else {
+		_, err = server.login(c, name)
+	}
+	if err != nil {
+		server.logger.Errorf("server: logging in %s failed: %s", name, err)
+		if err := c.ReplyError(protocol.NewError(protocol.CodeLoginFailed)); err != nil {
+			return err
+		}
+		c.sess.hangup()
+		return err
+	}
+	server.logger.Debugf(responseLogTpl, protocol.AuthMsg, fmt.Sprint(c.id, " ", name))
+
+	return nil
+}
+
+func (server *Server) handleJoin(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.JoinMsg)
+
+	m := protocol.Join{}
+	err := c.Decode(&m)
+	if err != nil {
+		return err
+	}
+
+	if !protocol.ValidName(m.Room) {
+		return c.ReplyError(protocol.NewError(protocol.CodeInvalidRoom))
+	}
+
+	// joining twice is fine, the client is a member either way
+	server.rooms.join(m.Room, c.id)
+
+	err = c.Reply(protocol.NewDone())
+	if err != nil {
+		return err
+	}
+	server.logger.Debugf(responseLogTpl, protocol.JoinMsg, m.Room)
+
+	return nil
+}
+
+func (server *Server) handlePart(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.PartMsg)
+
+	m := protocol.Part{}
+	err := c.Decode(&m)
+	if err != nil {
+		return err
+	}
+
+	if !server.rooms.part(m.Room, c.id) {
+		return c.ReplyError(protocol.NewError(protocol.CodeNotInRoom))
+	}
+
+	err = c.Reply(protocol.NewDone())
+	if err != nil {
+		return err
+	}
+	server.logger.Debugf(responseLogTpl, protocol.PartMsg, m.Room)
+
+	return nil
+}
+
+func (server *Server) handleRooms(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.RoomsMsg)
+
+	names := server.rooms.names()
+
+	err := c.Reply(protocol.NewRoomList(names))
+	if err != nil {
+		return err
+	}
+	server.logger.Debugf(responseLogTpl, protocol.RoomsMsg, fmt.Sprint(names))
+
+	return nil
+}
+
+// handlePing answers the keepalive msgs of clients, reading the msg already
+// extended the deadline of the connection
+func (server *Server) handlePing(c *Context) error {
+	server.logger.Debugf(receiveLogTpl, protocol.PingMsg)
+
+	err := c.Reply(protocol.NewPong())
+	if err != nil {
+		return err
+	}
+	server.logger.Debugf(responseLogTpl, protocol.PingMsg, protocol.PongMsg)
+
+	return nil
+}
+
+// createUser creates the account name, msgs sent to it while none of its
+// sessions is connected are stored
+func (server *Server) createUser(name string) (User, error) {
+	u, err := server.users.Create(name, atomic.AddUint64(&server.id, 1))
+	if err == ErrUserExists {
+		// created by a concurrent login
+		u, _ = server.users.Lookup(name)
+		return u, nil
+	}
+	if err != nil {
+		return User{}, err
+	}
+	_, err = server.store.Register(u.ID)
+	return u, err
+}
+
+var errIdentityInUse = errors.New("server: identity in use")
+
+// bind switches the session of c to identity id, reply and the msgs stored
+// for the identity are queued while holding cl so from then on msgs for it
+// are delivered right away. Only users may have several sessions, named by
+// name, anonymous identities are bound to a single connection.
+func (server *Server) bind(c *Context, id uint64, name string, reply protocol.Message) error {
+	server.cl.Lock()
+	defer server.cl.Unlock()
+
+	if name == "" {
+		for _, sess := range server.clients.lookup(id) {
+			if sess != c.sess {
+				return errIdentityInUse
+			}
+		}
+	}
+
+	stored, err := server.store.Drain(id)
+	if err != nil {
+		return err
+	}
+	old := c.sess.id
+	left, joined := server.clients.rebind(c.sess, id)
+	if left {
+		server.rooms.move(old, id)
+		server.announce(protocol.NewLeft(old), c.sess)
+	}
+	if joined {
+		server.announce(protocol.NewJoined(id, name), c.sess)
+	}
+	c.sess.name = name
+	c.id = id
+
+	msgs := make([]protocol.Message, 0, len(stored))
+	for _, s := range stored {
+		msgs = append(msgs, protocol.NewIncoming(s.Sender, s.Body))
+	}
+	return c.sess.flush(c.reqID, reply, msgs)
+}
+
+// redeliver hands the msgs stored for id to its sessions if it came online
+// since it was found offline, binding the identity drained the store before
+// they were pushed then
+func (server *Server) redeliver(id uint64) {
+	server.cl.RLock()
+	defer server.cl.RUnlock()
+	sessions := server.clients.lookup(id)
+	if len(sessions) == 0 {
+		return
+	}
+	stored, err := server.store.Drain(id)
+	if err != nil {
+		server.logger.Errorf("server: draining messages of %d failed: %s", id, err)
+		return
+	}
+	for _, s := range stored {
+		m := protocol.NewIncoming(s.Sender, s.Body)
+		for _, sess := range sessions {
+			server.deliver(sess, 0, m)
+		}
+	}
+}
+
+// deliver queues m tagged with id for sess without ever waiting for it,
+// slow clients lose messages or get disconnected depending on the overflow
+// policy. An error is returned when m was not queued.
+func (server *Server) deliver(sess *session, id uint64, m protocol.Message) error {
+	evicted, err := sess.deliver(id, m)
+	return server.delivered(sess, evicted, err)
+}
+
+// deliverFanout queues the msg of f for sess like deliver
+func (server *Server) deliverFanout(sess *session, f *fanout) error {
+	evicted, err := sess.deliverFanout(f)
+	return server.delivered(sess, evicted, err)
+}
+
+// delivered accounts for the outcome of queueing a msg for sess
+func (server *Server) delivered(sess *session, evicted bool, err error) error {
+	if evicted || err == errQueueFull {
+		atomic.AddUint64(&server.dropped, 1)
+		server.logger.Debugf("server: dropped message for slow client %d", sess.clientID())
+	}
+	if err == errQueueOverflow {
+		atomic.AddUint64(&server.dropped, 1)
+		server.logger.Infof("server: disconnecting slow client %d", sess.clientID())
+		sess.conn.Close()
+		return err
+	}
+	if err != nil {
+		server.logger.Debugf("server: delivering message to %d failed: %s", sess.clientID(), err)
+	}
+	return err
+}
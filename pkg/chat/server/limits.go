@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRateLimited is returned by the handling of msgs of clients
+// disconnected for exceeding their rate limits over and over
+var ErrRateLimited = errors.New("server: rate limited")
+
+// RateLimits bound how much work a client may cause. A client over one of
+// its limits gets a RATE LIMITED error instead of its msg being handled,
+// the limits it exceeded recover over time. Zero limits do not limit
+// anything.
+//
+// Each limit is a token bucket allowing bursts of up to the limit per
+// period, a msg is let through as long as the bucket is not empty and may
+// leave it in debt. A single msg larger than the limit is thus handled,
+// but the client has to wait until the debt is paid before the next one.
+//
+// The limits are checked before a msg reaches its handler and the
+// middleware. Unlike them the RateLimit middleware delays msgs instead of
+// rejecting them, with a bucket of its own: a msg rejected by the limits
+// never reaches it and is not charged there, a msg let through is charged
+// by both and may be delayed further. Configured together the limits
+// should thus be the looser ones, they only cut off clients the
+// middleware can not slow down enough.
+type RateLimits struct {
+	// Commands is the number of msgs per second
+	Commands float64
+	// Bytes is the number of bytes read per second
+	Bytes float64
+	// Recipients is the number of recipients of SEND msgs per minute, the
+	// members of a room count for msgs sent to it
+	Recipients float64
+
+	// Strikes is the number of rate limited msgs per minute tolerated,
+	// clients rate limited once more are disconnected. They are never
+	// disconnected when it is zero and may connect again right away.
+	Strikes int
+}
+
+// limits returns the rate limits of the client of sess, named users may
+// have their own
+func (server *Server) limits(sess *session) RateLimits {
+	if l, ok := server.config.UserLimits[sess.name]; ok && sess.name != "" {
+		return l
+	}
+	return server.config.Limits
+}
+
+// limiter holds the token buckets of a session, like the session values it
+// is only used by the goroutine of the connection
+type limiter struct {
+	commands   bucket
+	bytes      bucket
+	recipients bucket
+	strikes    bucket
+
+	// read is the number of bytes read from the connection, charged the
+	// number of bytes consumed by the msgs so far
+	read    int64
+	charged int64
+}
+
+// allow takes n tokens from b unless it is in debt, the bucket holds up
+// to rate tokens refilled every period. A zero rate allows everything.
+func (b *bucket) allow(now time.Time, n, rate float64, per time.Duration) bool {
+	if rate <= 0 {
+		return true
+	}
+	if b.take(now, 0, rate/per.Seconds(), int(math.Ceil(rate))) > 0 {
+		return false
+	}
+	b.charge(now, n, rate, per)
+	return true
+}
+
+// charge takes n tokens from b like allow, even when it is in debt. It
+// reports whether b is in debt afterwards.
+func (b *bucket) charge(now time.Time, n, rate float64, per time.Duration) bool {
+	if rate <= 0 {
+		return false
+	}
+	return b.take(now, n, rate/per.Seconds(), int(math.Ceil(rate))) > 0
+}
+
+// admitMessage checks the limits of the client of c before its msg is
+// handled, consumed is the number of bytes of the connection consumed so
+// far. Msgs over the limits are answered with a RATE LIMITED error.
+func (server *Server) admitMessage(c *Context, consumed int64) (bool, error) {
+	l := server.limits(c.sess)
+	lim := &c.sess.limiter
+	now := time.Now()
+
+	// the bytes are charged once read even for rejected msgs, for the
+	// line protocol the arguments of a msg are only read once admitted
+	ok := lim.bytes.allow(now, 0, l.Bytes, time.Second)
+	lim.bytes.charge(now, float64(consumed-lim.charged), l.Bytes, time.Second)
+	lim.charged = consumed
+	if ok && lim.commands.allow(now, 1, l.Commands, time.Second) {
+		return true, nil
+	}
+	server.skipArgs(c)
+	return false, server.rateLimited(c)
+}
+
+// admitRecipients checks whether the client of c may send a msg to n
+// recipients, the msg is answered with a RATE LIMITED error when not
+func (server *Server) admitRecipients(c *Context, n int) (bool, error) {
+	l := server.limits(c.sess)
+	if c.sess.limiter.recipients.allow(time.Now(), float64(n), l.Recipients, time.Minute) {
+		return true, nil
+	}
+	return false, server.rateLimited(c)
+}
+
+// rateLimited replies to the msg of c with a RATE LIMITED error, clients
+// running out of strikes are disconnected
+func (server *Server) rateLimited(c *Context) error {
+	atomic.AddUint64(&server.limited, 1)
+	server.logger.Debugf("server: rate limited %s of client %d", c.msg, c.id)
+	err := c.ReplyError(protocol.NewError(protocol.CodeRateLimited))
+	if err != nil {
+		return err
+	}
+
+	l := server.limits(c.sess)
+	if l.Strikes <= 0 || !c.sess.limiter.strikes.charge(time.Now(), 1, float64(l.Strikes), time.Minute) {
+		return nil
+	}
+	server.logger.Infof("server: disconnecting client %d from %s: rate limited too often",
+		c.id, c.sess.conn.RemoteAddr())
+	c.sess.hangup()
+	return ErrRateLimited
+}
+
+// argDecoders decode the arguments of the built-in msgs carrying some
+var argDecoders = map[string]func() protocol.Unmarshaler{
+	protocol.SendMsg:      func() protocol.Unmarshaler { return &protocol.Send{} },
+	protocol.HelloMsg:     func() protocol.Unmarshaler { return &protocol.Hello{} },
+	protocol.DeliveredMsg: func() protocol.Unmarshaler { return &protocol.Delivered{} },
+	protocol.ResumeMsg:    func() protocol.Unmarshaler { return &protocol.Resume{} },
+	protocol.LoginMsg:     func() protocol.Unmarshaler { return &protocol.Login{} },
+	protocol.AuthMsg:      func() protocol.Unmarshaler { return &protocol.Auth{} },
+	protocol.JoinMsg:      func() protocol.Unmarshaler { return &protocol.Join{} },
+	protocol.PartMsg:      func() protocol.Unmarshaler { return &protocol.Part{} },
+}
+
+// skipArgs reads the arguments of a msg which is not handled. The number
+// of arguments of commands registered with HandleFunc is unknown in the
+// line protocol, their clients are disconnected.
+func (server *Server) skipArgs(c *Context) {
+	if c.frame != nil {
+		return
+	}
+	if decoder, ok := argDecoders[c.msg]; ok {
+		c.Decode(decoder())
+		return
+	}
+	if _, ok := server.Handler(c.msg); ok {
+		switch c.msg {
+		case protocol.IdentityMsg, protocol.ListMsg, protocol.RoomsMsg, protocol.PingMsg:
+		default:
+			c.sess.hangup()
+		}
+	}
+}
+
+// countingReader counts the bytes read from the connection of a session
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	*r.n += int64(n)
+	return n, err
+}
+
+// RateLimitedMessages returns the number of msgs answered with a RATE
+// LIMITED error
+func (server *Server) RateLimitedMessages() uint64 {
+	return atomic.LoadUint64(&server.limited)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBucket_Allow(t *testing.T) {
+	var b bucket
+	now := time.Now()
+	assert.True(t, b.allow(now, 1, 2, time.Second))
+	assert.True(t, b.allow(now, 5, 2, time.Second))
+	// in debt until 4 tokens are refilled
+	assert.False(t, b.allow(now.Add(time.Second), 1, 2, time.Second))
+	assert.True(t, b.allow(now.Add(2*time.Second), 1, 2, time.Second))
+
+	assert.True(t, b.allow(now, 1000, 0, time.Second))
+	assert.False(t, b.charge(now, 1000, 0, time.Second))
+}
+
+func TestServer_RateLimits(t *testing.T) {
+	const limitsTestAddr = "localhost:50030"
+	server := New(
+		WithLimits(RateLimits{Commands: 3, Recipients: 2, Strikes: 2}),
+		WithUserLimits("bot", RateLimits{Commands: 100}),
+	)
+	tcpAddr, err := net.ResolveTCPAddr("tcp", limitsTestAddr)
+	assert.NoError(t, err)
+	go server.Start(tcpAddr)
+	defer server.Stop()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		conn, err = net.Dial("tcp", limitsTestAddr)
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	read := func() string {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := r.ReadString('\n')
+		assert.NoError(t, err)
+		return line
+	}
+
+	// the first msg may exceed the limit, the next one has to wait
+	_, err = conn.Write([]byte("SEND\n1,2,3\nHi\nSEND\n1\nHi\nPING\nPING\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "DONE\n", read())
+	assert.Equal(t, "ERR RATE LIMITED\n", read())
+	assert.Equal(t, "PONG\n", read())
+	assert.Equal(t, "PONG\n", read())
+
+	// the arguments of rejected msgs are skipped, one strike too many
+	// disconnects the client
+	_, err = conn.Write([]byte("SEND\n1\nHi\nPING\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ERR RATE LIMITED\n", read())
+	assert.Equal(t, "ERR RATE LIMITED\n", read())
+	_, err = r.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, uint64(3), server.RateLimitedMessages())
+
+	// users may have limits of their own
+	bot, err := net.Dial("tcp", limitsTestAddr)
+	assert.NoError(t, err)
+	defer bot.Close()
+	conn, r = bot, bufio.NewReader(bot)
+	_, err = bot.Write([]byte("LOGIN\nbot\n"))
+	assert.NoError(t, err)
+	assert.Contains(t, read(), " bot\n")
+	time.Sleep(time.Second)
+	_, err = bot.Write([]byte("PING\nPING\nPING\nPING\nPING\n"))
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "PONG\n", read())
+	}
+}
+
+func TestServer_RateLimitsWithMiddleware(t *testing.T) {
+	server := New(WithLimits(RateLimits{Commands: 2}))
+	var handled int32
+	server.Use(func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			atomic.AddInt32(&handled, 1)
+			return next(c)
+		}
+	}, RateLimit(1000, 1))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	read := func() string {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := r.ReadString('\n')
+		assert.NoError(t, err)
+		return line
+	}
+
+	// the limits let 3 msgs through, the middleware only delays them, the
+	// rejected one is never charged by it
+	_, err = conn.Write([]byte("PING\nPING\nPING\nPING\n"))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "PONG\n", read())
+	}
+	assert.Equal(t, "ERR RATE LIMITED\n", read())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&handled))
+	assert.Equal(t, uint64(1), server.RateLimitedMessages())
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metricsContentType is the content type of the Prometheus text format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	// fanoutBuckets are the upper bounds of the SEND recipient counts
+	fanoutBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+	// latencyBuckets are the upper bounds of the handler durations in
+	// seconds
+	latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+)
+
+// Errors counted by metrics
+const (
+	errorRead        = "read"
+	errorWrite       = "write"
+	errorIdleTimeout = "idle_timeout"
+	errorHandler     = "handler"
+)
+
+// metrics collects the numbers exposed by MetricsHandler, they are
+// collected whether or not anyone scrapes them. Msgs received are counted
+// by command, msgs sent by type once written.
+type metrics struct {
+	received      *counterVec
+	receivedBytes *counterVec
+	sent          [256]uint64
+	sentBytes     [256]uint64
+	errors        *counterVec
+
+	fanout *histogram
+	// latency is fed by the middleware wrapping every handler
+	latency *LatencyMetrics
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		received:      newCounterVec(),
+		receivedBytes: newCounterVec(),
+		errors:        newCounterVec(),
+		fanout:        newHistogram(fanoutBuckets),
+		latency:       NewLatencyMetrics(),
+	}
+}
+
+// observeMessage records a msg of the client named name which took bytes
+// of the connection
+func (m *metrics) observeMessage(name string, bytes int64) {
+	m.received.add(name, 1)
+	m.receivedBytes.add(name, uint64(bytes))
+}
+
+// written counts a msg of type t written to a client in n bytes
+func (m *metrics) written(t protocol.Type, n int) {
+	atomic.AddUint64(&m.sent[t], 1)
+	atomic.AddUint64(&m.sentBytes[t], uint64(n))
+}
+
+// counterVec is a set of counters told apart by a label
+type counterVec struct {
+	mu     *sync.RWMutex
+	values map[string]*uint64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{
+		mu:     &sync.RWMutex{},
+		values: make(map[string]*uint64),
+	}
+}
+
+func (v *counterVec) add(label string, n uint64) {
+	v.mu.RLock()
+	p, ok := v.values[label]
+	v.mu.RUnlock()
+	if !ok {
+		v.mu.Lock()
+		if p, ok = v.values[label]; !ok {
+			p = new(uint64)
+			v.values[label] = p
+		}
+		v.mu.Unlock()
+	}
+	atomic.AddUint64(p, n)
+}
+
+// snapshot returns the counters by label
+func (v *counterVec) snapshot() map[string]uint64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	values := make(map[string]uint64, len(v.values))
+	for label, p := range v.values {
+		values[label] = atomic.LoadUint64(p)
+	}
+	return values
+}
+
+// histogram counts observations in buckets with the given upper bounds
+type histogram struct {
+	mu     *sync.Mutex
+	bounds []float64
+	// counts holds the observations of each bucket and, last, of the ones
+	// above all bounds
+	counts []uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		mu:     &sync.Mutex{},
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// snapshot returns the cumulative bucket counts and the sum of the
+// observations, the last count is the total
+func (h *histogram) snapshot() ([]uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make([]uint64, len(h.counts))
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		counts[i] = n
+	}
+	return counts, h.sum
+}
+
+// commandName returns the label of the msgs named msg, msgs without a
+// handler are all counted as unknown
+func (server *Server) commandName(msg string) string {
+	if _, ok := server.Handler(msg); ok {
+		return msg
+	}
+	return protocol.UnknownMsg
+}
+
+// MetricsHandler returns a handler serving the metrics of the server in
+// the Prometheus text format
+func (server *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		bw := bufio.NewWriter(w)
+		server.WriteMetrics(bw)
+		bw.Flush()
+	})
+}
+
+// ServeMetrics serves MetricsHandler on /metrics over HTTP to the
+// connections of l until the server is shut down. It returns
+// ErrServerClosed once the server was shut down.
+func (server *Server) ServeMetrics(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", server.MetricsHandler())
+	hs := &http.Server{Handler: mux}
+
+	server.sl.Lock()
+	if server.closing() {
+		server.sl.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	server.metricsServers = append(server.metricsServers, hs)
+	server.sl.Unlock()
+
+	server.logger.Infof("Serving metrics on http://%s/metrics", l.Addr())
+	err := hs.Serve(l)
+	if err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// shutdownMetrics stops the metrics servers started by ServeMetrics, the
+// scrapes in progress finish unless ctx expires first
+func (server *Server) shutdownMetrics(ctx context.Context) {
+	server.sl.Lock()
+	servers := server.metricsServers
+	server.metricsServers = nil
+	server.sl.Unlock()
+	for _, hs := range servers {
+		if err := hs.Shutdown(ctx); err != nil {
+			hs.Close()
+		}
+	}
+}
+
+// WriteMetrics writes the metrics of the server to w in the Prometheus
+// text format
+func (server *Server) WriteMetrics(w io.Writer) error {
+	m := server.metrics
+	e := &metricsWriter{w: w}
+
+	server.sl.Lock()
+	conns := server.conns
+	var queued, maxQueued int
+	for sess := range server.sessions {
+		n := sess.out.len()
+		queued += n
+		if n > maxQueued {
+			maxQueued = n
+		}
+	}
+	server.sl.Unlock()
+
+	e.header("tcpchat_connected_clients", "gauge", "Clients reachable by other clients.")
+	e.sample("tcpchat_connected_clients", "", float64(server.clients.len()))
+	e.header("tcpchat_open_connections", "gauge", "Connections served, authenticated or not.")
+	e.sample("tcpchat_open_connections", "", float64(conns))
+
+	stats := server.ConnectionStats()
+	e.header("tcpchat_connections_accepted_total", "counter", "Connections accepted.")
+	e.sample("tcpchat_connections_accepted_total", "", float64(stats.Accepted))
+	e.header("tcpchat_connections_rejected_total", "counter", "Connections refused by reason.")
+	e.counters("tcpchat_connections_rejected_total", "reason", map[string]uint64{
+		"server_full":      stats.Full,
+		"too_many_from_ip": stats.TooManyFromIP,
+		"address_denied":   stats.Denied,
+	})
+
+	e.header("tcpchat_messages_received_total", "counter", "Messages received by command.")
+	e.counters("tcpchat_messages_received_total", "command", m.received.snapshot())
+	e.header("tcpchat_received_bytes_total", "counter", "Bytes received by command.")
+	e.counters("tcpchat_received_bytes_total", "command", m.receivedBytes.snapshot())
+
+	sent := make(map[string]uint64)
+	sentBytes := make(map[string]uint64)
+	for t := range m.sent {
+		// room msgs and lists share the name of their direct siblings
+		if n := atomic.LoadUint64(&m.sent[t]); n > 0 {
+			sent[protocol.Type(t).String()] += n
+			sentBytes[protocol.Type(t).String()] += atomic.LoadUint64(&m.sentBytes[t])
+		}
+	}
+	e.header("tcpchat_messages_sent_total", "counter", "Messages written to clients by command.")
+	e.counters("tcpchat_messages_sent_total", "command", sent)
+	e.header("tcpchat_sent_bytes_total", "counter", "Bytes written to clients by command.")
+	e.counters("tcpchat_sent_bytes_total", "command", sentBytes)
+
+	e.header("tcpchat_send_fanout_size", "histogram", "Recipients of SEND messages.")
+	e.histogram("tcpchat_send_fanout_size", "", m.fanout)
+	e.header("tcpchat_handler_duration_seconds", "histogram", "Time taken to handle messages by command.")
+	latency := m.latency.histograms()
+	commands := make([]string, 0, len(latency))
+	for command := range latency {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		e.histogram("tcpchat_handler_duration_seconds", command, latency[command])
+	}
+
+	e.header("tcpchat_write_queue_depth", "gauge", "Messages queued for all clients.")
+	e.sample("tcpchat_write_queue_depth", "", float64(queued))
+	e.header("tcpchat_write_queue_max_depth", "gauge", "Messages queued for the client with the longest queue.")
+	e.sample("tcpchat_write_queue_max_depth", "", float64(maxQueued))
+
+	errs := m.errors.snapshot()
+	errs["queue_overflow"] = server.DroppedMessages()
+	errs["rate_limited"] = server.RateLimitedMessages()
+	e.header("tcpchat_errors_total", "counter", "Errors by type.")
+	e.counters("tcpchat_errors_total", "type", errs)
+	return e.err
+}
+
+// metricsWriter writes metrics in the Prometheus text format, it keeps the
+// first error and writes nothing after it
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (e *metricsWriter) printf(format string, args ...interface{}) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = fmt.Fprintf(e.w, format, args...)
+}
+
+func (e *metricsWriter) header(name, typ, help string) {
+	e.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a single value, labels are already formatted
+func (e *metricsWriter) sample(name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	e.printf("%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (e *metricsWriter) counters(name, label string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e.sample(name, formatLabel(label, k), float64(values[k]))
+	}
+}
+
+// histogram writes h, command is the command label of histograms by
+// command
+func (e *metricsWriter) histogram(name, command string, h *histogram) {
+	labels := ""
+	if command != "" {
+		labels = formatLabel("command", command) + ","
+	}
+	counts, sum := h.snapshot()
+	for i, bound := range h.bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		e.sample(name+"_bucket", labels+formatLabel("le", le), float64(counts[i]))
+	}
+	total := counts[len(counts)-1]
+	e.sample(name+"_bucket", labels+formatLabel("le", "+Inf"), float64(total))
+	labels = strings.TrimSuffix(labels, ",")
+	e.sample(name+"_sum", labels, sum)
+	e.sample(name+"_count", labels, float64(total))
+}
+
+func formatLabel(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"testing"
+)
+
+func TestMetricsWriter_Histogram(t *testing.T) {
+	h := newHistogram([]float64{1, 5})
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		h.observe(v)
+	}
+
+	var b bytes.Buffer
+	e := &metricsWriter{w: &b}
+	e.histogram("size", "", h)
+	e.histogram("took", `SAY "HI"`, h)
+	assert.NoError(t, e.err)
+	assert.Equal(t, `size_bucket{le="1"} 2
+size_bucket{le="5"} 3
+size_bucket{le="+Inf"} 4
+size_sum 14.5
+size_count 4
+took_bucket{command="SAY \"HI\"",le="1"} 2
+took_bucket{command="SAY \"HI\"",le="5"} 3
+took_bucket{command="SAY \"HI\"",le="+Inf"} 4
+took_sum{command="SAY \"HI\""} 14.5
+took_count{command="SAY \"HI\""} 4
+`, b.String())
+}
+
+func TestMetricsWriter_Counters(t *testing.T) {
+	v := newCounterVec()
+	v.add("b", 2)
+	v.add("a", 1)
+	v.add("b", 3)
+
+	var b bytes.Buffer
+	e := &metricsWriter{w: &b}
+	e.header("msgs_total", "counter", "Msgs.")
+	e.counters("msgs_total", "command", v.snapshot())
+	assert.Equal(t, `# HELP msgs_total Msgs.
+# TYPE msgs_total counter
+msgs_total{command="a"} 1
+msgs_total{command="b"} 5
+`, b.String())
+}
+
+func TestServer_WriteMetrics(t *testing.T) {
+	server := New()
+	server.metrics.written(protocol.TypeIncoming, 10)
+	server.metrics.written(protocol.TypeRoomIncoming, 5)
+
+	var b bytes.Buffer
+	assert.NoError(t, server.WriteMetrics(&b))
+	assert.Contains(t, b.String(), "tcpchat_messages_sent_total{command=\"INCOMING\"} 2\n")
+	assert.Contains(t, b.String(), "tcpchat_sent_bytes_total{command=\"INCOMING\"} 15\n")
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a handler to add behaviour shared by many msgs, like
+// logging or access checks. It may handle the msg itself instead of
+// calling the handler, but must read its arguments or close the connection
+// then.
+type Middleware func(HandlerFunc) HandlerFunc
+
+// chain wraps h in middleware, the first middleware is the outermost
+func chain(h HandlerFunc, middleware []Middleware) HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Use adds middleware wrapping the handlers of all msgs, including unknown
+// ones. Middleware added first runs first, the middleware given to
+// HandleFunc runs after all of them.
+func (server *Server) Use(middleware ...Middleware) {
+	server.hl.Lock()
+	defer server.hl.Unlock()
+	server.middleware = append(server.middleware, middleware...)
+	server.chain = server.metrics.latency.Middleware()(chain(route, server.middleware))
+}
+
+// route calls the handler HandleMessage found for the msg
+func route(c *Context) error {
+	return c.handler(c)
+}
+
+// Logging logs every handled msg with the time it took at info level
+func Logging() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.server.logger.Infof("server: client %d: %s failed after %s: %s", c.id, c.name, time.Since(start), err)
+				return err
+			}
+			c.server.logger.Infof("server: client %d: %s handled in %s", c.id, c.name, time.Since(start))
+			return nil
+		}
+	}
+}
+
+// Recover turns panics of handlers into an INTERNAL ERROR response, the
+// connection is closed since the arguments of the msg may be left unread
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) (err error) {
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				c.server.logger.Errorf("server: handling %s of client %d panicked: %v\n%s", c.name, c.id, p, debug.Stack())
+				c.ReplyError(protocol.NewError(protocol.CodeInternal))
+				c.sess.hangup()
+				err = fmt.Errorf("server: handler panicked: %v", p)
+			}()
+			return next(c)
+		}
+	}
+}
+
+// RequireAuth rejects the msgs of clients which did not authenticate yet
+// but the named ones, the connection is closed since the arguments of the
+// msg are left unread. The server uses it with HELLO, AUTH and PING once
+// Config.Auth is set.
+func RequireAuth(except ...string) Middleware {
+	allowed := make(map[string]bool, len(except))
+	for _, name := range except {
+		allowed[name] = true
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if c.sess.authed || allowed[c.name] {
+				return next(c)
+			}
+			c.server.logger.Debugf(receiveLogTpl, c.msg)
+			err := c.ReplyError(protocol.NewError(protocol.CodeAuthRequired))
+			if err != nil {
+				return err
+			}
+			c.sess.hangup()
+			return ErrAuthFailed
+		}
+	}
+}
+
+// bucket is a token bucket refilling rate tokens per second up to burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes n tokens and returns how long to wait until they are
+// available, the bucket goes into debt meanwhile
+func (b *bucket) take(now time.Time, n, rate float64, burst int) time.Duration {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// rateLimit is the key of the buckets of RateLimit in the sessions
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+// RateLimit throttles every client to rate msgs per second, allowing
+// bursts of up to burst msgs. Msgs over the limit are handled late rather
+// than rejected, so a flooding client stops being read and TCP slows it
+// down. A rate of zero or less does not limit anything. Msgs rejected by
+// the RateLimits of the server never reach the middleware, so they do not
+// count against rate.
+func RateLimit(rate float64, burst int) Middleware {
+	if rate <= 0 {
+		return func(next HandlerFunc) HandlerFunc { return next }
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	key := &rateLimit{rate: rate, burst: burst}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			b, ok := c.sess.values[key].(*bucket)
+			if !ok {
+				b = &bucket{}
+				c.sess.values[key] = b
+			}
+			if wait := b.take(time.Now(), 1, key.rate, key.burst); wait > 0 {
+				t := time.NewTimer(wait)
+				select {
+				case <-t.C:
+				case <-c.server.quit:
+					t.Stop()
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// CommandStats are the latency metrics of a single msg name
+type CommandStats struct {
+	Count  uint64
+	Errors uint64
+	Total  time.Duration
+	Max    time.Duration
+}
+
+// Mean returns the mean time it took to handle a msg
+func (s CommandStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// LatencyMetrics records how many msgs of every name were handled and how
+// long that took, unknown msgs are recorded as protocol.UnknownMsg. Every
+// server records its own for the handler durations of MetricsHandler.
+type LatencyMetrics struct {
+	mu        *sync.Mutex
+	stats     map[string]*CommandStats
+	durations map[string]*histogram
+}
+
+// NewLatencyMetrics creates and returns new empty LatencyMetrics
+func NewLatencyMetrics() *LatencyMetrics {
+	return &LatencyMetrics{
+		mu:        &sync.Mutex{},
+		stats:     make(map[string]*CommandStats),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// Middleware returns the middleware recording the metrics
+func (m *LatencyMetrics) Middleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			start := time.Now()
+			err := next(c)
+			m.record(c.name, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+func (m *LatencyMetrics) record(name string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.stats[name]
+	if !ok {
+		s = &CommandStats{}
+		m.stats[name] = s
+		m.durations[name] = newHistogram(latencyBuckets)
+	}
+	m.durations[name].observe(d.Seconds())
+	s.Count++
+	if err != nil {
+		s.Errors++
+	}
+	s.Total += d
+	if d > s.Max {
+		s.Max = d
+	}
+}
+
+// Stats returns a copy of the metrics by msg name
+func (m *LatencyMetrics) Stats() map[string]CommandStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[string]CommandStats, len(m.stats))
+	for name, s := range m.stats {
+		stats[name] = *s
+	}
+	return stats
+}
+
+// histograms returns the histograms of the durations by msg name, seconds
+// are observed
+func (m *LatencyMetrics) histograms() map[string]*histogram {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	histograms := make(map[string]*histogram, len(m.durations))
+	for name, h := range m.durations {
+		histograms[name] = h
+	}
+	return histograms
+}
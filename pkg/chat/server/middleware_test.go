@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestContext returns the context of a msg read from a connection of
+// server nobody is reading from
+func newTestContext(server *Server) *Context {
+	conn, _ := net.Pipe()
+	sess := newSession(1, conn, newQueue(8, DropOldest))
+	sess.authed = true
+	return &Context{id: 1, sess: sess, server: server}
+}
+
+// responses returns the responses queued for the session of c
+func responses(c *Context) []string {
+	c.sess.out.drain()
+	var rr []string
+	for {
+		items, ok := c.sess.out.take(nil)
+		if !ok {
+			return rr
+		}
+		for _, item := range items {
+			rr = append(rr, string(item.b))
+			item.release()
+		}
+	}
+}
+
+func TestServer_Use(t *testing.T) {
+	server := New()
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Context) error {
+				calls = append(calls, name+" "+c.name)
+				return next(c)
+			}
+		}
+	}
+	server.Use(record("first"), record("second"))
+	server.HandleFunc("X", func(c *Context) error {
+		calls = append(calls, "handler")
+		return nil
+	}, record("own"))
+
+	assert.NoError(t, server.HandleMessage("X", newTestContext(server)))
+	assert.Equal(t, []string{"first X", "second X", "own X", "handler"}, calls)
+
+	calls = nil
+	c := newTestContext(server)
+	assert.NoError(t, server.HandleMessage("POOFF", c))
+	assert.Equal(t, []string{"first UNKNOWN MESSAGE", "second UNKNOWN MESSAGE"}, calls)
+	assert.Equal(t, []string{"UNKNOWN MESSAGE\n"}, responses(c))
+}
+
+func TestRecover(t *testing.T) {
+	server := New()
+	server.Use(Recover())
+	server.HandleFunc("X", func(c *Context) error {
+		panic("boom")
+	})
+
+	c := newTestContext(server)
+	assert.Error(t, server.HandleMessage("X", c))
+	assert.Equal(t, []string{"ERR INTERNAL ERROR\n"}, responses(c))
+}
+
+func TestRequireAuth(t *testing.T) {
+	server := New()
+	server.Use(RequireAuth(protocol.PingMsg))
+
+	c := newTestContext(server)
+	c.sess.authed = false
+	assert.NoError(t, server.HandleMessage(protocol.PingMsg, c))
+	assert.Equal(t, ErrAuthFailed, server.HandleMessage(protocol.ListMsg, c))
+	assert.Equal(t, []string{"PONG\n", "ERR AUTH REQUIRED\n"}, responses(c))
+
+	c = newTestContext(server)
+	assert.NoError(t, server.HandleMessage(protocol.PingMsg, c))
+	assert.NoError(t, server.HandleMessage(protocol.IdentityMsg, c))
+}
+
+func TestRateLimit(t *testing.T) {
+	server := New()
+	server.Use(RateLimit(50, 2))
+	c := newTestContext(server)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, server.HandleMessage(protocol.PingMsg, c))
+	}
+	assert.True(t, time.Since(start) < 20*time.Millisecond)
+	// 2 more msgs take 20ms each
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, server.HandleMessage(protocol.PingMsg, c))
+	}
+	assert.True(t, time.Since(start) >= 35*time.Millisecond)
+
+	// other clients have their own budget
+	start = time.Now()
+	assert.NoError(t, server.HandleMessage(protocol.PingMsg, newTestContext(server)))
+	assert.True(t, time.Since(start) < 20*time.Millisecond)
+}
+
+func TestLatencyMetrics(t *testing.T) {
+	server := New()
+	metrics := NewLatencyMetrics()
+	server.Use(metrics.Middleware())
+	failure := errors.New("failure")
+	server.HandleFunc("FAIL", func(c *Context) error {
+		time.Sleep(5 * time.Millisecond)
+		return failure
+	})
+
+	c := newTestContext(server)
+	assert.NoError(t, server.HandleMessage(protocol.PingMsg, c))
+	assert.NoError(t, server.HandleMessage(protocol.PingMsg, c))
+	assert.Equal(t, failure, server.HandleMessage("FAIL", c))
+	assert.NoError(t, server.HandleMessage("POOFF", c))
+
+	stats := metrics.Stats()
+	assert.Len(t, stats, 3)
+	assert.Equal(t, uint64(2), stats[protocol.PingMsg].Count)
+	assert.Equal(t, uint64(1), stats["FAIL"].Errors)
+	assert.True(t, stats["FAIL"].Max >= 5*time.Millisecond)
+	assert.True(t, stats["FAIL"].Mean() >= 5*time.Millisecond)
+	assert.Equal(t, uint64(1), stats[protocol.UnknownMsg].Count)
+
+	// the server records its own for MetricsHandler, the histograms count
+	// the same msgs
+	durations := server.metrics.latency.histograms()
+	assert.Len(t, durations, 3)
+	for name, s := range server.metrics.latency.Stats() {
+		assert.Equal(t, stats[name].Count, s.Count)
+		counts, sum := durations[name].snapshot()
+		assert.Equal(t, s.Count, counts[len(counts)-1])
+		assert.InDelta(t, s.Total.Seconds(), sum, 1e-6)
+	}
+}
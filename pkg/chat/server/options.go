@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+)
+
+// Option configures a server created by New
+type Option func(*Config)
+
+// WithDebug makes the server log at debug level
+func WithDebug() Option {
+	return func(c *Config) {
+		c.Debug = true
+	}
+}
+
+// WithQueue sets the number of outbound messages buffered for each client
+// and what happens to messages sent to a client whose queue is full
+func WithQueue(size int, overflow OverflowPolicy) Option {
+	return func(c *Config) {
+		c.QueueSize = size
+		c.Overflow = overflow
+	}
+}
+
+// WithStore sets the store keeping the messages sent to offline clients
+func WithStore(store MessageStore) Option {
+	return func(c *Config) {
+		c.Store = store
+	}
+}
+
+// WithUsers sets the store keeping the user accounts
+func WithUsers(users UserStore) Option {
+	return func(c *Config) {
+		c.Users = users
+	}
+}
+
+// WithAuth makes clients authenticate with auth before anything but
+// HELLO and PING is handled
+func WithAuth(auth Authenticator) Option {
+	return func(c *Config) {
+		c.Auth = auth
+	}
+}
+
+// WithTLS makes the server accept TLS connections only, certUser maps
+// verified client certificates to users and may be nil
+func WithTLS(config *tls.Config, certUser func(*x509.Certificate) string) Option {
+	return func(c *Config) {
+		c.TLS = config
+		c.CertUser = certUser
+	}
+}
+
+// WithIdleTimeout drops connections silent for longer than timeout
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.IdleTimeout = timeout
+	}
+}
+
+// WithLimits sets the rate limits of every client
+func WithLimits(limits RateLimits) Option {
+	return func(c *Config) {
+		c.Limits = limits
+	}
+}
+
+// WithUserLimits sets the rate limits of the user logged in as name, they
+// replace the limits of every client
+func WithUserLimits(name string, limits RateLimits) Option {
+	return func(c *Config) {
+		if c.UserLimits == nil {
+			c.UserLimits = make(map[string]RateLimits)
+		}
+		c.UserLimits[name] = limits
+	}
+}
+
+// WithMaxConns limits the number of connections served at once to total
+// and the ones from a single address to perIP, zero does not limit them
+func WithMaxConns(total, perIP int) Option {
+	return func(c *Config) {
+		c.MaxConns = total
+		c.MaxConnsPerIP = perIP
+	}
+}
+
+// WithAllow accepts connections from the given networks only
+func WithAllow(nets ...*net.IPNet) Option {
+	return func(c *Config) {
+		c.Allow = append(c.Allow, nets...)
+	}
+}
+
+// WithDeny refuses connections from the given networks
+func WithDeny(nets ...*net.IPNet) Option {
+	return func(c *Config) {
+		c.Deny = append(c.Deny, nets...)
+	}
+}
+
+// WithMiddleware wraps the handlers of all msgs in middleware
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(c *Config) {
+		c.Middleware = append(c.Middleware, middleware...)
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNew_Options(t *testing.T) {
+	store := NewMemoryStore()
+	server := New(
+		WithDebug(),
+		WithQueue(8, DropOldest),
+		WithStore(store),
+		WithIdleTimeout(time.Minute),
+		WithMiddleware(Logging()),
+		WithMiddleware(Recover()),
+	)
+
+	assert.True(t, server.debug)
+	assert.Equal(t, 8, server.config.QueueSize)
+	assert.Equal(t, DropOldest, server.config.Overflow)
+	assert.Equal(t, store, server.store)
+	assert.Equal(t, time.Minute, server.config.IdleTimeout)
+	assert.Len(t, server.config.Middleware, 2)
+	assert.Len(t, server.middleware, 2)
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DefaultQueueSize is the number of outbound messages buffered for each
+// client when Config.QueueSize is not set
+const DefaultQueueSize = 256
+
+// maxBatch is the number of messages taken by the writer at once, at up to
+// three buffers each they stay below the 1024 buffers a single writev
+// writes on Linux
+const maxBatch = 256
+
+// OverflowPolicy decides what happens to a message for a client whose
+// outbound queue is full
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room
+	DropOldest OverflowPolicy = iota
+	// DropNew discards the message being queued
+	DropNew
+	// Disconnect closes the connection of the slow client
+	Disconnect
+)
+
+var overflowPolicies = map[OverflowPolicy]string{
+	DropOldest: "drop-oldest",
+	DropNew:    "drop-new",
+	Disconnect: "disconnect",
+}
+
+// String returns the name of the policy
+func (p OverflowPolicy) String() string {
+	if name, ok := overflowPolicies[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// ParseOverflowPolicy returns the policy with the given name
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for p, n := range overflowPolicies {
+		if n == strings.ToLower(name) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("server: unknown overflow policy %q", name)
+}
+
+var (
+	errQueueClosed   = errors.New("server: outbound queue closed")
+	errQueueFull     = errors.New("server: outbound queue full")
+	errQueueOverflow = errors.New("server: outbound queue overflow")
+)
+
+type outbound struct {
+	b []byte
+	// typ is the type of the message, it is counted once written
+	typ protocol.Type
+	// shared messages are written as the encoding vec of their fanout and
+	// release it once written or dropped
+	vec    [][]byte
+	shared *fanout
+	// droppable messages are subject to the overflow policy, responses
+	// never are
+	droppable bool
+}
+
+// size returns the number of bytes of the message
+func (o outbound) size() int {
+	if o.shared != nil {
+		n := 0
+		for _, b := range o.vec {
+			n += len(b)
+		}
+		return n
+	}
+	return len(o.b)
+}
+
+// appendTo appends the buffers to write for the message to bufs
+func (o outbound) appendTo(bufs net.Buffers) net.Buffers {
+	if o.shared != nil {
+		return append(bufs, o.vec...)
+	}
+	return append(bufs, o.b)
+}
+
+func (o outbound) release() {
+	if o.shared != nil {
+		o.shared.release()
+	}
+}
+
+// queue is a bounded outbound message queue drained by the writer
+// goroutine of a session
+type queue struct {
+	mu     *sync.Mutex
+	cond   *sync.Cond
+	items  []outbound
+	size   int
+	policy OverflowPolicy
+	closed bool
+	// draining queues accept nothing new, take keeps returning what is
+	// already queued
+	draining bool
+}
+
+func newQueue(size int, policy OverflowPolicy) *queue {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	mu := &sync.Mutex{}
+	return &queue{
+		mu:     mu,
+		cond:   sync.NewCond(mu),
+		size:   size,
+		policy: policy,
+	}
+}
+
+// pushItem queues a response, waiting for room while the queue is full
+func (q *queue) pushItem(item outbound) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) >= q.size && !q.closed && !q.draining {
+		q.cond.Wait()
+	}
+	if q.closed || q.draining {
+		return errQueueClosed
+	}
+	q.items = append(q.items, item)
+	q.cond.Broadcast()
+	return nil
+}
+
+// pushAll queues responses without waiting for room, the queue may grow
+// beyond its size until they are written
+func (q *queue) pushAll(items []outbound) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.draining {
+		return errQueueClosed
+	}
+	q.items = append(q.items, items...)
+	q.cond.Broadcast()
+	return nil
+}
+
+// offerShared queues the encoding vec of the fanout f like offerItem, the
+// queue takes over the reference of the caller to f
+func (q *queue) offerShared(vec [][]byte, f *fanout) (bool, error) {
+	return q.offerItem(outbound{vec: vec, typ: f.m.Type(), shared: f, droppable: true})
+}
+
+// offerItem queues a message without ever waiting, when the queue is full
+// the overflow policy applies. It reports whether an older message was
+// dropped to make room, errQueueFull when the message itself was dropped
+// and errQueueOverflow when the client must be disconnected. Dropped
+// messages are released.
+func (q *queue) offerItem(item outbound) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.draining {
+		item.release()
+		return false, errQueueClosed
+	}
+
+	if len(q.items) < q.size {
+		q.items = append(q.items, item)
+		q.cond.Broadcast()
+		return false, nil
+	}
+
+	switch q.policy {
+	case DropOldest:
+		for i, old := range q.items {
+			if old.droppable {
+				old.release()
+				q.items = append(q.items[:i], q.items[i+1:]...)
+				q.items = append(q.items, item)
+				return true, nil
+			}
+		}
+		// nothing but responses queued, the new message is the oldest
+		// droppable one
+		item.release()
+		return false, errQueueFull
+	case Disconnect:
+		item.release()
+		return false, errQueueOverflow
+	default:
+		item.release()
+		return false, errQueueFull
+	}
+}
+
+// take waits for messages and moves up to maxBatch of the queued ones to
+// dst, oldest first. It returns false once the queue is closed or has been
+// drained. The caller releases the messages once written.
+func (q *queue) take(dst []outbound) ([]outbound, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.closed && !q.draining {
+		q.cond.Wait()
+	}
+	if q.closed || len(q.items) == 0 {
+		return dst, false
+	}
+	n := len(q.items)
+	if n > maxBatch {
+		n = maxBatch
+	}
+	dst = append(dst, q.items[:n]...)
+	rest := copy(q.items, q.items[n:])
+	for i := rest; i < len(q.items); i++ {
+		q.items[i] = outbound{}
+	}
+	q.items = q.items[:rest]
+	q.cond.Broadcast()
+	return dst, true
+}
+
+// len returns the number of queued messages
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// drain stops q from accepting messages, take returns false once the
+// queued ones are gone
+func (q *queue) drain() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.draining = true
+	q.cond.Broadcast()
+}
+
+// close discards the queued messages and wakes up everyone waiting on q
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	for _, item := range q.items {
+		item.release()
+	}
+	q.items = nil
+	q.cond.Broadcast()
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// response and message return queue items as queued by the sessions
+func response(b string) outbound {
+	return outbound{b: []byte(b)}
+}
+
+func message(b string) outbound {
+	return outbound{b: []byte(b), droppable: true}
+}
+
+// takeAll takes the queued messages batch by batch and releases them
+func takeAll(q *queue) []string {
+	var items []string
+	for q.len() > 0 {
+		batch, _ := q.take(nil)
+		for _, item := range batch {
+			items = append(items, string(bytes.Join(item.appendTo(nil), nil)))
+			item.release()
+		}
+	}
+	return items
+}
+
+func TestQueue_Offer(t *testing.T) {
+	tt := []struct {
+		policy  OverflowPolicy
+		dropped bool
+		err     error
+		want    []string
+	}{
+		{policy: DropOldest, dropped: true, err: nil, want: []string{"2", "3"}},
+		{policy: DropNew, dropped: false, err: errQueueFull, want: []string{"1", "2"}},
+		{policy: Disconnect, dropped: false, err: errQueueOverflow, want: []string{"1", "2"}},
+	}
+
+	for _, tc := range tt {
+		q := newQueue(2, tc.policy)
+		for _, b := range []string{"1", "2"} {
+			dropped, err := q.offerItem(message(b))
+			assert.False(t, dropped)
+			assert.NoError(t, err)
+		}
+		dropped, err := q.offerItem(message("3"))
+		assert.Equal(t, tc.dropped, dropped, tc.policy.String())
+		assert.Equal(t, tc.err, err, tc.policy.String())
+		assert.Equal(t, tc.want, takeAll(q), tc.policy.String())
+	}
+}
+
+func TestQueue_ResponsesAreNeverDropped(t *testing.T) {
+	q := newQueue(2, DropOldest)
+	assert.NoError(t, q.pushItem(response("r1")))
+	assert.NoError(t, q.pushItem(response("r2")))
+
+	dropped, err := q.offerItem(message("m1"))
+	assert.False(t, dropped)
+	assert.Equal(t, errQueueFull, err)
+	assert.Equal(t, []string{"r1", "r2"}, takeAll(q))
+}
+
+func TestQueue_PushWaitsForRoom(t *testing.T) {
+	q := newQueue(1, DropOldest)
+	assert.NoError(t, q.pushItem(response("1")))
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.pushItem(response("2"))
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push did not wait for room")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	items, ok := q.take(nil)
+	assert.True(t, ok)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "1", string(items[0].b))
+	assert.NoError(t, <-pushed)
+}
+
+func TestQueue_TakeWaitsForMessages(t *testing.T) {
+	q := newQueue(2, DropOldest)
+
+	taken := make(chan []outbound)
+	go func() {
+		items, _ := q.take(nil)
+		taken <- items
+	}()
+
+	select {
+	case <-taken:
+		t.Fatal("take did not wait for messages")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	_, err := q.offerItem(message("1"))
+	assert.NoError(t, err)
+	items := <-taken
+	assert.Len(t, items, 1)
+	assert.Equal(t, "1", string(items[0].b))
+}
+
+func TestQueue_TakeBatch(t *testing.T) {
+	q := newQueue(2, DropOldest)
+	// flushed stored msgs may queue more than a batch at once
+	items := make([]outbound, maxBatch+2)
+	for i := range items {
+		items[i] = response(fmt.Sprint(i))
+	}
+	assert.NoError(t, q.pushAll(items))
+
+	batch, ok := q.take(nil)
+	assert.True(t, ok)
+	assert.Len(t, batch, maxBatch)
+	assert.Equal(t, "0", string(batch[0].b))
+	assert.Equal(t, fmt.Sprint(maxBatch-1), string(batch[maxBatch-1].b))
+
+	// dst is appended to
+	batch, ok = q.take(batch[:1])
+	assert.True(t, ok)
+	assert.Len(t, batch, 3)
+	assert.Equal(t, []string{"0", fmt.Sprint(maxBatch), fmt.Sprint(maxBatch + 1)},
+		[]string{string(batch[0].b), string(batch[1].b), string(batch[2].b)})
+	assert.Equal(t, 0, q.len())
+}
+
+func TestQueue_ReleasesShared(t *testing.T) {
+	refs := func(f *fanout) int32 {
+		return atomic.LoadInt32(&f.refs)
+	}
+	f := newFanout(protocol.NewIncoming(1, []byte("Hi")), 1)
+	defer f.release()
+	offer := func(q *queue) (bool, error) {
+		f.retain()
+		return q.offerShared(f.encoding(false, false), f)
+	}
+
+	// evicted by a newer msg
+	q := newQueue(1, DropOldest)
+	_, err := offer(q)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), refs(f))
+	dropped, err := offer(q)
+	assert.True(t, dropped)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), refs(f))
+
+	// written
+	assert.Equal(t, []string{"INCOMING\n1\nHi\n"}, takeAll(q))
+	assert.Equal(t, int32(1), refs(f))
+
+	// rejected by the overflow policy
+	q = newQueue(1, DropNew)
+	assert.NoError(t, q.pushItem(response("r1")))
+	_, err = offer(q)
+	assert.Equal(t, errQueueFull, err)
+	assert.Equal(t, int32(1), refs(f))
+
+	// discarded when closing
+	q = newQueue(2, DropNew)
+	_, err = offer(q)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), refs(f))
+	q.close()
+	assert.Equal(t, int32(1), refs(f))
+	_, err = offer(q)
+	assert.Equal(t, errQueueClosed, err)
+	assert.Equal(t, int32(1), refs(f))
+}
+
+func TestQueue_Close(t *testing.T) {
+	q := newQueue(1, DropOldest)
+	assert.NoError(t, q.pushItem(response("1")))
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.pushItem(response("2"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	q.close()
+	assert.Equal(t, errQueueClosed, <-pushed)
+	_, ok := q.take(nil)
+	assert.False(t, ok)
+	_, err := q.offerItem(message("3"))
+	assert.Equal(t, errQueueClosed, err)
+}
+
+func TestQueue_Drain(t *testing.T) {
+	q := newQueue(2, DropOldest)
+	assert.NoError(t, q.pushItem(response("1")))
+
+	q.drain()
+	assert.Equal(t, errQueueClosed, q.pushItem(response("2")))
+	items, ok := q.take(nil)
+	assert.True(t, ok)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "1", string(items[0].b))
+	_, ok = q.take(nil)
+	assert.False(t, ok)
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, p := range []OverflowPolicy{DropOldest, DropNew, Disconnect} {
+		actual, err := ParseOverflowPolicy(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, actual)
+	}
+
+	_, err := ParseOverflowPolicy("block")
+	assert.Error(t, err)
+}
+
+func TestServer_DeliverToStalledClient(t *testing.T) {
+	tt := []struct {
+		policy OverflowPolicy
+		closed bool
+	}{
+		{policy: DropOldest, closed: false},
+		{policy: DropNew, closed: false},
+		{policy: Disconnect, closed: true},
+	}
+
+	for _, tc := range tt {
+		server := NewWithConfig(Config{QueueSize: 2, Overflow: tc.policy})
+		// nobody reads the other end of the pipe, the writer blocks on the
+		// first message it pops
+		conn, peer := net.Pipe()
+		sess := server.registerClient(conn)
+		go sess.writeLoop()
+
+		delivered := make(chan struct{})
+		go func() {
+			for i := 0; i < 10; i++ {
+				server.deliver(sess, 0, protocol.NewIncoming(1, []byte("Hi")))
+			}
+			close(delivered)
+		}()
+
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: delivering to a stalled client blocked", tc.policy)
+		}
+
+		assert.NotZero(t, server.DroppedMessages(), tc.policy.String())
+		peer.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+		_, err := peer.Write([]byte{0})
+		assert.Equal(t, tc.closed, err == io.ErrClosedPipe, tc.policy.String())
+
+		sess.out.close()
+		conn.Close()
+		peer.Close()
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// registryShards is the number of shards of each registry index
+const (
+	registryShardBits = 6
+	registryShards    = 1 << registryShardBits
+)
+
+// registryHooks are called by the registry while the id shard of the
+// session is locked, so the events of an id are never reordered. Hooks
+// may iterate the registry with each but must not look ids up.
+type registryHooks struct {
+	// registered is called once sess was added, first reports whether it
+	// is the only session of its id
+	registered func(sess *session, first bool)
+	// deregistered is called once sess was removed, last reports whether
+	// its id has no session left
+	deregistered func(sess *session, last bool)
+}
+
+// registry indexes the sessions of the connected clients by connection and
+// by id. A user logged in from several connections has a session for each
+// of them sharing the user id. Both indexes are split into shards with a
+// lock each, so clients connecting and disconnecting only contend with the
+// ones hashed to the same shard.
+type registry struct {
+	ids   [registryShards]*idShard
+	conns [registryShards]*connShard
+	n     int64
+	hooks registryHooks
+}
+
+type idShard struct {
+	mu       *sync.RWMutex
+	sessions map[uint64][]*session
+}
+
+type connShard struct {
+	mu       *sync.RWMutex
+	sessions map[net.Conn]*session
+}
+
+func newRegistry(hooks registryHooks) *registry {
+	r := &registry{hooks: hooks}
+	for i := range r.ids {
+		r.ids[i] = &idShard{
+			mu:       &sync.RWMutex{},
+			sessions: make(map[uint64][]*session),
+		}
+		r.conns[i] = &connShard{
+			mu:       &sync.RWMutex{},
+			sessions: make(map[net.Conn]*session),
+		}
+	}
+	return r
+}
+
+func (r *registry) add(sess *session) {
+	is := r.idShard(sess.id)
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	cs := r.connShard(sess.conn)
+	cs.mu.Lock()
+	cs.sessions[sess.conn] = sess
+	cs.mu.Unlock()
+	atomic.AddInt64(&r.n, 1)
+
+	is.sessions[sess.id] = append(is.sessions[sess.id], sess)
+	if r.hooks.registered != nil {
+		r.hooks.registered(sess, len(is.sessions[sess.id]) == 1)
+	}
+}
+
+// remove forgets the session of conn and returns it
+func (r *registry) remove(conn net.Conn) (*session, bool) {
+	sess, ok := r.session(conn)
+	if !ok {
+		return nil, false
+	}
+	is := r.idShard(sess.id)
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	cs := r.connShard(conn)
+	cs.mu.Lock()
+	_, ok = cs.sessions[conn]
+	delete(cs.sessions, conn)
+	cs.mu.Unlock()
+	if !ok {
+		// removed concurrently
+		return nil, false
+	}
+	atomic.AddInt64(&r.n, -1)
+
+	last := is.unindex(sess)
+	if r.hooks.deregistered != nil {
+		r.hooks.deregistered(sess, last)
+	}
+	return sess, true
+}
+
+// session returns the session of conn
+func (r *registry) session(conn net.Conn) (*session, bool) {
+	cs := r.connShard(conn)
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	sess, ok := cs.sessions[conn]
+	return sess, ok
+}
+
+// lookup returns the sessions of id, the returned slice must not be
+// modified
+func (r *registry) lookup(id uint64) []*session {
+	is := r.idShard(id)
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	return is.sessions[id]
+}
+
+// rebind moves sess to the new id, it reports whether sess was the last
+// session of its old id and whether it is the first one of the new id.
+// Neither hook is called, the caller announces the change itself.
+func (r *registry) rebind(sess *session, id uint64) (left, joined bool) {
+	if _, ok := r.session(sess.conn); !ok {
+		sess.setID(id)
+		return false, false
+	}
+	if sess.id == id {
+		return false, false
+	}
+
+	from, to := r.idShard(sess.id), r.idShard(id)
+	// shards are always locked in the same order
+	first, second := from, to
+	if shardIndex(id) < shardIndex(sess.id) {
+		first, second = to, from
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	if second != first {
+		second.mu.Lock()
+		defer second.mu.Unlock()
+	}
+
+	left = from.unindex(sess)
+	sess.setID(id)
+	to.sessions[id] = append(to.sessions[id], sess)
+	return left, len(to.sessions[id]) == 1
+}
+
+// clientIDs returns the ids of the connected clients, each id is listed
+// once no matter how many sessions it has
+func (r *registry) clientIDs() []uint64 {
+	var ids []uint64
+	for _, is := range r.ids {
+		is.mu.RLock()
+		for id := range is.sessions {
+			ids = append(ids, id)
+		}
+		is.mu.RUnlock()
+	}
+	return ids
+}
+
+// each calls f for every session, shard by shard. f gets a snapshot of the
+// sessions of a shard and runs without holding any lock of the registry,
+// sessions registered meanwhile may be missed.
+func (r *registry) each(f func(*session)) {
+	var snapshot []*session
+	for _, cs := range r.conns {
+		snapshot = cs.snapshot(snapshot[:0])
+		for i, sess := range snapshot {
+			f(sess)
+			snapshot[i] = nil
+		}
+	}
+}
+
+func (r *registry) len() int {
+	return int(atomic.LoadInt64(&r.n))
+}
+
+func (r *registry) idShard(id uint64) *idShard {
+	return r.ids[shardIndex(id)]
+}
+
+func (r *registry) connShard(conn net.Conn) *connShard {
+	// connections are hashed by address, every net.Conn implementation
+	// of the standard library is a pointer
+	v := reflect.ValueOf(conn)
+	if v.Kind() != reflect.Ptr {
+		return r.conns[0]
+	}
+	return r.conns[shardIndex(uint64(v.Pointer()))]
+}
+
+// shardIndex spreads v over the shards with a Fibonacci hash so sequential
+// ids and aligned addresses don't pile up in a few of them
+func shardIndex(v uint64) int {
+	return int((v * 0x9e3779b97f4a7c15) >> (64 - registryShardBits))
+}
+
+// unindex removes sess from the sessions of its id and reports whether it
+// was the last one, the caller must hold mu
+func (s *idShard) unindex(sess *session) bool {
+	sessions := s.sessions[sess.id]
+	for i, other := range sessions {
+		if other == sess {
+			// copy so slices returned by lookup are never modified
+			rest := make([]*session, 0, len(sessions)-1)
+			rest = append(rest, sessions[:i]...)
+			sessions = append(rest, sessions[i+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(s.sessions, sess.id)
+		return true
+	}
+	s.sessions[sess.id] = sessions
+	return false
+}
+
+// snapshot appends the sessions of the shard to dst
+func (s *connShard) snapshot(dst []*session) []*session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sess := range s.sessions {
+		dst = append(dst, sess)
+	}
+	return dst
+}
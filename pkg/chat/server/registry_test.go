@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry(registryHooks{})
+	conns := make([]net.Conn, 3)
+	sessions := make([]*session, 3)
+	for i := range conns {
+		conns[i], _ = net.Pipe()
+		sessions[i] = newSession(uint64(i+1), conns[i], newQueue(1, DropOldest))
+		r.add(sessions[i])
+	}
+	assert.Equal(t, 3, r.len())
+	assert.ElementsMatch(t, []uint64{1, 2, 3}, r.clientIDs())
+
+	// two sessions of the same user
+	left, joined := r.rebind(sessions[2], 1)
+	assert.True(t, left)
+	assert.False(t, joined)
+	assert.Equal(t, []*session{sessions[0], sessions[2]}, r.lookup(1))
+	assert.Empty(t, r.lookup(3))
+	assert.ElementsMatch(t, []uint64{1, 2}, r.clientIDs())
+
+	sess, ok := r.remove(conns[0])
+	assert.True(t, ok)
+	assert.Equal(t, sessions[0], sess)
+	assert.Equal(t, []*session{sessions[2]}, r.lookup(1))
+
+	_, ok = r.remove(conns[0])
+	assert.False(t, ok)
+
+	sess, ok = r.session(conns[2])
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), sess.id)
+	assert.Equal(t, 2, r.len())
+
+	var each []*session
+	r.each(func(sess *session) {
+		each = append(each, sess)
+	})
+	assert.ElementsMatch(t, []*session{sessions[1], sessions[2]}, each)
+}
+
+func TestRegistry_Hooks(t *testing.T) {
+	var events []string
+	r := newRegistry(registryHooks{
+		registered: func(sess *session, first bool) {
+			if first {
+				events = append(events, "joined")
+			}
+		},
+		deregistered: func(sess *session, last bool) {
+			if last {
+				events = append(events, "left")
+			}
+		},
+	})
+
+	a, _ := net.Pipe()
+	b, _ := net.Pipe()
+	r.add(newSession(1, a, newQueue(1, DropOldest)))
+	r.add(newSession(1, b, newQueue(1, DropOldest)))
+	r.remove(a)
+	assert.Equal(t, []string{"joined"}, events)
+	r.remove(b)
+	assert.Equal(t, []string{"joined", "left"}, events)
+}
+
+func TestRegistry_Concurrent(t *testing.T) {
+	r := newRegistry(registryHooks{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			conn, _ := net.Pipe()
+			sess := newSession(id, conn, newQueue(1, DropOldest))
+			r.add(sess)
+			r.rebind(sess, id%10)
+			assert.Contains(t, r.lookup(id%10), sess)
+			r.remove(conn)
+		}(uint64(i))
+	}
+	wg.Wait()
+	assert.Zero(t, r.len())
+	assert.Empty(t, r.clientIDs())
+}
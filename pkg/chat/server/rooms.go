@@ -0,0 +1,113 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+// rooms tracks the members of the chat rooms by client id, a user is a
+// member with all its sessions. A room exists as long as it has members.
+type rooms struct {
+	mu      *sync.RWMutex
+	members map[string]map[uint64]bool
+	joined  map[uint64]map[string]bool
+}
+
+func newRooms() *rooms {
+	return &rooms{
+		mu:      &sync.RWMutex{},
+		members: make(map[string]map[uint64]bool),
+		joined:  make(map[uint64]map[string]bool),
+	}
+}
+
+// join adds id to the members of room, creating the room if needed
+func (r *rooms) join(room string, id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.add(room, id)
+}
+
+func (r *rooms) add(room string, id uint64) {
+	if r.members[room] == nil {
+		r.members[room] = make(map[uint64]bool)
+	}
+	r.members[room][id] = true
+	if r.joined[id] == nil {
+		r.joined[id] = make(map[string]bool)
+	}
+	r.joined[id][room] = true
+}
+
+// part removes id from the members of room, it reports whether id was a
+// member
+func (r *rooms) part(room string, id uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.remove(room, id)
+}
+
+func (r *rooms) remove(room string, id uint64) bool {
+	if !r.members[room][id] {
+		return false
+	}
+	delete(r.members[room], id)
+	if len(r.members[room]) == 0 {
+		delete(r.members, room)
+	}
+	delete(r.joined[id], room)
+	if len(r.joined[id]) == 0 {
+		delete(r.joined, id)
+	}
+	return true
+}
+
+// partAll removes id from all the rooms it joined
+func (r *rooms) partAll(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for room := range r.joined[id] {
+		r.remove(room, id)
+	}
+}
+
+// move hands the memberships of id over to another id, used when a client
+// logs in or resumes an earlier identity
+func (r *rooms) move(from, to uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for room := range r.joined[from] {
+		r.remove(room, from)
+		r.add(room, to)
+	}
+}
+
+func (r *rooms) isMember(room string, id uint64) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.members[room][id]
+}
+
+// memberIDs returns the ids of the members of room in ascending order
+func (r *rooms) memberIDs(room string) []uint64 {
+	r.mu.RLock()
+	ids := make([]uint64, 0, len(r.members[room]))
+	for id := range r.members[room] {
+		ids = append(ids, id)
+	}
+	r.mu.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// names returns the names of the rooms in alphabetical order
+func (r *rooms) names() []string {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.members))
+	for room := range r.members {
+		names = append(names, room)
+	}
+	r.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRooms(t *testing.T) {
+	r := newRooms()
+	r.join("general", 1)
+	r.join("general", 2)
+	r.join("general", 2)
+	r.join("deploys", 2)
+
+	assert.Equal(t, []string{"deploys", "general"}, r.names())
+	assert.Equal(t, []uint64{1, 2}, r.memberIDs("general"))
+	assert.True(t, r.isMember("deploys", 2))
+	assert.False(t, r.isMember("deploys", 1))
+
+	assert.True(t, r.part("general", 1))
+	assert.False(t, r.part("general", 1))
+	assert.Equal(t, []uint64{2}, r.memberIDs("general"))
+
+	r.move(2, 3)
+	assert.Equal(t, []uint64{3}, r.memberIDs("general"))
+	assert.Equal(t, []uint64{3}, r.memberIDs("deploys"))
+
+	r.partAll(3)
+	assert.Empty(t, r.names())
+	assert.Empty(t, r.joined)
+}
@@ -0,0 +1,635 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Start once the server was shut down
+var ErrServerClosed = errors.New("server: server closed")
+
+// Config holds the server options
+type Config struct {
+	Debug bool
+
+	// QueueSize is the number of outbound messages buffered for each
+	// client, DefaultQueueSize is used when it is not set
+	QueueSize int
+	// Overflow decides what happens to messages sent to a client whose
+	// queue is full
+	Overflow OverflowPolicy
+
+	// Store keeps the messages sent to offline clients, a MemoryStore is
+	// used when it is not set
+	Store MessageStore
+	// Users keeps the user accounts, a MemoryUserStore is used when it is
+	// not set
+	Users UserStore
+
+	// Auth checks the credentials of connecting clients, clients are not
+	// required to authenticate when it is not set
+	Auth Authenticator
+
+	// TLS makes the server accept TLS connections only, clients with a
+	// verified certificate may authenticate with it
+	TLS *tls.Config
+	// CertUser maps verified client certificates to the user they log in
+	// to, an empty name authenticates without logging in. CommonNameUser
+	// is used when it is not set.
+	CertUser func(*x509.Certificate) string
+
+	// IdleTimeout is how long a connection may stay silent before it is
+	// considered dead and dropped, idle connections are kept forever when
+	// it is not set. Clients keep their connections alive with PING msgs,
+	// so it should be a few times their keepalive interval.
+	IdleTimeout time.Duration
+
+	// Middleware wraps the handlers of all msgs, see Server.Use
+	Middleware []Middleware
+
+	// Limits are the rate limits of every client, UserLimits override them
+	// for the users logged in with the given names
+	Limits     RateLimits
+	UserLimits map[string]RateLimits
+
+	// MaxConns is the number of connections served at once, MaxConnsPerIP
+	// the number of them from a single address. Connections are not
+	// limited when they are not set.
+	MaxConns      int
+	MaxConnsPerIP int
+	// Deny lists the networks connections are refused from, when Allow is
+	// set connections are only accepted from the networks it lists. Deny
+	// wins over Allow.
+	Deny  []*net.IPNet
+	Allow []*net.IPNet
+}
+
+// Server implements a TCP message server
+type Server struct {
+	config Config
+	debug  bool
+	logger *logrus.Logger
+
+	id      uint64
+	msgID   uint64
+	dropped uint64
+	limited uint64
+	store   MessageStore
+	users   UserStore
+
+	// cl guards the id of the sessions which changes when a client logs
+	// in or resumes an earlier identity, binding an identity holds it
+	// exclusively so no msg sent to the identity meanwhile is lost. The
+	// registry and the rooms have locks of their own.
+	cl      *sync.RWMutex
+	clients *registry
+	rooms   *rooms
+
+	// al guards the msgs waiting for acks, sentAcks indexes their ids by
+	// sender and owedAcks by the recipients which did not ack yet
+	al       *sync.Mutex
+	acks     map[uint64]*pendingAck
+	sentAcks map[*session]map[uint64]bool
+	owedAcks map[uint64]map[uint64]bool
+
+	// hl guards the handlers and the middleware, chain is the middleware
+	// wrapping every handler, inside the one recording the latency metrics
+	hl         *sync.RWMutex
+	handler    map[string]HandlerFunc
+	middleware []Middleware
+	chain      HandlerFunc
+
+	// sl guards the listener and the sessions of all the connections,
+	// authenticated or not, quit is closed once the server shuts down. wg
+	// waits for the connection goroutines. conns counts the connections
+	// admitted, connsPerIP the ones by address.
+	sl         *sync.Mutex
+	listener   net.Listener
+	sessions   map[*session]bool
+	conns      int
+	connsPerIP map[string]int
+	connStats  ConnectionStats
+	// refusing holds a token for every refused connection being told why
+	refusing chan struct{}
+	quit     chan struct{}
+	wg       *sync.WaitGroup
+
+	// metrics are exposed by the metricsServers started with ServeMetrics,
+	// which are guarded by sl
+	metrics        *metrics
+	metricsServers []*http.Server
+}
+
+// New creates and sets up a new server instance configured by opts
+func New(opts ...Option) *Server {
+	var config Config
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return NewWithConfig(config)
+}
+
+// NewWithConfig creates and sets up a new server instance using the given
+// config
+func NewWithConfig(config Config) *Server {
+	if config.Store == nil {
+		config.Store = NewMemoryStore()
+	}
+	if config.Users == nil {
+		config.Users = NewMemoryUserStore()
+	}
+
+	// ids are never handed out twice, not even across restarts
+	id := config.Store.LastID()
+	if config.Users.LastID() > id {
+		id = config.Users.LastID()
+	}
+
+	s := &Server{
+		config:   config,
+		debug:    config.Debug,
+		id:       id,
+		store:    config.Store,
+		users:    config.Users,
+		logger:   logrus.New(),
+		rooms:    newRooms(),
+		handler:  make(map[string]HandlerFunc),
+		acks:     make(map[uint64]*pendingAck),
+		sentAcks: make(map[*session]map[uint64]bool),
+		owedAcks: make(map[uint64]map[uint64]bool),
+		cl:       &sync.RWMutex{},
+		al:       &sync.Mutex{},
+		hl:       &sync.RWMutex{},
+		sl:       &sync.Mutex{},
+		sessions: make(map[*session]bool),
+		quit:     make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+
+		connsPerIP: make(map[string]int),
+		refusing:   make(chan struct{}, maxRefusing),
+		metrics:    newMetrics(),
+	}
+	s.chain = s.metrics.latency.Middleware()(route)
+
+	s.clients = newRegistry(registryHooks{
+		registered:   s.registered,
+		deregistered: s.deregistered,
+	})
+
+	s.logger.SetFormatter(&logrus.TextFormatter{
+		FullTimestamp:   true,
+		TimestampFormat: time.RFC3339,
+	})
+
+	if s.debug {
+		s.logger.SetLevel(logrus.DebugLevel)
+	}
+
+	s.registerHandlers()
+	if config.Auth != nil {
+		s.Use(RequireAuth(protocol.HelloMsg, protocol.AuthMsg, protocol.PingMsg))
+	}
+	s.Use(config.Middleware...)
+
+	return s
+}
+
+func (server *Server) registerHandlers() {
+	server.HandleFunc(protocol.IdentityMsg, server.handleIdentity)
+	server.HandleFunc(protocol.ListMsg, server.handleList)
+	server.HandleFunc(protocol.SendMsg, server.handleSend)
+	server.HandleFunc(protocol.HelloMsg, server.handleHello)
+	server.HandleFunc(protocol.DeliveredMsg, server.handleDelivered)
+	server.HandleFunc(protocol.ResumeMsg, server.handleResume)
+	server.HandleFunc(protocol.LoginMsg, server.handleLogin)
+	server.HandleFunc(protocol.AuthMsg, server.handleAuth)
+	server.HandleFunc(protocol.JoinMsg, server.handleJoin)
+	server.HandleFunc(protocol.PartMsg, server.handlePart)
+	server.HandleFunc(protocol.RoomsMsg, server.handleRooms)
+	server.HandleFunc(protocol.PingMsg, server.handlePing)
+}
+
+// Start will bootstrap and starts the server and connection handling
+// loop. It returns ErrServerClosed once the server was shut down.
+func (server *Server) Start(laddr *net.TCPAddr) error {
+	l, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		return fmt.Errorf("error listening: %s", err)
+	}
+	return server.Serve(l)
+}
+
+// Serve accepts the connections of l and serves them until the server is
+// shut down, l is closed when Serve returns. It returns ErrServerClosed
+// once the server was shut down.
+func (server *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	server.sl.Lock()
+	select {
+	case <-server.quit:
+		server.sl.Unlock()
+		return ErrServerClosed
+	default:
+	}
+	server.listener = l
+	server.sl.Unlock()
+
+	ln := l
+	if server.config.TLS != nil {
+		ln = tls.NewListener(l, server.config.TLS)
+	}
+
+	server.logger.Infof("Listening on %s", l.Addr())
+	if server.debug {
+		server.logger.Debug("Server is running on debug mode.")
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if server.closing() {
+				return ErrServerClosed
+			}
+			server.logger.Errorf("server: failed accepting a connection request: %s", err)
+			continue
+		}
+		server.logger.Debug("server: handle incoming connection")
+		if reason := server.checkIn(conn); reason != "" {
+			server.reject(conn, reason)
+			continue
+		}
+		sess := server.registerClient(conn)
+		if !server.track(sess) {
+			server.deregisterClient(conn)
+			server.checkOut(conn)
+			conn.Close()
+			return ErrServerClosed
+		}
+		go server.handleConnection(sess)
+	}
+}
+
+// track adds sess to the sessions served by the server unless it is
+// shutting down
+func (server *Server) track(sess *session) bool {
+	server.sl.Lock()
+	defer server.sl.Unlock()
+	if server.closing() {
+		return false
+	}
+	server.sessions[sess] = true
+	server.wg.Add(1)
+	return true
+}
+
+func (server *Server) untrack(sess *session) {
+	server.sl.Lock()
+	delete(server.sessions, sess)
+	server.sl.Unlock()
+	server.checkOut(sess.conn)
+	server.wg.Done()
+}
+
+func (server *Server) closing() bool {
+	select {
+	case <-server.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// ListClientIDs returns the current active clients ids, users logged in
+// more than once are listed once
+func (server *Server) ListClientIDs() []uint64 {
+	return server.clients.clientIDs()
+}
+
+// Stop Stops accepting connections and close the existing ones right away,
+// use Shutdown to let the clients finish their requests
+func (server *Server) Stop() error {
+	server.logger.Info("Stop accepting connections and close the existing ones")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := server.Shutdown(ctx)
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+// Shutdown gracefully shuts the server down. It stops accepting
+// connections, pushes a SERVER_SHUTDOWN event to every client and stops
+// reading their requests. The requests being handled, like the fan-out of
+// a SEND msg, finish and their responses are written before the
+// connections are closed. Shutdown returns once all the connections are
+// gone, or closes the remaining ones and returns the context error when
+// ctx expires first.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.sl.Lock()
+	if !server.closing() {
+		close(server.quit)
+	}
+	var err error
+	if server.listener != nil {
+		err = server.listener.Close()
+	}
+	sessions := make([]*session, 0, len(server.sessions))
+	for sess := range server.sessions {
+		sessions = append(sessions, sess)
+	}
+	server.sl.Unlock()
+	server.shutdownMetrics(ctx)
+
+	for _, sess := range sessions {
+		// pushed without waiting, even to clients with a full queue
+		if err := sess.flush(0, protocol.NewServerShutdown(), nil); err != nil {
+			server.logger.Debugf("server: notifying client %d of shutdown failed: %s", sess.clientID(), err)
+		}
+		sess.interrupt()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.wg.Wait()
+		server.closeStores()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		server.sl.Lock()
+		for sess := range server.sessions {
+			sess.conn.Close()
+			sess.cancel()
+		}
+		server.sl.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (server *Server) closeStores() {
+	if err := server.store.Close(); err != nil {
+		server.logger.Errorf("server: closing message store failed: %s", err)
+	}
+	if err := server.users.Close(); err != nil {
+		server.logger.Errorf("server: closing user store failed: %s", err)
+	}
+}
+
+// DroppedMessages returns the number of messages dropped because their
+// recipients were too slow to receive them
+func (server *Server) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&server.dropped)
+}
+
+func (server *Server) registerClient(c net.Conn) *session {
+	out := newQueue(server.config.QueueSize, server.config.Overflow)
+	sess := newSession(atomic.AddUint64(&server.id, 1), c, out)
+	sess.writeTimeout = server.config.IdleTimeout
+	sess.metrics = server.metrics
+	if server.config.Auth != nil {
+		// unauthenticated clients are neither listed nor reachable until
+		// handleAuth admits them
+		return sess
+	}
+	sess.authed = true
+	server.admit(sess)
+	return sess
+}
+
+func (server *Server) admit(sess *session) {
+	server.clients.add(sess)
+}
+
+func (server *Server) deregisterClient(conn net.Conn) {
+	server.clients.remove(conn)
+}
+
+// registered announces clients coming online, it is called by the registry
+func (server *Server) registered(sess *session, first bool) {
+	if first {
+		server.announce(protocol.NewJoined(sess.id, sess.name), sess)
+	}
+}
+
+// deregistered cleans up after sessions which are gone and announces
+// clients going offline, it is called by the registry
+func (server *Server) deregistered(sess *session, last bool) {
+	if last {
+		server.rooms.partAll(sess.id)
+		server.announce(protocol.NewLeft(sess.id), nil)
+	}
+	server.forgetAcks(sess, last)
+}
+
+// announce pushes the presence event m to the clients which agreed on
+// CapPresence but sess
+func (server *Server) announce(m protocol.Message, sess *session) {
+	server.clients.each(func(s *session) {
+		if s != sess && s.hasCap(protocol.CapPresence) {
+			server.deliver(s, 0, m)
+		}
+	})
+}
+
+// HandleFunc registers a new message with associated handler, the given
+// middleware only wraps this handler
+func (server *Server) HandleFunc(name string, f HandlerFunc, middleware ...Middleware) {
+	server.hl.Lock()
+	server.handler[name] = chain(f, middleware)
+	server.hl.Unlock()
+}
+
+// HandleMessage finds the appropriate handler based on msg and passes control
+// to it through the middleware added with Use
+func (server *Server) HandleMessage(name string, ctx *Context) error {
+	server.hl.RLock()
+	h, ok := server.handler[name]
+	next := server.chain
+	server.hl.RUnlock()
+	if !ok {
+		name = protocol.UnknownMsg
+		h = server.handleUnknown
+	}
+	ctx.name = name
+	ctx.handler = h
+	return next(ctx)
+}
+
+// Handler returns the Handler associated with a msg
+func (server *Server) Handler(msg string) (HandlerFunc, bool) {
+	server.hl.RLock()
+	h, ok := server.handler[msg]
+	server.hl.RUnlock()
+	return h, ok
+}
+
+// ClientID returns the unsigned integer  associated with client connection
+func (server *Server) ClientID(conn net.Conn) uint64 {
+	if sess, ok := server.clients.session(conn); ok {
+		return sess.clientID()
+	}
+	return 0
+}
+
+func (server *Server) handleConnection(sess *session) {
+	defer server.untrack(sess)
+	conn := sess.conn
+	r := bufio.NewReader(countingReader{r: conn, n: &sess.limiter.read})
+
+	written := make(chan struct{})
+	go func() {
+		sess.writeLoop()
+		close(written)
+	}()
+
+	err := server.readLoop(sess, r)
+	sess.cancel()
+	switch ne, ok := err.(net.Error); {
+	case server.closing():
+		server.logger.Debug("server: closing connection because the server shuts down")
+	case ok && ne.Timeout():
+		server.metrics.errors.add(errorIdleTimeout, 1)
+		server.logger.Infof("server: dropping client %d from %s: idle for more than %s",
+			server.ClientID(conn), conn.RemoteAddr(), server.config.IdleTimeout)
+	default:
+		if err != io.EOF {
+			server.metrics.errors.add(errorRead, 1)
+		}
+		server.logger.Debug("server: closing connection because: ", err)
+	}
+	server.deregisterClient(conn)
+
+	if server.closing() {
+		// the responses to the requests handled so far are still written
+		sess.hangup()
+	} else {
+		sess.out.close()
+		conn.Close()
+	}
+	<-written
+}
+
+// readLoop reads and handles the msgs of the client until reading fails
+func (server *Server) readLoop(sess *session, r *bufio.Reader) error {
+	server.extendDeadline(sess)
+	if err := server.detectFraming(sess, r); err != nil {
+		return err
+	}
+	// consumed returns the number of bytes of the connection taken by the
+	// msgs read so far
+	consumed := func() int64 {
+		return sess.limiter.read - int64(r.Buffered())
+	}
+	for seq := uint64(1); ; seq++ {
+		server.extendDeadline(sess)
+		start := consumed()
+		ctx, err := server.readMessage(sess, r)
+		if err != nil {
+			return err
+		}
+		ctx.seq = seq
+		name := server.commandName(ctx.msg)
+		ok, err := server.admitMessage(ctx, consumed())
+		if !ok {
+			server.metrics.observeMessage(name, consumed()-start)
+			if err != nil {
+				server.logger.Debug("server: rejecting message failed: ", err)
+			}
+			continue
+		}
+		err = server.HandleMessage(ctx.msg, ctx)
+		server.metrics.observeMessage(name, consumed()-start)
+		if err != nil {
+			server.metrics.errors.add(errorHandler, 1)
+			server.logger.Debug("server: handling message failed: ", err)
+		}
+	}
+}
+
+// extendDeadline gives the client another IdleTimeout to send its next
+// message, silent peers like half-open connections make the read fail
+func (server *Server) extendDeadline(sess *session) {
+	var deadline time.Time
+	if server.config.IdleTimeout > 0 {
+		deadline = time.Now().Add(server.config.IdleTimeout)
+	}
+	sess.setReadDeadline(deadline)
+}
+
+// detectFraming switches the session to the framed protocol when the
+// client starts the connection with protocol.FramePreface
+func (server *Server) detectFraming(sess *session, r *bufio.Reader) error {
+	b, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+	if b[0] != protocol.FramePreface {
+		return nil
+	}
+	if _, err := r.Discard(1); err != nil {
+		return err
+	}
+	sess.setFramed()
+	server.logger.Debug("server: client switched to framed protocol")
+	return nil
+}
+
+// readMessage reads the next message name and, for the framed protocol, its
+// payload from r
+func (server *Server) readMessage(sess *session, r *bufio.Reader) (*Context, error) {
+	ctx := &Context{
+		id:     sess.id,
+		sess:   sess,
+		server: server,
+	}
+	if !sess.isFramed() {
+		msg, id, err := protocol.ReadCommand(r)
+		if err != nil {
+			return nil, err
+		}
+		ctx.msg = msg
+		ctx.reqID = id
+		ctx.r = r
+		return ctx, nil
+	}
+
+	f, err := protocol.ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	ctx.reqID = f.RequestID
+	// the names and arguments of commands are read like in the line format,
+	// malformed ones are handled as unknown COMMAND msgs
+	var m protocol.Command
+	if f.Type == protocol.TypeCommand && m.UnmarshalBinary(f.Payload) == nil {
+		ctx.msg = protocol.CommandName(m.Name)
+		ctx.r = bufio.NewReader(bytes.NewReader(m.Marshal()[len(m.Name)+1:]))
+		return ctx, nil
+	}
+	ctx.msg = f.Type.String()
+	if !f.Type.IsRequest() {
+		// frames only servers send are not handled even when named like
+		// a request, e.g. ROOMS lists
+		ctx.msg = protocol.UnknownMsg
+	}
+	ctx.frame = &f
+	return ctx, nil
+}
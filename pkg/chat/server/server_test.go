@@ -0,0 +1,1799 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/xesina/tcp-chat/pkg/chat/client"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testAddr = "localhost:50005"
+
+type connMock struct {
+	net.Conn
+}
+
+type ServerTestSuite struct {
+	suite.Suite
+	server *Server
+}
+
+func (suite *ServerTestSuite) SetupSuite() {
+	suite.server = New()
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	if err != nil {
+		suite.FailNow("resolving address failed %s", err)
+	}
+
+	go func() {
+		err := suite.server.Start(tcpAddr)
+		defer suite.server.Stop()
+		if err != nil {
+			fmt.Println("starting server failed: ", err)
+			os.Exit(1)
+		}
+	}()
+
+	// wait for the server to start listening
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", testAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	suite.TearDownTest()
+}
+
+// TearDownTest forgets the clients registered by the test so each test
+// starts with an empty server, connections closed by the test are
+// deregistered asynchronously by the server. The rooms are gone with their
+// members.
+func (suite *ServerTestSuite) TearDownTest() {
+	time.Sleep(50 * time.Millisecond)
+	suite.server.clients.each(func(sess *session) {
+		suite.server.clients.remove(sess.conn)
+	})
+}
+
+func TestServerTestSuite(t *testing.T) {
+	suite.Run(t, new(ServerTestSuite))
+}
+
+func (suite *ServerTestSuite) clientsCount() int {
+	return suite.server.clients.len()
+}
+
+func (suite *ServerTestSuite) handlersCount() int {
+	suite.server.hl.RLock()
+	defer suite.server.hl.RUnlock()
+	return len(suite.server.handler)
+}
+
+// resetIDCounter hands out the ids from 1 again, the identities stored by
+// earlier tests are forgotten so they can not collide
+func (suite *ServerTestSuite) resetIDCounter() {
+	atomic.StoreUint64(&suite.server.id, 0)
+	suite.server.store = NewMemoryStore()
+	suite.server.users = NewMemoryUserStore()
+}
+
+func (suite *ServerTestSuite) TestRegisterHandlers() {
+	l := suite.handlersCount()
+
+	// to ensure each time we register handler we update the test to
+	// control the registration of the handlers
+	suite.Equal(12, l)
+}
+
+func (suite *ServerTestSuite) TestRegisterClient() {
+	tt := []struct {
+		conn net.Conn
+	}{
+		{conn: &connMock{}},
+		{conn: &connMock{}},
+		{conn: &connMock{}},
+	}
+
+	for c, tc := range tt {
+		suite.server.registerClient(tc.conn)
+		suite.Equal(c+1, suite.clientsCount())
+	}
+}
+
+func (suite *ServerTestSuite) TestDeregisterClients() {
+	tt := []struct {
+		conn net.Conn
+	}{
+		{conn: &connMock{}},
+		{conn: &connMock{}},
+		{conn: &connMock{}},
+	}
+
+	registerAll := func(conns []struct{ conn net.Conn }) {
+		for _, c := range conns {
+			suite.server.registerClient(c.conn)
+		}
+	}
+
+	deregisterAll := func(conns []struct{ conn net.Conn }) {
+		for _, c := range conns {
+			suite.server.deregisterClient(c.conn)
+		}
+	}
+
+	// test deregister right after a register
+	for _, tc := range tt {
+		suite.server.registerClient(tc.conn)
+		suite.server.deregisterClient(tc.conn)
+		suite.Equal(0, suite.clientsCount())
+	}
+
+	// first register all the clients and then deregister all
+	registerAll(tt)
+	deregisterAll(tt)
+	suite.Equal(0, suite.clientsCount())
+}
+
+func (suite *ServerTestSuite) TestStart() {
+	conn, err := net.Dial("tcp", testAddr)
+	defer conn.Close()
+	suite.NoError(err)
+}
+
+func (suite *ServerTestSuite) TestHandleFunc() {
+	l := suite.handlersCount()
+
+	msgName := "testHandler"
+	testHandler := func(ctx *Context) error { return nil }
+	suite.server.HandleFunc(msgName, testHandler)
+
+	newLen := suite.handlersCount()
+	suite.Equal(l+1, newLen)
+
+	suite.server.hl.RLock()
+	_, ok := suite.server.handler[msgName]
+	suite.True(ok)
+	suite.server.hl.RUnlock()
+
+	suite.server.hl.Lock()
+	delete(suite.server.handler, msgName)
+	suite.server.hl.Unlock()
+}
+
+func (suite *ServerTestSuite) TestHandleUnknown() {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+	suite.NoError(err)
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	unknownMsg := "POOFF\n"
+	_, err = rw.WriteString(unknownMsg)
+	suite.NoError(err)
+	suite.NoError(rw.Flush())
+
+	response, err := protocol.ReadStringArg(rw.Reader)
+	suite.NoError(err)
+	suite.Equal("UNKNOWN MESSAGE", response)
+}
+
+func (suite *ServerTestSuite) TestHandleIdentity() {
+	suite.resetIDCounter()
+
+	cl := client.New()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	err = cl.Connect(tcpAddr)
+	defer cl.Close()
+	suite.NoError(err)
+
+	id, err := cl.WhoAmI()
+	suite.NoError(err)
+	suite.Equal(uint64(1), id)
+}
+
+func (suite *ServerTestSuite) TestListClientIDs() {
+	tt := []struct {
+		conns []*connMock
+		want  []uint64
+	}{
+		{
+			conns: []*connMock{
+				{},
+			},
+			want: []uint64{1},
+		},
+		{
+			conns: []*connMock{},
+			want:  []uint64{},
+		},
+		{
+			conns: []*connMock{
+				{},
+				{},
+				{},
+				{},
+			},
+			want: []uint64{1, 2, 3, 4},
+		},
+	}
+
+	for _, tc := range tt {
+		suite.resetIDCounter()
+
+		for _, conn := range tc.conns {
+			suite.server.registerClient(conn)
+		}
+
+		ids := suite.server.ListClientIDs()
+		suite.Equal(len(tc.want), len(ids))
+		suite.ElementsMatch(tc.want, ids)
+
+		for _, conn := range tc.conns {
+			suite.server.deregisterClient(conn)
+		}
+	}
+}
+
+func (suite *ServerTestSuite) TestHandleListWithSingleClient() {
+	suite.resetIDCounter()
+
+	cl := client.New()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	err = cl.Connect(tcpAddr)
+	defer cl.Close()
+	suite.NoError(err)
+
+	ids, err := cl.ListClientIDs()
+	suite.NoError(err)
+	suite.ElementsMatch([]uint64{}, ids)
+}
+
+func (suite *ServerTestSuite) TestHandleListWithMultipleClient() {
+	suite.resetIDCounter()
+
+	cl1 := client.New()
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	err = cl1.Connect(tcpAddr)
+	defer cl1.Close()
+	suite.NoError(err)
+
+	cl2 := client.New()
+	tcpAddr, err = net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	err = cl2.Connect(tcpAddr)
+	defer cl2.Close()
+	suite.NoError(err)
+
+	cl3 := client.New()
+	tcpAddr, err = net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	err = cl3.Connect(tcpAddr)
+	defer cl3.Close()
+	suite.NoError(err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	expedtedIds := []uint64{1, 3}
+	ids, err := cl2.ListClientIDs()
+	suite.NoError(err)
+	suite.Len(ids, len(expedtedIds))
+	suite.ElementsMatch(expedtedIds, ids)
+
+}
+
+func (suite *ServerTestSuite) TestSendToOneClient() {
+	suite.resetIDCounter()
+
+	cl1 := client.New()
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	err = cl1.Connect(tcpAddr)
+	defer cl1.Close()
+	suite.NoError(err)
+
+	cl1Ch := make(chan client.IncomingMessage)
+	go cl1.HandleIncomingMessages(cl1Ch)
+
+	cl2 := client.New()
+	tcpAddr, err = net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	err = cl2.Connect(tcpAddr)
+	defer cl2.Close()
+	suite.NoError(err)
+
+	cl2Ch := make(chan client.IncomingMessage)
+	go cl2.HandleIncomingMessages(cl2Ch)
+
+	time.Sleep(100 * time.Millisecond)
+
+	receiver := uint64(1)
+	expectedSenderID := uint64(2)
+	expectedBody := "Hello"
+
+	_, err = cl2.SendMsg([]uint64{receiver}, []byte(expectedBody))
+	suite.NoError(err)
+	incomingFromCl2 := <-cl1Ch
+	suite.Equal(incomingFromCl2.SenderID, expectedSenderID)
+	suite.Equal(string(incomingFromCl2.Body), expectedBody)
+}
+
+func (suite *ServerTestSuite) TestSendToTwoClient() {
+	suite.resetIDCounter()
+
+	cl1 := client.New()
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	err = cl1.Connect(tcpAddr)
+	defer cl1.Close()
+	suite.NoError(err)
+
+	cl1Ch := make(chan client.IncomingMessage)
+	go cl1.HandleIncomingMessages(cl1Ch)
+
+	cl2 := client.New()
+	tcpAddr, err = net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	err = cl2.Connect(tcpAddr)
+	defer cl2.Close()
+	suite.NoError(err)
+
+	cl2Ch := make(chan client.IncomingMessage)
+	go cl2.HandleIncomingMessages(cl2Ch)
+
+	cl3 := client.New()
+	tcpAddr, err = net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	err = cl3.Connect(tcpAddr)
+	defer cl3.Close()
+	suite.NoError(err)
+
+	cl3Ch := make(chan client.IncomingMessage)
+	go cl3.HandleIncomingMessages(cl3Ch)
+
+	time.Sleep(100 * time.Millisecond)
+
+	receivers := []uint64{1, 2}
+	expectedSenderID := uint64(3)
+	expectedBody := "Hello"
+
+	_, err = cl3.SendMsg(receivers, []byte(expectedBody))
+	suite.NoError(err)
+
+	incomingFromCl3 := <-cl1Ch
+	suite.Equal(incomingFromCl3.SenderID, expectedSenderID)
+	suite.Equal(string(incomingFromCl3.Body), expectedBody)
+
+	incomingFromCl2 := <-cl2Ch
+	suite.Equal(incomingFromCl2.SenderID, expectedSenderID)
+	suite.Equal(string(incomingFromCl2.Body), expectedBody)
+}
+
+func (suite *ServerTestSuite) TestHandleIdentityFramed() {
+	suite.resetIDCounter()
+
+	cl := client.NewWithConfig(client.Config{Protocol: client.ProtocolFramed})
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	err = cl.Connect(tcpAddr)
+	defer cl.Close()
+	suite.NoError(err)
+
+	id, err := cl.WhoAmI()
+	suite.NoError(err)
+	suite.Equal(uint64(1), id)
+
+	ids, err := cl.ListClientIDs()
+	suite.NoError(err)
+	suite.ElementsMatch([]uint64{}, ids)
+}
+
+func (suite *ServerTestSuite) TestSendFramedToLineClient() {
+	suite.resetIDCounter()
+
+	cl1 := client.NewWithConfig(client.Config{Protocol: client.ProtocolLine})
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	err = cl1.Connect(tcpAddr)
+	defer cl1.Close()
+	suite.NoError(err)
+
+	cl1Ch := make(chan client.IncomingMessage)
+	go cl1.HandleIncomingMessages(cl1Ch)
+
+	cl2 := client.NewWithConfig(client.Config{Protocol: client.ProtocolFramed})
+	err = cl2.Connect(tcpAddr)
+	defer cl2.Close()
+	suite.NoError(err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = cl2.SendMsg([]uint64{1}, []byte("Hello"))
+	suite.NoError(err)
+	incoming := <-cl1Ch
+	suite.Equal(uint64(2), incoming.SenderID)
+	suite.Equal("Hello", string(incoming.Body))
+}
+
+func (suite *ServerTestSuite) TestSendMultilineToLineClient() {
+	suite.resetIDCounter()
+
+	cl1 := client.NewWithConfig(client.Config{Protocol: client.ProtocolLine})
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	err = cl1.Connect(tcpAddr)
+	defer cl1.Close()
+	suite.NoError(err)
+
+	cl1Ch := make(chan client.IncomingMessage, 2)
+	go cl1.HandleIncomingMessages(cl1Ch)
+
+	// framed after the handshake
+	cl2 := client.New()
+	err = cl2.Connect(tcpAddr)
+	defer cl2.Close()
+	suite.NoError(err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// the lines of the body must not pass for msgs of the server
+	res, err := cl2.SendMsg([]uint64{1}, []byte("hi\nSERVER_SHUTDOWN\nX"))
+	suite.NoError(err)
+	suite.Equal([]uint64{1}, res.Failed)
+	suite.Empty(res.Delivered)
+
+	_, err = cl2.SendMsg([]uint64{1}, []byte("Hello"))
+	suite.NoError(err)
+	incoming := <-cl1Ch
+	suite.Equal("Hello", string(incoming.Body))
+	id, err := cl1.WhoAmI()
+	suite.NoError(err)
+	suite.Equal(uint64(1), id)
+}
+
+func (suite *ServerTestSuite) TestClientKeepsUnconsumedMessages() {
+	suite.resetIDCounter()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	// nothing picks up the incoming msgs of cl1
+	cl1 := client.New()
+	suite.NoError(cl1.Connect(tcpAddr))
+	defer cl1.Close()
+	cl2 := client.New()
+	suite.NoError(cl2.Connect(tcpAddr))
+	defer cl2.Close()
+
+	n := client.IncomingBuffer + 10
+	for i := 0; i < n; i++ {
+		_, err = cl2.SendMsg([]uint64{1}, []byte("Hi"))
+		suite.NoError(err)
+	}
+
+	// the responses to cl1 keep flowing
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	id, err := cl1.WhoAmIContext(ctx)
+	suite.NoError(err)
+	suite.Equal(uint64(1), id)
+
+	// and none of the msgs is lost
+	msgs := make(chan client.IncomingMessage, n)
+	go cl1.HandleIncomingMessages(msgs)
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-msgs:
+			suite.Equal([]byte("Hi"), msg.Body)
+		case <-time.After(time.Second):
+			suite.FailNow("incoming message lost", "got %d of %d", i, n)
+		}
+	}
+	suite.Equal(uint64(0), cl1.DroppedMessages())
+}
+
+func (suite *ServerTestSuite) TestSendFramedPreservesBody() {
+	suite.resetIDCounter()
+
+	cl1 := client.NewWithConfig(client.Config{Protocol: client.ProtocolFramed})
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+	err = cl1.Connect(tcpAddr)
+	defer cl1.Close()
+	suite.NoError(err)
+
+	cl1Ch := make(chan client.IncomingMessage)
+	go cl1.HandleIncomingMessages(cl1Ch)
+
+	cl2 := client.NewWithConfig(client.Config{Protocol: client.ProtocolFramed})
+	err = cl2.Connect(tcpAddr)
+	defer cl2.Close()
+	suite.NoError(err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	expectedBody := "  panic: oops\n\tgoroutine 1 [running]:\n"
+	_, err = cl2.SendMsg([]uint64{1}, []byte(expectedBody))
+	suite.NoError(err)
+	incoming := <-cl1Ch
+	suite.Equal(uint64(2), incoming.SenderID)
+	suite.Equal(expectedBody, string(incoming.Body))
+}
+
+func (suite *ServerTestSuite) TestHandleHello() {
+	tt := []struct {
+		given []string
+		want  []string
+	}{
+		{
+			given: []string{"HELLO\n1\nframing,acks,compression\n"},
+			want:  []string{"WELCOME", "1", "framing,acks"},
+		},
+		{
+			given: []string{"HELLO\n1\n\n", "IDENTITY\n"},
+			want:  []string{"WELCOME", "1", "", "1"},
+		},
+		{
+			given: []string{"HELLO\n99\n\n"},
+			want:  []string{"WELCOME", "3", ""},
+		},
+		{
+			given: []string{"HELLO\n0\nframing\n"},
+			want:  []string{"ERR UNSUPPORTED VERSION"},
+		},
+		{
+			given: []string{"IDENTITY\n", "HELLO\n1\n\n"},
+			want:  []string{"1", "ERR HELLO MUST BE FIRST"},
+		},
+	}
+
+	for _, tc := range tt {
+		suite.resetIDCounter()
+		conn, err := net.Dial("tcp", testAddr)
+		suite.NoError(err)
+
+		r := bufio.NewReader(conn)
+		for _, line := range tc.given {
+			_, err = conn.Write([]byte(line))
+			suite.NoError(err)
+		}
+		for _, want := range tc.want {
+			response, err := protocol.ReadStringArg(r)
+			suite.NoError(err)
+			suite.Equal(want, response)
+		}
+		conn.Close()
+		suite.TearDownTest()
+	}
+}
+
+func (suite *ServerTestSuite) TestHandshake() {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	cl := client.New()
+	err = cl.Connect(tcpAddr)
+	defer cl.Close()
+	suite.NoError(err)
+	suite.Equal(protocol.ProtocolVersion, cl.ProtocolVersion())
+	suite.True(cl.HasCapability(protocol.CapFraming))
+
+	legacy := client.NewWithConfig(client.Config{Protocol: client.ProtocolLine})
+	err = legacy.Connect(tcpAddr)
+	defer legacy.Close()
+	suite.NoError(err)
+	suite.False(legacy.HasCapability(protocol.CapFraming))
+
+	time.Sleep(100 * time.Millisecond)
+
+	ids, err := cl.ListClientIDs()
+	suite.NoError(err)
+	suite.Len(ids, 1)
+
+	ids, err = legacy.ListClientIDs()
+	suite.NoError(err)
+	suite.Len(ids, 1)
+}
+
+func (suite *ServerTestSuite) TestHandshakeWithoutFraming() {
+	suite.resetIDCounter()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	cl := client.NewWithConfig(client.Config{Capabilities: []string{}})
+	err = cl.Connect(tcpAddr)
+	defer cl.Close()
+	suite.NoError(err)
+	suite.False(cl.HasCapability(protocol.CapFraming))
+
+	id, err := cl.WhoAmI()
+	suite.NoError(err)
+	suite.Equal(uint64(1), id)
+}
+
+func (suite *ServerTestSuite) TestListWhileReceiving() {
+	suite.resetIDCounter()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	cl1 := client.New()
+	err = cl1.Connect(tcpAddr)
+	defer cl1.Close()
+	suite.NoError(err)
+
+	cl1Ch := make(chan client.IncomingMessage)
+	go cl1.HandleIncomingMessages(cl1Ch)
+
+	cl2 := client.New()
+	err = cl2.Connect(tcpAddr)
+	defer cl2.Close()
+	suite.NoError(err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	const count = 50
+	sendErr := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; i < count && err == nil; i++ {
+			_, err = cl2.SendMsg([]uint64{1}, []byte(fmt.Sprint(i)))
+		}
+		sendErr <- err
+	}()
+
+	for i := 0; i < count; i++ {
+		ids, err := cl1.ListClientIDs()
+		suite.NoError(err)
+		suite.Equal([]uint64{2}, ids)
+
+		incoming := <-cl1Ch
+		suite.Equal(uint64(2), incoming.SenderID)
+		suite.Equal(fmt.Sprint(i), string(incoming.Body))
+	}
+	suite.NoError(<-sendErr)
+}
+
+func (suite *ServerTestSuite) TestSendErrorResponse() {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	// legacy clients get ERR responses, the code is derived from the text
+	configs := []client.Config{{}, {Protocol: client.ProtocolLine}, {Protocol: client.ProtocolFramed}}
+	for _, config := range configs {
+		cl := client.NewWithConfig(config)
+		err = cl.Connect(tcpAddr)
+		suite.NoError(err)
+
+		_, err = cl.SendMsg([]uint64{}, []byte("Hello"))
+		suite.True(errors.Is(err, client.ErrServer))
+		_, err = cl.SendMsg(make([]uint64, 256), []byte("Hello"))
+		var e *client.ServerError
+		suite.True(errors.As(err, &e))
+		suite.Equal(protocol.CodeInvalidRecipients, e.Code)
+		_, err = cl.SendMsgTo(nil, []string{"nobody"}, []byte("Hello"))
+		suite.True(errors.As(err, &e))
+		suite.Equal(protocol.CodeUnknownUser, e.Code)
+		suite.Equal("UNKNOWN USER nobody", e.Text)
+
+		_, err = cl.WhoAmI()
+		suite.NoError(err)
+		cl.Close()
+
+		_, err = cl.WhoAmI()
+		suite.Error(err)
+	}
+}
+
+func (suite *ServerTestSuite) TestErrorCodes() {
+	conn, err := net.Dial("tcp", testAddr)
+	suite.NoError(err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("HELLO\n3\n\n"))
+	suite.NoError(err)
+	r := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		_, err = protocol.ReadStringArg(r)
+		suite.NoError(err)
+	}
+
+	tt := []struct {
+		given string
+		want  string
+	}{
+		{given: "POOFF\n", want: "ERROR 100 UNKNOWN MESSAGE"},
+		{given: "SEND\n\nHi\n", want: "ERROR 101 MALFORMED MESSAGE"},
+		{given: "PART #9\nlobby\n", want: "#9 ERROR 305 NOT IN ROOM"},
+		{given: "LOGIN\n42\n", want: "ERROR 205 INVALID NAME"},
+	}
+	for _, tc := range tt {
+		_, err = conn.Write([]byte(tc.given))
+		suite.NoError(err)
+		response, err := protocol.ReadStringArg(r)
+		suite.NoError(err)
+		suite.Equal(tc.want, response)
+	}
+}
+
+func (suite *ServerTestSuite) TestRequestIDs() {
+	suite.resetIDCounter()
+
+	conn, err := net.Dial("tcp", testAddr)
+	suite.NoError(err)
+	defer conn.Close()
+
+	tt := []struct {
+		given string
+		want  string
+	}{
+		{given: "IDENTITY #9\n", want: "#9 1"},
+		{given: "LIST #10\n", want: "#10"},
+		{given: "LIST\n", want: ""},
+		{given: "SEND #11\n1\nHi\n", want: "#11 DONE"},
+		{given: "SEND #12\n\nHi\n", want: "#12 ERR MALFORMED MESSAGE"},
+		{given: "POOFF #13\n", want: "#13 UNKNOWN MESSAGE"},
+	}
+
+	r := bufio.NewReader(conn)
+	for _, tc := range tt {
+		_, err = conn.Write([]byte(tc.given))
+		suite.NoError(err)
+		response, err := protocol.ReadStringArg(r)
+		suite.NoError(err)
+		suite.Equal(tc.want, response)
+	}
+}
+
+func (suite *ServerTestSuite) TestSendPipelined() {
+	suite.resetIDCounter()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	for _, config := range []client.Config{{}, {Protocol: client.ProtocolLine}} {
+		cl1 := client.New()
+		err = cl1.Connect(tcpAddr)
+		suite.NoError(err)
+		id, err := cl1.WhoAmI()
+		suite.NoError(err)
+
+		cl1Ch := make(chan client.IncomingMessage, 100)
+		go cl1.HandleIncomingMessages(cl1Ch)
+
+		cl2 := client.NewWithConfig(config)
+		err = cl2.Connect(tcpAddr)
+		suite.NoError(err)
+
+		const count = 100
+		done := make(chan *client.Call, count)
+		calls := make(map[*client.Call]bool)
+		for i := 0; i < count; i++ {
+			calls[cl2.SendMsgAsync([]uint64{id}, []byte(fmt.Sprint(i)), done)] = true
+		}
+		listCall := cl2.ListClientIDsAsync(nil)
+
+		for i := 0; i < count; i++ {
+			call := <-done
+			suite.NoError(call.Error)
+			suite.Equal(config.Protocol == client.ProtocolAuto, call.RequestID != 0)
+			suite.True(calls[call])
+			delete(calls, call)
+		}
+		<-listCall.Done
+		suite.NoError(listCall.Error)
+		suite.Contains(listCall.Reply.(*protocol.ClientIDs).IDs, id)
+
+		for i := 0; i < count; i++ {
+			incoming := <-cl1Ch
+			suite.Equal(fmt.Sprint(i), string(incoming.Body))
+		}
+
+		cl1.Close()
+		cl2.Close()
+	}
+}
+
+func (suite *ServerTestSuite) TestSendToStalledClient() {
+	suite.resetIDCounter()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	// the stalled client never reads what the server sends it
+	stalled, err := net.Dial("tcp", testAddr)
+	suite.NoError(err)
+	defer stalled.Close()
+
+	cl1 := client.New()
+	err = cl1.Connect(tcpAddr)
+	suite.NoError(err)
+	defer cl1.Close()
+	id, err := cl1.WhoAmI()
+	suite.NoError(err)
+
+	cl1Ch := make(chan client.IncomingMessage, 100)
+	go cl1.HandleIncomingMessages(cl1Ch)
+
+	cl2 := client.New()
+	err = cl2.Connect(tcpAddr)
+	suite.NoError(err)
+	defer cl2.Close()
+
+	const count = 400
+	body := make([]byte, 64<<10)
+	received := make(chan error)
+	go func() {
+		for i := 0; i < count; i++ {
+			incoming := <-cl1Ch
+			if len(incoming.Body) != len(body) {
+				received <- fmt.Errorf("unexpected body length %d", len(incoming.Body))
+				return
+			}
+		}
+		received <- nil
+	}()
+
+	for i := 0; i < count; i++ {
+		_, err = cl2.SendMsg([]uint64{1, id}, body)
+		suite.NoError(err)
+	}
+
+	select {
+	case err := <-received:
+		suite.NoError(err)
+	case <-time.After(10 * time.Second):
+		suite.Fail("messages to the fast client were stalled")
+	}
+	suite.NotZero(suite.server.DroppedMessages())
+}
+
+func (suite *ServerTestSuite) TestSendResults() {
+	suite.resetIDCounter()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	for _, config := range []client.Config{{}, {Capabilities: []string{}}} {
+		cl1 := client.New()
+		err = cl1.Connect(tcpAddr)
+		suite.NoError(err)
+		id1, err := cl1.WhoAmI()
+		suite.NoError(err)
+
+		cl2 := client.NewWithConfig(config)
+		err = cl2.Connect(tcpAddr)
+		suite.NoError(err)
+		id2, err := cl2.WhoAmI()
+		suite.NoError(err)
+
+		result, err := cl2.SendMsg([]uint64{99, id1, id2, id1}, []byte("Hi"))
+		suite.NoError(err)
+		suite.NotZero(result.MessageID)
+		suite.Equal([]uint64{id1}, result.Delivered)
+		suite.Equal([]uint64{99}, result.Unknown)
+		suite.Equal([]uint64{id2}, result.Failed)
+
+		cl1.Close()
+		cl2.Close()
+		suite.TearDownTest()
+	}
+}
+
+func (suite *ServerTestSuite) TestSendResultsLegacyClient() {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	cl := client.NewWithConfig(client.Config{Protocol: client.ProtocolFramed})
+	err = cl.Connect(tcpAddr)
+	suite.NoError(err)
+	defer cl.Close()
+
+	result, err := cl.SendMsg([]uint64{99}, []byte("Hi"))
+	suite.NoError(err)
+	suite.Zero(result.MessageID)
+	suite.Equal([]uint64{99}, result.Delivered)
+}
+
+func (suite *ServerTestSuite) TestDeliveryAcks() {
+	suite.resetIDCounter()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	acks := []string{protocol.CapFraming, protocol.CapRequestIDs, protocol.CapAcks}
+	for _, config := range []client.Config{
+		{Capabilities: acks},
+		{Protocol: client.ProtocolAuto, Capabilities: []string{protocol.CapAcks}},
+	} {
+		sender := client.NewWithConfig(config)
+		err = sender.Connect(tcpAddr)
+		suite.NoError(err)
+		suite.True(sender.HasCapability(protocol.CapAcks))
+		receipts := make(chan client.DeliveryReceipt, 10)
+		go sender.HandleDeliveryReceipts(receipts)
+
+		recipient := client.NewWithConfig(config)
+		err = recipient.Connect(tcpAddr)
+		suite.NoError(err)
+		recipientID, err := recipient.WhoAmI()
+		suite.NoError(err)
+		incoming := make(chan client.IncomingMessage, 10)
+		go recipient.HandleIncomingMessages(incoming)
+
+		// recipients without acks are delivered to but never acknowledge
+		legacy := client.New()
+		err = legacy.Connect(tcpAddr)
+		suite.NoError(err)
+		legacyID, err := legacy.WhoAmI()
+		suite.NoError(err)
+
+		result, err := sender.SendMsg([]uint64{recipientID, legacyID}, []byte("Hi"))
+		suite.NoError(err)
+		suite.Equal([]uint64{recipientID, legacyID}, result.Delivered)
+
+		msg := <-incoming
+		suite.Equal(result.MessageID, msg.ID)
+
+		select {
+		case receipt := <-receipts:
+			suite.Equal(client.DeliveryReceipt{MessageID: result.MessageID, RecipientID: recipientID}, receipt)
+		case <-time.After(time.Second):
+			suite.Fail("no delivery receipt received")
+		}
+		suite.Equal(0, suite.server.pendingAcks())
+
+		sender.Close()
+		recipient.Close()
+		legacy.Close()
+		suite.TearDownTest()
+	}
+}
+
+func (suite *ServerTestSuite) TestForgetAcks() {
+	sender := newSession(1, connMock{}, newQueue(1, DropOldest))
+	suite.server.expectAcks(1, sender, []uint64{2, 3})
+	suite.server.expectAcks(2, sender, []uint64{2})
+
+	_, ok := suite.server.ack(1, 4)
+	suite.False(ok)
+	s, ok := suite.server.ack(1, 2)
+	suite.True(ok)
+	suite.Equal(sender, s)
+	_, ok = suite.server.ack(1, 2)
+	suite.False(ok)
+
+	suite.server.forgetAcks(newSession(3, connMock{}, newQueue(1, DropOldest)), false)
+	suite.Equal(2, suite.server.pendingAcks())
+	suite.server.forgetAcks(newSession(3, connMock{}, newQueue(1, DropOldest)), true)
+	suite.Equal(1, suite.server.pendingAcks())
+	suite.server.forgetAcks(sender, true)
+	suite.Equal(0, suite.server.pendingAcks())
+	suite.Empty(suite.server.sentAcks)
+	suite.Empty(suite.server.owedAcks)
+}
+
+func (suite *ServerTestSuite) TestPendingAcksCap() {
+	sender := newSession(1, connMock{}, newQueue(1, DropOldest))
+	for id := uint64(1); id <= maxPendingAcks+1; id++ {
+		suite.server.expectAcks(id, sender, []uint64{2})
+	}
+	suite.Equal(maxPendingAcks, suite.server.pendingAcks())
+
+	// the oldest msg stopped waiting
+	_, ok := suite.server.ack(1, 2)
+	suite.False(ok)
+	_, ok = suite.server.ack(maxPendingAcks+1, 2)
+	suite.True(ok)
+	suite.Len(suite.server.owedAcks[2], maxPendingAcks-1)
+
+	suite.server.forgetAcks(sender, false)
+	suite.Equal(0, suite.server.pendingAcks())
+	suite.Empty(suite.server.sentAcks)
+	suite.Empty(suite.server.owedAcks)
+}
+
+func (suite *ServerTestSuite) TestResume() {
+	suite.resetIDCounter()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	for _, config := range []client.Config{{}, {Protocol: client.ProtocolLine}} {
+		offline := client.NewWithConfig(config)
+		err = offline.Connect(tcpAddr)
+		suite.NoError(err)
+		id, token, err := offline.Resume("")
+		suite.NoError(err)
+		offline.Close()
+
+		sender := client.New()
+		err = sender.Connect(tcpAddr)
+		suite.NoError(err)
+		time.Sleep(50 * time.Millisecond)
+
+		result, err := sender.SendMsg([]uint64{id}, []byte("while you were away"))
+		suite.NoError(err)
+		suite.Equal([]uint64{id}, result.Queued)
+
+		_, _, err = sender.Resume("nope")
+		suite.Error(err)
+
+		cl := client.NewWithConfig(config)
+		err = cl.Connect(tcpAddr)
+		suite.NoError(err)
+		resumedID, resumedToken, err := cl.Resume(token)
+		suite.NoError(err)
+		suite.Equal(id, resumedID)
+		suite.Equal(token, resumedToken)
+
+		whoami, err := cl.WhoAmI()
+		suite.NoError(err)
+		suite.Equal(id, whoami)
+
+		// a second connection can not take over a live identity
+		_, _, err = sender.Resume(token)
+		suite.Error(err)
+
+		incoming := make(chan client.IncomingMessage, 10)
+		go cl.HandleIncomingMessages(incoming)
+		msg := <-incoming
+		suite.Equal("while you were away", string(msg.Body))
+
+		result, err = sender.SendMsg([]uint64{id}, []byte("welcome back"))
+		suite.NoError(err)
+		suite.Equal([]uint64{id}, result.Delivered)
+		msg = <-incoming
+		suite.Equal("welcome back", string(msg.Body))
+
+		sender.Close()
+		cl.Close()
+		suite.TearDownTest()
+	}
+}
+
+func (suite *ServerTestSuite) TestLogin() {
+	suite.resetIDCounter()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	connect := func(config client.Config) *client.Client {
+		cl := client.NewWithConfig(config)
+		suite.NoError(cl.Connect(tcpAddr))
+		return cl
+	}
+
+	bob := connect(client.Config{})
+	defer bob.Close()
+	bobID, err := bob.Login("bob")
+	suite.NoError(err)
+
+	// alice is logged in twice, speaking both protocols
+	alice1 := connect(client.Config{})
+	aliceID, err := alice1.Login("alice")
+	suite.NoError(err)
+	alice2 := connect(client.Config{Protocol: client.ProtocolLine})
+	id, err := alice2.Login("alice")
+	suite.NoError(err)
+	suite.Equal(aliceID, id)
+	suite.NotEqual(bobID, aliceID)
+
+	id, name, err := alice2.Identity()
+	suite.NoError(err)
+	suite.Equal(aliceID, id)
+	suite.Equal("alice", name)
+
+	_, err = alice2.Login("bob")
+	suite.Error(err)
+	_, err = alice2.Login("42")
+	suite.Error(err)
+
+	ids, err := bob.ListClientIDs()
+	suite.NoError(err)
+	suite.Equal([]uint64{aliceID}, ids)
+
+	ch1 := make(chan client.IncomingMessage, 10)
+	go alice1.HandleIncomingMessages(ch1)
+	ch2 := make(chan client.IncomingMessage, 10)
+	go alice2.HandleIncomingMessages(ch2)
+
+	result, err := bob.SendMsgTo(nil, []string{"alice"}, []byte("Hi alice"))
+	suite.NoError(err)
+	suite.Equal([]uint64{aliceID}, result.Delivered)
+	for _, ch := range []chan client.IncomingMessage{ch1, ch2} {
+		msg := <-ch
+		suite.Equal(bobID, msg.SenderID)
+		suite.Equal("Hi alice", string(msg.Body))
+	}
+
+	// a user sending to itself reaches its other sessions
+	result, err = alice1.SendMsg([]uint64{aliceID}, []byte("note to self"))
+	suite.NoError(err)
+	suite.Equal([]uint64{aliceID}, result.Delivered)
+	suite.Equal("note to self", string((<-ch2).Body))
+
+	_, err = bob.SendMsgTo(nil, []string{"carol"}, []byte("Hi"))
+	suite.Error(err)
+
+	// msgs for users without any session are kept until they log in
+	alice1.Close()
+	alice2.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	result, err = bob.SendMsgTo(nil, []string{"alice"}, []byte("while you were away"))
+	suite.NoError(err)
+	suite.Equal([]uint64{aliceID}, result.Queued)
+
+	alice3 := connect(client.Config{})
+	defer alice3.Close()
+	id, err = alice3.Login("alice")
+	suite.NoError(err)
+	suite.Equal(aliceID, id)
+
+	ch3 := make(chan client.IncomingMessage, 10)
+	go alice3.HandleIncomingMessages(ch3)
+	suite.Equal("while you were away", string((<-ch3).Body))
+}
+
+func (suite *ServerTestSuite) TestRooms() {
+	suite.resetIDCounter()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	connect := func(config client.Config) *client.Client {
+		cl := client.NewWithConfig(config)
+		suite.NoError(cl.Connect(tcpAddr))
+		return cl
+	}
+
+	alice := connect(client.Config{})
+	defer alice.Close()
+	aliceID, err := alice.Login("alice")
+	suite.NoError(err)
+	// a second session of alice gets the room msgs of the first one
+	alice2 := connect(client.Config{Protocol: client.ProtocolLine})
+	defer alice2.Close()
+	_, err = alice2.Login("alice")
+	suite.NoError(err)
+	bob := connect(client.Config{Protocol: client.ProtocolLine})
+	defer bob.Close()
+	bobID, err := bob.WhoAmI()
+	suite.NoError(err)
+	carol := connect(client.Config{})
+	defer carol.Close()
+
+	suite.NoError(alice.Join("deploys"))
+	suite.NoError(bob.Join("deploys"))
+	suite.NoError(bob.Join("general"))
+	suite.Error(bob.Join("not a room"))
+
+	rooms, err := carol.Rooms()
+	suite.NoError(err)
+	suite.Equal([]string{"deploys", "general"}, rooms)
+
+	_, err = carol.SendToRoom("deploys", []byte("Hi"))
+	suite.Error(err)
+
+	aliceCh := make(chan client.IncomingMessage, 10)
+	go alice2.HandleIncomingMessages(aliceCh)
+	bobCh := make(chan client.IncomingMessage, 10)
+	go bob.HandleIncomingMessages(bobCh)
+
+	result, err := alice.SendToRoom("deploys", []byte("shipping v2"))
+	suite.NoError(err)
+	suite.Equal([]uint64{bobID}, result.Delivered)
+	for _, ch := range []chan client.IncomingMessage{aliceCh, bobCh} {
+		msg := <-ch
+		suite.Equal(aliceID, msg.SenderID)
+		suite.Equal("deploys", msg.Room)
+		suite.Equal("shipping v2", string(msg.Body))
+	}
+
+	// direct msgs carry no room
+	_, err = alice.SendMsg([]uint64{bobID}, []byte("psst"))
+	suite.NoError(err)
+	msg := <-bobCh
+	suite.Equal("", msg.Room)
+
+	suite.NoError(bob.Part("deploys"))
+	suite.Error(bob.Part("deploys"))
+	_, err = bob.SendToRoom("deploys", []byte("Hi"))
+	suite.Error(err)
+	result, err = alice.SendToRoom("deploys", []byte("anyone?"))
+	suite.NoError(err)
+	suite.Empty(result.Delivered)
+
+	// rooms are gone with their last member
+	bob.Close()
+	time.Sleep(50 * time.Millisecond)
+	rooms, err = carol.Rooms()
+	suite.NoError(err)
+	suite.Equal([]string{"deploys"}, rooms)
+}
+
+func (suite *ServerTestSuite) TestPresence() {
+	suite.resetIDCounter()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", testAddr)
+	suite.NoError(err)
+
+	connect := func(config client.Config) *client.Client {
+		cl := client.NewWithConfig(config)
+		suite.NoError(cl.Connect(tcpAddr))
+		return cl
+	}
+	watch := func(config client.Config) (*client.Client, chan client.PresenceEvent) {
+		config.Capabilities = append(config.Capabilities, protocol.CapPresence)
+		cl := connect(config)
+		ch := make(chan client.PresenceEvent, 10)
+		go cl.HandlePresenceEvents(ch)
+		return cl, ch
+	}
+	next := func(ch chan client.PresenceEvent) client.PresenceEvent {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(time.Second):
+			suite.Fail("no presence event")
+			return client.PresenceEvent{}
+		}
+	}
+	quiet := func(ch chan client.PresenceEvent) {
+		select {
+		case e := <-ch:
+			suite.Fail("unexpected presence event", "%+v", e)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	watcher, framed := watch(client.Config{Capabilities: []string{protocol.CapFraming}})
+	defer watcher.Close()
+	watcher, line := watch(client.Config{})
+	defer watcher.Close()
+	suite.True(next(framed).Online)
+
+	bob := connect(client.Config{})
+	bobID, err := bob.WhoAmI()
+	suite.NoError(err)
+	for _, ch := range []chan client.PresenceEvent{framed, line} {
+		suite.Equal(client.PresenceEvent{ClientID: bobID, Online: true}, next(ch))
+	}
+
+	// logging in swaps the anonymous identity for the user
+	userID, err := bob.Login("bob")
+	suite.NoError(err)
+	for _, ch := range []chan client.PresenceEvent{framed, line} {
+		suite.Equal(client.PresenceEvent{ClientID: bobID}, next(ch))
+		suite.Equal(client.PresenceEvent{ClientID: userID, Name: "bob", Online: true}, next(ch))
+	}
+
+	// users are online as long as one of their sessions is
+	bob2 := connect(client.Config{})
+	bob2ID, err := bob2.WhoAmI()
+	suite.NoError(err)
+	suite.Equal(client.PresenceEvent{ClientID: bob2ID, Online: true}, next(framed))
+	_, err = bob2.Login("bob")
+	suite.NoError(err)
+	suite.Equal(client.PresenceEvent{ClientID: bob2ID}, next(framed))
+	quiet(framed)
+
+	bob.Close()
+	quiet(framed)
+	bob2.Close()
+	suite.Equal(client.PresenceEvent{ClientID: userID}, next(framed))
+}
+
+func TestServer_Redeliver(t *testing.T) {
+	server := New()
+	c := newTestContext(server)
+	_, err := server.store.Register(c.id)
+	require.NoError(t, err)
+
+	// offline identities keep their msgs
+	require.NoError(t, server.store.Push(c.id, StoredMessage{Sender: 2, Body: []byte("Hi")}))
+	server.redeliver(c.id)
+
+	// identities which came online while the msgs were stored get them
+	server.clients.add(c.sess)
+	server.redeliver(c.id)
+	assert.Equal(t, []string{"INCOMING\n2\nHi\n"}, responses(c))
+	stored, err := server.store.Drain(c.id)
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	const idleTestAddr = "localhost:50010"
+	server := NewWithConfig(Config{IdleTimeout: 200 * time.Millisecond})
+	tcpAddr, err := net.ResolveTCPAddr("tcp", idleTestAddr)
+	assert.NoError(t, err)
+	go server.Start(tcpAddr)
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", idleTestAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// silent peers, like half-open connections, are dropped
+	raw, err := net.Dial("tcp", idleTestAddr)
+	assert.NoError(t, err)
+	defer raw.Close()
+	r := bufio.NewReader(raw)
+	_, err = raw.Write([]byte("PING\n"))
+	assert.NoError(t, err)
+	line, err := r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "PONG\n", line)
+
+	// while clients pinging the server are kept
+	alive := client.NewWithConfig(client.Config{KeepAlive: 50 * time.Millisecond})
+	assert.NoError(t, alive.Connect(tcpAddr))
+	defer alive.Close()
+	rtt, err := alive.Ping()
+	assert.NoError(t, err)
+	assert.True(t, rtt > 0)
+	assert.Len(t, server.ListClientIDs(), 2)
+
+	time.Sleep(400 * time.Millisecond)
+	assert.Len(t, server.ListClientIDs(), 1)
+	_, err = r.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	_, err = alive.WhoAmI()
+	assert.NoError(t, err)
+}
+
+func TestClient_KeepAlive(t *testing.T) {
+	// the server accepts the connection but never answers
+	l, err := net.Listen("tcp", "localhost:50011")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	c := client.NewWithConfig(client.Config{Protocol: client.ProtocolLine, KeepAlive: 50 * time.Millisecond})
+	assert.NoError(t, c.Connect(l.Addr().(*net.TCPAddr)))
+	defer c.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	_, err = c.WhoAmI()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "keepalive")
+}
+
+func TestClient_Context(t *testing.T) {
+	// the server accepts connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+
+	// the handshake is never answered
+	c := client.New()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err = c.ConnectContext(ctx, addr)
+	cancel()
+	assert.True(t, errors.Is(err, client.ErrTimeout), "%v", err)
+	(<-conns).Close()
+
+	c = client.NewWithConfig(client.Config{Protocol: client.ProtocolLine, KeepAlive: -1})
+	assert.NoError(t, c.ConnectContext(context.Background(), addr))
+	defer c.Close()
+	conn := <-conns
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = c.WhoAmIContext(ctx)
+	cancel()
+	assert.True(t, errors.Is(err, client.ErrTimeout), "%v", err)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = c.SendMsgContext(ctx, []uint64{1}, []byte("Hi"))
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+
+	// calls interrupted by the lost connection fail with ErrClosed
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+	}()
+	_, err = c.ListClientIDs()
+	assert.True(t, errors.Is(err, client.ErrClosed), "%v", err)
+	_, err = c.WhoAmI()
+	assert.True(t, errors.Is(err, client.ErrClosed), "%v", err)
+
+	// the server rejects every request
+	rl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer rl.Close()
+	go func() {
+		conn, err := rl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			conn.Write([]byte("ERR AUTH REQUIRED\n"))
+		}
+	}()
+	c = client.NewWithConfig(client.Config{Protocol: client.ProtocolLine, KeepAlive: -1})
+	assert.NoError(t, c.Connect(rl.Addr().(*net.TCPAddr)))
+	defer c.Close()
+	_, err = c.WhoAmI()
+	assert.True(t, errors.Is(err, client.ErrServer), "%v", err)
+	var e *client.ServerError
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, protocol.CodeAuthRequired, e.Code)
+}
+
+func TestServer_LoginAuthenticated(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+	writePasswordFile(t, path, map[string]string{"alice": "wonderland"})
+	passwords, err := LoadPasswordFile(path)
+	require.NoError(t, err)
+
+	server := NewWithConfig(Config{
+		Auth: Authenticators{passwords, NewBearerTokens(map[string]string{"guest": ""})},
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+	defer server.Stop()
+	addr := l.Addr().(*net.TCPAddr)
+
+	alice := client.New()
+	require.NoError(t, alice.ConnectWithCredentials(addr, client.Credentials{Username: "alice", Password: "wonderland"}))
+	aliceID, err := alice.Login("alice")
+	assert.NoError(t, err)
+	alice.Close()
+
+	// sessions authenticated without a user can not pick one
+	guest := client.New()
+	require.NoError(t, guest.ConnectWithCredentials(addr, client.Credentials{Token: "guest"}))
+	defer guest.Close()
+	_, err = guest.Login("alice")
+	var e *client.ServerError
+	require.True(t, errors.As(err, &e), "%v", err)
+	assert.Equal(t, protocol.CodeAuthRequired, e.Code)
+	id, name, err := guest.Identity()
+	assert.NoError(t, err)
+	assert.NotEqual(t, aliceID, id)
+	assert.Equal(t, "", name)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	start := func(addr string) (*Server, chan struct{}, chan error) {
+		server := New()
+		// SLOW keeps handling until released
+		release := make(chan struct{})
+		server.HandleFunc("SLOW", func(c *Context) error {
+			<-release
+			return c.Reply(protocol.NewDone())
+		})
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		assert.NoError(t, err)
+		started := make(chan error, 1)
+		go func() {
+			started <- server.Start(tcpAddr)
+		}()
+		for i := 0; i < 50; i++ {
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return server, release, started
+	}
+
+	server, release, started := start("localhost:50012")
+	cl := client.New()
+	assert.NoError(t, cl.Connect(&net.TCPAddr{Port: 50012}))
+	defer cl.Close()
+	raw, err := net.Dial("tcp", "localhost:50012")
+	assert.NoError(t, err)
+	defer raw.Close()
+	r := bufio.NewReader(raw)
+	_, err = raw.Write([]byte("SLOW\n"))
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	assert.Equal(t, ErrServerClosed, <-started)
+
+	// clients are told, requests being handled still get their response
+	line, err := r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "SERVER_SHUTDOWN\n", line)
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned before the request was handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	line, err = r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "DONE\n", line)
+	_, err = r.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, <-shutdown)
+
+	_, err = cl.WhoAmI()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "server shutting down")
+	_, err = net.Dial("tcp", "localhost:50012")
+	assert.Error(t, err)
+
+	// connections still busy when the context expires are closed
+	server, release, started = start("localhost:50013")
+	defer close(release)
+	raw, err = net.Dial("tcp", "localhost:50013")
+	assert.NoError(t, err)
+	defer raw.Close()
+	_, err = raw.Write([]byte("SLOW\n"))
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+	assert.Equal(t, ErrServerClosed, <-started)
+	b, err := ioutil.ReadAll(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "SERVER_SHUTDOWN\n", string(b))
+}
+
+func TestClient_ReconnectTimeout(t *testing.T) {
+	// the server answers the handshake of every connection but the second
+	// one, like a server predating it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for i := 1; ; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			if i == 2 {
+				go io.Copy(ioutil.Discard, conn)
+				continue
+			}
+			go func() {
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := r.ReadString('\n'); err != nil {
+						return
+					}
+					conn.Write([]byte(protocol.UnknownMsg + "\n"))
+				}
+			}()
+		}
+	}()
+
+	cl := client.NewWithConfig(client.Config{
+		Reconnect: true,
+		KeepAlive: -1,
+		Backoff:   &client.Backoff{Min: 10 * time.Millisecond, Max: 10 * time.Millisecond},
+	})
+	require.NoError(t, cl.Connect(l.Addr().(*net.TCPAddr)))
+	defer cl.Close()
+	states := make(chan client.StateEvent, 16)
+	go cl.HandleStateChanges(states)
+	(<-conns).Close()
+
+	// the silent server does not stall the client for good
+	for {
+		select {
+		case event := <-states:
+			if event.State != client.StateConnected {
+				continue
+			}
+			assert.Equal(t, 2, event.Attempt)
+			return
+		case <-time.After(3 * time.Second):
+			t.Fatal("the client did not reconnect")
+		}
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	const reconnectTestAddr = "localhost:50014"
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	// the message store, and with it the resume tokens, survives restarts
+	start := func() *Server {
+		store, err := OpenFileStore(path)
+		assert.NoError(t, err)
+		server := NewWithConfig(Config{Store: store})
+		tcpAddr, err := net.ResolveTCPAddr("tcp", reconnectTestAddr)
+		assert.NoError(t, err)
+		go server.Start(tcpAddr)
+		for i := 0; i < 50; i++ {
+			conn, err := net.Dial("tcp", reconnectTestAddr)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return server
+	}
+	connect := func() (*client.Client, chan client.StateEvent) {
+		cl := client.NewWithConfig(client.Config{
+			Reconnect: true,
+			Backoff:   &client.Backoff{Min: 20 * time.Millisecond, Max: 100 * time.Millisecond},
+		})
+		assert.NoError(t, cl.Connect(&net.TCPAddr{Port: 50014}))
+		states := make(chan client.StateEvent, 16)
+		go cl.HandleStateChanges(states)
+		return cl, states
+	}
+	await := func(states chan client.StateEvent, want client.State) client.StateEvent {
+		for {
+			select {
+			case event := <-states:
+				if event.State == want {
+					return event
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatalf("no %s state", want)
+			}
+		}
+	}
+
+	server := start()
+	alice, aliceStates := connect()
+	defer alice.Close()
+	_, err := alice.Login("alice")
+	assert.NoError(t, err)
+	assert.NoError(t, alice.Join("lobby"))
+
+	bob, bobStates := connect()
+	defer bob.Close()
+	bobID, _, err := bob.Resume("")
+	assert.NoError(t, err)
+	assert.NoError(t, bob.Join("lobby"))
+	bobCh := make(chan client.IncomingMessage, 1)
+	go bob.HandleIncomingMessages(bobCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, server.Shutdown(ctx))
+	event := await(aliceStates, client.StateReconnecting)
+	assert.Contains(t, event.Err.Error(), "server shutting down")
+	await(bobStates, client.StateReconnecting)
+
+	// SEND msgs wait for the connection, the other calls fail
+	_, err = alice.WhoAmI()
+	assert.Error(t, err)
+	sent := make(chan *client.SendResult, 1)
+	go func() {
+		result, err := alice.SendToRoom("lobby", []byte("still there?"))
+		assert.NoError(t, err)
+		sent <- result
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	server = start()
+	defer server.Stop()
+	await(aliceStates, client.StateConnected)
+	await(bobStates, client.StateConnected)
+
+	// both are back with their identity and in their rooms
+	_, name, err := alice.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", name)
+	id, err := bob.WhoAmI()
+	assert.NoError(t, err)
+	assert.Equal(t, bobID, id)
+
+	select {
+	case result := <-sent:
+		assert.Equal(t, []uint64{bobID}, result.Delivered)
+	case <-time.After(3 * time.Second):
+		t.Fatal("queued msg was not sent")
+	}
+	select {
+	case msg := <-bobCh:
+		assert.Equal(t, "lobby", msg.Room)
+		assert.Equal(t, "still there?", string(msg.Body))
+	case <-time.After(3 * time.Second):
+		t.Fatal("queued msg was not received")
+	}
+}
+
+func TestServer_ResponseFrames(t *testing.T) {
+	server := New()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	_, err = conn.Write([]byte{protocol.FramePreface})
+	require.NoError(t, err)
+	require.NoError(t, protocol.WriteFrame(conn, protocol.NewHello(protocol.ErrorCodesVersion, nil)))
+	f, err := protocol.ReadFrame(r)
+	require.NoError(t, err)
+	require.Equal(t, protocol.TypeWelcome, f.Type)
+
+	// frames only servers send are unknown, even when named like a request
+	for _, m := range []protocol.Message{
+		protocol.NewRoomList([]string{"ops"}),
+		protocol.NewRoomIncoming(1, "ops", []byte("Hi")),
+		protocol.NewPong(),
+	} {
+		require.NoError(t, protocol.WriteFrame(conn, m))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		f, err := protocol.ReadFrame(r)
+		require.NoError(t, err)
+		require.Equal(t, protocol.TypeError, f.Type, "reply to %s", m.Type())
+		var e protocol.Error
+		require.NoError(t, f.Decode(&e))
+		assert.Equal(t, protocol.CodeUnknownMessage, e.Code)
+	}
+
+	require.NoError(t, protocol.WriteFrame(conn, protocol.NewRooms()))
+	f, err = protocol.ReadFrame(r)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.TypeRoomList, f.Type)
+}
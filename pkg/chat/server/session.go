@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"net"
+	"sync"
+	"time"
+)
+
+// errMultilineBody is returned for msgs which can not be written in the
+// line protocol, a newline in their body would let the rest of it pass for
+// msgs of the server
+var errMultilineBody = errors.New("server: body spans several lines")
+
+// maxScratch is the largest write buffer a session keeps between writes
+const maxScratch = 64 << 10
+
+// session holds the state of a single client connection
+type session struct {
+	// id and name are only changed by the goroutine of the connection
+	// while holding Server.cl, other goroutines read id with clientID. name
+	// is only set once the client logged in.
+	id   uint64
+	name string
+	conn net.Conn
+
+	// wl guards framed and makes encoding and queueing a message atomic
+	// with regard to switching the protocol
+	wl     *sync.Mutex
+	framed bool
+	out    *queue
+
+	// version and caps are agreed on during the HELLO handshake, legacy
+	// clients skipping it get MinProtocolVersion without any capability
+	version uint64
+	caps    map[string]bool
+
+	// authed and authFailures are only used by the handlers of the
+	// connection, authed is set right away when the server requires no
+	// authentication
+	authed       bool
+	authFailures int
+
+	// values holds the state of middleware for the connection, like
+	// authed it is only used by the handlers of the connection
+	values map[interface{}]interface{}
+
+	// limiter enforces the rate limits of the client
+	limiter limiter
+
+	// metrics counts the msgs written to the client, sessions created
+	// without a server have none
+	metrics *metrics
+
+	// writeTimeout bounds how long writing a message may block, peers
+	// which stopped reading are dropped once it expires. Writes never time
+	// out when it is zero.
+	writeTimeout time.Duration
+
+	// interrupted is guarded by wl, it is set once the server stopped
+	// reading the msgs of the client
+	interrupted bool
+
+	// ctx is cancelled once the connection is gone
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newSession(id uint64, conn net.Conn, out *queue) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &session{
+		id:      id,
+		conn:    conn,
+		out:     out,
+		wl:      &sync.Mutex{},
+		version: protocol.MinProtocolVersion,
+		caps:    make(map[string]bool),
+		values:  make(map[interface{}]interface{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// welcome writes the HELLO response and applies the agreed version and
+// capabilities while holding the write lock, so nothing can be written in
+// the old protocol after the client has been told to switch
+func (s *session) welcome(id uint64, m *protocol.Welcome) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	b, err := s.encode(id, m)
+	if err != nil {
+		return err
+	}
+	err = s.out.pushItem(outbound{b: b, typ: m.Type()})
+	if err != nil {
+		return err
+	}
+
+	s.version = m.Version
+	for _, c := range m.Capabilities {
+		s.caps[c] = true
+	}
+	if s.caps[protocol.CapFraming] {
+		s.framed = true
+	}
+	return nil
+}
+
+// clientID returns the id of the session
+func (s *session) clientID() uint64 {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	return s.id
+}
+
+func (s *session) setID(id uint64) {
+	s.wl.Lock()
+	s.id = id
+	s.wl.Unlock()
+}
+
+func (s *session) hasCap(c string) bool {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	return s.caps[c]
+}
+
+func (s *session) protocolVersion() uint64 {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	return s.version
+}
+
+func (s *session) setFramed() {
+	s.wl.Lock()
+	s.framed = true
+	s.wl.Unlock()
+}
+
+func (s *session) isFramed() bool {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	return s.framed
+}
+
+// reply queues m as the response to the request carrying id, it waits
+// while the client is too slow to drain its queue
+func (s *session) reply(id uint64, m protocol.Message) error {
+	s.wl.Lock()
+	b, err := s.encode(id, m)
+	s.wl.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.out.pushItem(outbound{b: b, typ: m.Type()})
+}
+
+// deliver queues a message sent by another client tagged with id, it never
+// waits for a slow client and applies the overflow policy instead
+func (s *session) deliver(id uint64, m protocol.Message) (bool, error) {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	b, err := s.encode(id, m)
+	if err != nil {
+		return false, err
+	}
+	return s.out.offerItem(outbound{b: b, typ: m.Type(), droppable: true})
+}
+
+// deliverFanout queues the msg of f like deliver, tagged with the msg id of
+// f when the client agreed on acks
+func (s *session) deliverFanout(f *fanout) (bool, error) {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	if f.multiline && !s.framed {
+		return false, errMultilineBody
+	}
+	f.retain()
+	return s.out.offerShared(f.encoding(s.framed, s.caps[protocol.CapAcks]), f)
+}
+
+// flush queues the response to the request carrying id followed by msgs
+// without waiting, nothing can be queued in between
+func (s *session) flush(id uint64, m protocol.Message, msgs []protocol.Message) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	items := make([]outbound, 0, len(msgs)+1)
+	b, err := s.encode(id, m)
+	if err != nil {
+		return err
+	}
+	items = append(items, outbound{b: b, typ: m.Type()})
+	for _, m := range msgs {
+		b, err := s.encode(0, m)
+		if err == errMultilineBody {
+			// the msg is dropped, the client could only misread it
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		items = append(items, outbound{b: b, typ: m.Type()})
+	}
+	return s.out.pushAll(items)
+}
+
+// encode marshals m using the protocol spoken by the session, INCOMING
+// msgs with a multiline body can only be written in the framed protocol
+func (s *session) encode(id uint64, m protocol.Message) ([]byte, error) {
+	if !s.framed {
+		if in, ok := m.(*protocol.Incoming); ok && bytes.IndexByte(in.Body(), '\n') >= 0 {
+			return nil, errMultilineBody
+		}
+		return protocol.MarshalWithID(m, id), nil
+	}
+	return protocol.AppendFrameWithID(nil, m, id)
+}
+
+// setReadDeadline sets the deadline for reading the next msg, a zero
+// deadline means no timeout. Once interrupted reads fail right away.
+func (s *session) setReadDeadline(t time.Time) {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	if s.interrupted {
+		return
+	}
+	s.conn.SetReadDeadline(t)
+}
+
+// interrupt makes the pending and all later reads of the connection fail,
+// the msg being handled is not affected
+func (s *session) interrupt() {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	s.interrupted = true
+	s.conn.SetReadDeadline(time.Now())
+}
+
+// hangup closes the connection once the messages already queued, like an
+// error response, have been written
+func (s *session) hangup() {
+	s.out.drain()
+}
+
+// writeLoop writes the queued messages to the connection, it is the only
+// writer of the connection once started and closes it when it stops. The
+// messages queued by the time the writer gets to them are written at once,
+// up to maxBatch of them.
+func (s *session) writeLoop() {
+	defer s.cancel()
+	defer s.conn.Close()
+	var (
+		items   []outbound
+		bufs    net.Buffers
+		scratch []byte
+		ok      bool
+	)
+	for {
+		items, ok = s.out.take(items[:0])
+		if !ok {
+			return
+		}
+		bufs = bufs[:0]
+		for _, item := range items {
+			bufs = item.appendTo(bufs)
+		}
+		if s.writeTimeout > 0 {
+			s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		}
+		var err error
+		scratch, err = s.write(bufs, scratch)
+
+		for i := range bufs {
+			bufs[i] = nil
+		}
+		for i, item := range items {
+			if err == nil && s.metrics != nil {
+				s.metrics.written(item.typ, item.size())
+			}
+			item.release()
+			items[i] = outbound{}
+		}
+		if err != nil {
+			if s.metrics != nil {
+				s.metrics.errors.add(errorWrite, 1)
+			}
+			s.out.close()
+			return
+		}
+	}
+}
+
+// write writes bufs to the connection. TCP connections get them with a
+// single writev, for others like TLS connections they are copied to scratch
+// first so they are not written one by one. It returns scratch for reuse.
+func (s *session) write(bufs net.Buffers, scratch []byte) ([]byte, error) {
+	if _, ok := s.conn.(*net.TCPConn); ok {
+		_, err := bufs.WriteTo(s.conn)
+		return scratch, err
+	}
+	scratch = scratch[:0]
+	for _, b := range bufs {
+		scratch = append(scratch, b...)
+	}
+	_, err := s.conn.Write(scratch)
+	if cap(scratch) > maxScratch {
+		// kept by every connection, large bodies must not stay around
+		scratch = nil
+	}
+	return scratch, err
+}
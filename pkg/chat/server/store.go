@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// MaxStoredMessages is the number of msgs kept for an offline identity,
+// SEND msgs to it fail once it is reached
+const MaxStoredMessages = 1000
+
+var (
+	// ErrUnknownToken is returned when a resume token was never issued
+	ErrUnknownToken = errors.New("server: unknown resume token")
+	// ErrNotRegistered is returned when msgs are stored for an identity
+	// which never asked for a resume token
+	ErrNotRegistered = errors.New("server: identity has no resume token")
+	// ErrStoreFull is returned when an identity has MaxStoredMessages
+	// msgs waiting for it
+	ErrStoreFull = errors.New("server: message store full")
+)
+
+// StoredMessage is a msg kept for an offline recipient
+type StoredMessage struct {
+	Sender uint64
+	Body   []byte
+}
+
+// MessageStore keeps the msgs sent to offline identities until they
+// resume. Only identities which asked for a resume token are stored for,
+// msgs to any other id are unknown once it disconnects.
+type MessageStore interface {
+	// Register issues the resume token of identity id
+	Register(id uint64) (string, error)
+	// Claim returns the identity a resume token was issued for
+	Claim(token string) (uint64, error)
+	// Registered reports whether a resume token was issued for id
+	Registered(id uint64) bool
+	// Push stores m for the offline identity id
+	Push(id uint64, m StoredMessage) error
+	// Drain removes and returns the msgs stored for id in the order they
+	// were pushed
+	Drain(id uint64) ([]StoredMessage, error)
+	// LastID returns the highest identity known to the store so the
+	// server never hands it out to a new connection
+	LastID() uint64
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// MemoryStore is a MessageStore which forgets everything when the server
+// stops
+type MemoryStore struct {
+	mu      *sync.Mutex
+	tokens  map[string]uint64
+	pending map[uint64][]StoredMessage
+	lastID  uint64
+}
+
+// NewMemoryStore creates a new empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mu:      &sync.Mutex{},
+		tokens:  make(map[string]uint64),
+		pending: make(map[uint64][]StoredMessage),
+	}
+}
+
+// Register issues the resume token of identity id
+func (s *MemoryStore) Register(id uint64) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	s.register(id, token)
+	return token, nil
+}
+
+func (s *MemoryStore) register(id uint64, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token] = id
+	if _, ok := s.pending[id]; !ok {
+		s.pending[id] = nil
+	}
+	if id > s.lastID {
+		s.lastID = id
+	}
+}
+
+// Claim returns the identity a resume token was issued for
+func (s *MemoryStore) Claim(token string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.tokens[token]
+	if !ok {
+		return 0, ErrUnknownToken
+	}
+	return id, nil
+}
+
+// Registered reports whether a resume token was issued for id
+func (s *MemoryStore) Registered(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.pending[id]
+	return ok
+}
+
+// Push stores m for the offline identity id
+func (s *MemoryStore) Push(id uint64, m StoredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.pending[id]
+	if !ok {
+		return ErrNotRegistered
+	}
+	if len(pending) >= MaxStoredMessages {
+		return ErrStoreFull
+	}
+	s.pending[id] = append(pending, m)
+	return nil
+}
+
+// Drain removes and returns the msgs stored for id
+func (s *MemoryStore) Drain(id uint64) ([]StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.pending[id]
+	if !ok {
+		return nil, nil
+	}
+	s.pending[id] = nil
+	return pending, nil
+}
+
+// LastID returns the highest identity known to the store
+func (s *MemoryStore) LastID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastID
+}
+
+// Close does nothing for the in-memory store
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempStorePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "tcp-chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "store.log"), func() { os.RemoveAll(dir) }
+}
+
+func TestMessageStore(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+	fs, err := OpenFileStore(path)
+	assert.NoError(t, err)
+	defer fs.Close()
+
+	for _, store := range []MessageStore{NewMemoryStore(), fs} {
+		assert.Equal(t, ErrNotRegistered, store.Push(1, StoredMessage{Sender: 2, Body: []byte("Hi")}))
+		assert.False(t, store.Registered(1))
+
+		token, err := store.Register(3)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, token)
+		assert.True(t, store.Registered(3))
+		assert.Equal(t, uint64(3), store.LastID())
+
+		id, err := store.Claim(token)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(3), id)
+		_, err = store.Claim("nope")
+		assert.Equal(t, ErrUnknownToken, err)
+
+		assert.NoError(t, store.Push(3, StoredMessage{Sender: 1, Body: []byte("one")}))
+		assert.NoError(t, store.Push(3, StoredMessage{Sender: 2, Body: []byte("two")}))
+
+		msgs, err := store.Drain(3)
+		assert.NoError(t, err)
+		assert.Equal(t, []StoredMessage{
+			{Sender: 1, Body: []byte("one")},
+			{Sender: 2, Body: []byte("two")},
+		}, msgs)
+
+		msgs, err = store.Drain(3)
+		assert.NoError(t, err)
+		assert.Empty(t, msgs)
+	}
+}
+
+func TestMessageStore_Full(t *testing.T) {
+	store := NewMemoryStore()
+	_, err := store.Register(1)
+	assert.NoError(t, err)
+	for i := 0; i < MaxStoredMessages; i++ {
+		assert.NoError(t, store.Push(1, StoredMessage{Sender: 2}))
+	}
+	assert.Equal(t, ErrStoreFull, store.Push(1, StoredMessage{Sender: 2}))
+}
+
+func TestFileStore_Replay(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	store, err := OpenFileStore(path)
+	assert.NoError(t, err)
+	token1, err := store.Register(1)
+	assert.NoError(t, err)
+	token7, err := store.Register(7)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Push(1, StoredMessage{Sender: 7, Body: []byte("drained")}))
+	_, err = store.Drain(1)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Push(1, StoredMessage{Sender: 7, Body: []byte("\tkept\n")}))
+	assert.NoError(t, store.Close())
+
+	// a record cut off by a crash is dropped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{recordPush, 1, 10, 'x'})
+	assert.NoError(t, err)
+	f.Close()
+
+	store, err = OpenFileStore(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), store.LastID())
+	id, err := store.Claim(token1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), id)
+	id, err = store.Claim(token7)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), id)
+
+	assert.NoError(t, store.Push(1, StoredMessage{Sender: 7, Body: []byte("after")}))
+	assert.NoError(t, store.Close())
+
+	store, err = OpenFileStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	msgs, err := store.Drain(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []StoredMessage{
+		{Sender: 7, Body: []byte("\tkept\n")},
+		{Sender: 7, Body: []byte("after")},
+	}, msgs)
+}
+
+func TestFileStore_Compact(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+	logSize := func() int64 {
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		return info.Size()
+	}
+
+	store, err := OpenFileStore(path)
+	assert.NoError(t, err)
+	token, err := store.Register(1)
+	assert.NoError(t, err)
+	_, err = store.Register(2)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Push(2, StoredMessage{Sender: 1, Body: []byte("kept")}))
+	assert.NoError(t, store.Push(1, StoredMessage{Sender: 2, Body: make([]byte, compactSize)}))
+	assert.True(t, logSize() > compactSize)
+
+	// drained msgs are gone from the log with the next change
+	msgs, err := store.Drain(1)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.NoError(t, store.Push(1, StoredMessage{Sender: 2, Body: []byte("after")}))
+	assert.True(t, logSize() < 100, "%d", logSize())
+
+	// or once the store is opened again
+	assert.NoError(t, store.Push(2, StoredMessage{Sender: 1, Body: make([]byte, compactSize)}))
+	msgs, err = store.Drain(2)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	assert.NoError(t, store.Close())
+	assert.True(t, logSize() > compactSize)
+
+	store, err = OpenFileStore(path)
+	assert.NoError(t, err)
+	assert.True(t, logSize() < 100, "%d", logSize())
+	defer store.Close()
+	assert.Equal(t, uint64(2), store.LastID())
+	id, err := store.Claim(token)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), id)
+	msgs, err = store.Drain(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []StoredMessage{{Sender: 2, Body: []byte("after")}}, msgs)
+	msgs, err = store.Drain(2)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
+func TestFileStore_Corrupt(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte{42, 1, 0}, 0600))
+	_, err := OpenFileStore(path)
+	assert.Error(t, err)
+}
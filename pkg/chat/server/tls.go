@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"io/ioutil"
+)
+
+// LoadTLSConfig creates the TLS config of a server from the PEM encoded
+// certificate and key files. With a client CA file the certificates
+// presented by clients are verified against it, clients without one are
+// rejected too when requireClientCert is set.
+func LoadTLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("server: loading certificate failed: %s", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	pool, err := loadCertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("server: reading CA file failed: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("server: CA file %s holds no certificate", path)
+	}
+	return pool, nil
+}
+
+// CommonNameUser maps client certificates to the user named by the common
+// name of their subject
+func CommonNameUser(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+// authenticates tells whether clients are logged in by their credentials,
+// either checked by Config.Auth or presented as client certificates
+func (server *Server) authenticates() bool {
+	return server.config.Auth != nil ||
+		server.config.TLS != nil && server.config.TLS.ClientAuth >= tls.VerifyClientCertIfGiven
+}
+
+// certificateUser returns the user name the verified client certificate of
+// sess maps to, connections without TLS or without a verified client
+// certificate can not authenticate with it
+func (server *Server) certificateUser(sess *session) (string, error) {
+	conn, ok := sess.conn.(*tls.Conn)
+	if !ok {
+		return "", ErrAuthFailed
+	}
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", ErrAuthFailed
+	}
+
+	certUser := server.config.CertUser
+	if certUser == nil {
+		certUser = CommonNameUser
+	}
+	name := certUser(state.PeerCertificates[0])
+	if name != "" && !protocol.ValidName(name) {
+		return "", fmt.Errorf("server: certificate maps to invalid user name %q", name)
+	}
+	return name, nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/xesina/tcp-chat/pkg/chat/client"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const tlsTestAddr = "localhost:50009"
+
+// testCA issues certificates signed by a self-signed CA and writes them to
+// PEM files in dir
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// caFile is the PEM file of the CA certificate
+	caFile string
+	serial int64
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	ca := &testCA{t: t, dir: dir}
+	ca.cert, ca.key, ca.caFile, _ = ca.issue("ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "tcp-chat test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+// issue signs template with the CA, or itself when the CA has no
+// certificate yet, and returns the cert and key files
+func (ca *testCA) issue(name string, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parent, signer := ca.cert, ca.key
+	if parent == nil {
+		parent, signer = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+
+	certFile := filepath.Join(ca.dir, name+".crt")
+	keyFile := filepath.Join(ca.dir, name+".key")
+	ca.write(certFile, "CERTIFICATE", der)
+	ca.write(keyFile, "EC PRIVATE KEY", keyDER)
+	return cert, key, certFile, keyFile
+}
+
+func (ca *testCA) write(path, kind string, der []byte) {
+	b := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+}
+
+func (ca *testCA) serverCert(name string) (string, string) {
+	_, _, certFile, keyFile := ca.issue(name, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return certFile, keyFile
+}
+
+func (ca *testCA) clientCert(name string) (string, string) {
+	_, _, certFile, keyFile := ca.issue(name, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return certFile, keyFile
+}
+
+func TestServer_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-chat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.serverCert("server")
+	aliceCert, aliceKey := ca.clientCert("alice")
+	// certificates signed by another CA are not trusted
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "rogue"), 0700))
+	rogue := newTestCA(t, filepath.Join(dir, "rogue"))
+	rogueCert, rogueKey := rogue.clientCert("mallory")
+
+	config, err := LoadTLSConfig(certFile, keyFile, ca.caFile, false)
+	assert.NoError(t, err)
+	server := NewWithConfig(Config{
+		TLS:  config,
+		Auth: NewBearerTokens(map[string]string{"anon": ""}),
+	})
+	tcpAddr, err := net.ResolveTCPAddr("tcp", tlsTestAddr)
+	assert.NoError(t, err)
+	go server.Start(tcpAddr)
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", tlsTestAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	connect := func(caFile, certFile, keyFile string, creds client.Credentials) (*client.Client, error) {
+		config, err := client.LoadTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cl := client.NewWithConfig(client.Config{TLS: config})
+		return cl, cl.ConnectWithCredentials(tcpAddr, creds)
+	}
+
+	// the client certificate logs in to the account named by its subject
+	alice, err := connect(ca.caFile, aliceCert, aliceKey, client.Credentials{Certificate: true})
+	assert.NoError(t, err)
+	defer alice.Close()
+	_, name, err := alice.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", name)
+
+	// clients without a certificate authenticate otherwise
+	anon, err := connect(ca.caFile, "", "", client.Credentials{Token: "anon"})
+	assert.NoError(t, err)
+	defer anon.Close()
+	_, err = anon.SendMsgTo(nil, []string{"alice"}, []byte("Hi"))
+	assert.NoError(t, err)
+	_, err = connect(ca.caFile, "", "", client.Credentials{Certificate: true})
+	assert.Error(t, err)
+
+	// servers signed by an unknown CA are rejected
+	_, err = connect(rogue.caFile, "", "", client.Credentials{Token: "anon"})
+	assert.Error(t, err)
+	// and so are clients with such certificates
+	_, err = connect(ca.caFile, rogueCert, rogueKey, client.Credentials{Certificate: true})
+	assert.Error(t, err)
+
+	// plain TCP clients never get to talk to the server
+	plain := client.New()
+	assert.Error(t, plain.Connect(tcpAddr))
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-chat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.serverCert("server")
+
+	_, err = LoadTLSConfig(certFile, keyFile, "", false)
+	assert.NoError(t, err)
+	config, err := LoadTLSConfig(certFile, keyFile, ca.caFile, true)
+	assert.NoError(t, err)
+	assert.NotNil(t, config.ClientCAs)
+
+	_, err = LoadTLSConfig(certFile, certFile, "", false)
+	assert.Error(t, err)
+	_, err = LoadTLSConfig(certFile, keyFile, keyFile, false)
+	assert.Error(t, err)
+}
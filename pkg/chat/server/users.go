@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrUserExists is returned when an account is created with a name which
+// is already taken
+var ErrUserExists = errors.New("server: user already exists")
+
+// User is a persistent account clients log in to, its id never changes
+// and is shared by all the connections logged in to it
+type User struct {
+	ID   uint64
+	Name string
+}
+
+// UserStore keeps the user accounts
+type UserStore interface {
+	// Create adds the account name with the given id
+	Create(name string, id uint64) (User, error)
+	// Lookup returns the account name
+	Lookup(name string) (User, bool)
+	// LastID returns the highest account id so the server never hands it
+	// out to a new connection
+	LastID() uint64
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// MemoryUserStore is a UserStore which forgets every account when the
+// server stops
+type MemoryUserStore struct {
+	mu     *sync.RWMutex
+	users  map[string]User
+	lastID uint64
+}
+
+// NewMemoryUserStore creates a new empty in-memory user store
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		mu:    &sync.RWMutex{},
+		users: make(map[string]User),
+	}
+}
+
+// Create adds the account name with the given id
+func (s *MemoryUserStore) Create(name string, id uint64) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; ok {
+		return User{}, ErrUserExists
+	}
+	u := User{ID: id, Name: name}
+	s.users[name] = u
+	if id > s.lastID {
+		s.lastID = id
+	}
+	return u, nil
+}
+
+// Lookup returns the account name
+func (s *MemoryUserStore) Lookup(name string) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[name]
+	return u, ok
+}
+
+// LastID returns the highest account id
+func (s *MemoryUserStore) LastID() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastID
+}
+
+// Close does nothing for the in-memory store
+func (s *MemoryUserStore) Close() error {
+	return nil
+}
+
+// FileUserStore is a UserStore which survives restarts, the accounts are
+// appended to a file as `id name` lines
+type FileUserStore struct {
+	mem *MemoryUserStore
+
+	// wl serializes appending to the file
+	wl   *sync.Mutex
+	file *os.File
+}
+
+// OpenFileUserStore opens the user store kept in path, creating it if
+// needed
+func OpenFileUserStore(path string) (*FileUserStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("server: opening user store failed: %s", err)
+	}
+
+	s := &FileUserStore{
+		mem:  NewMemoryUserStore(),
+		wl:   &sync.Mutex{},
+		file: file,
+	}
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var id uint64
+		if len(fields) == 2 {
+			id, err = strconv.ParseUint(fields[0], 10, 64)
+		}
+		if len(fields) != 2 || err != nil {
+			file.Close()
+			return nil, fmt.Errorf("server: user store %s:%d is malformed", path, line)
+		}
+		s.mem.Create(fields[1], id)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("server: reading user store failed: %s", err)
+	}
+	return s, nil
+}
+
+// Create adds the account name with the given id
+func (s *FileUserStore) Create(name string, id uint64) (User, error) {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	if _, ok := s.mem.Lookup(name); ok {
+		return User{}, ErrUserExists
+	}
+	_, err := fmt.Fprintf(s.file, "%d %s\n", id, name)
+	if err != nil {
+		return User{}, fmt.Errorf("server: writing user store failed: %s", err)
+	}
+	return s.mem.Create(name, id)
+}
+
+// Lookup returns the account name
+func (s *FileUserStore) Lookup(name string) (User, bool) {
+	return s.mem.Lookup(name)
+}
+
+// LastID returns the highest account id
+func (s *FileUserStore) LastID() uint64 {
+	return s.mem.LastID()
+}
+
+// Close closes the file
+func (s *FileUserStore) Close() error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestUserStore(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+	fs, err := OpenFileUserStore(path)
+	assert.NoError(t, err)
+	defer fs.Close()
+
+	for _, store := range []UserStore{NewMemoryUserStore(), fs} {
+		_, ok := store.Lookup("alice")
+		assert.False(t, ok)
+
+		u, err := store.Create("alice", 3)
+		assert.NoError(t, err)
+		assert.Equal(t, User{ID: 3, Name: "alice"}, u)
+
+		_, err = store.Create("alice", 4)
+		assert.Equal(t, ErrUserExists, err)
+
+		u, ok = store.Lookup("alice")
+		assert.True(t, ok)
+		assert.Equal(t, uint64(3), u.ID)
+		assert.Equal(t, uint64(3), store.LastID())
+	}
+}
+
+func TestFileUserStore_Reopen(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	store, err := OpenFileUserStore(path)
+	assert.NoError(t, err)
+	_, err = store.Create("alice", 3)
+	assert.NoError(t, err)
+	_, err = store.Create("bob", 9)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	store, err = OpenFileUserStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	u, ok := store.Lookup("bob")
+	assert.True(t, ok)
+	assert.Equal(t, User{ID: 9, Name: "bob"}, u)
+	assert.Equal(t, uint64(9), store.LastID())
+}
+
+func TestFileUserStore_Malformed(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("3 alice\nbob\n"), 0600))
+	_, err := OpenFileUserStore(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,63 @@
+package test
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/xesina/tcp-chat/pkg/chat/client"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"github.com/xesina/tcp-chat/pkg/chat/server"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	srv := server.New(server.WithMaxConns(0, 1))
+	addr := &net.TCPAddr{Port: 50031}
+	go srv.Start(addr)
+	defer srv.Stop()
+
+	first := client.New()
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = first.Connect(addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+
+	// refused during the handshake
+	cl := client.New()
+	err = cl.Connect(addr)
+	assert.True(t, errors.Is(err, client.ErrRefused))
+	var refused *client.RefusedError
+	assert.True(t, errors.As(err, &refused))
+	assert.Equal(t, protocol.RefusedTooManyFromIP, refused.Reason)
+
+	// refused with a frame once the first request is sent
+	for _, config := range []client.Config{{Protocol: client.ProtocolFramed}, {Protocol: client.ProtocolLine}} {
+		cl = client.NewWithConfig(config)
+		assert.NoError(t, cl.Connect(addr))
+		_, err = cl.WhoAmI()
+		assert.True(t, errors.Is(err, client.ErrClosed))
+		assert.True(t, errors.Is(err, client.ErrRefused))
+		cl.Close()
+	}
+
+	first.Close()
+	for i := 0; i < 50; i++ {
+		cl = client.New()
+		if err = cl.Connect(addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	cl.Close()
+
+	stats := srv.ConnectionStats()
+	assert.True(t, stats.Accepted >= 2)
+	assert.True(t, stats.TooManyFromIP >= 3)
+	assert.Equal(t, uint64(0), stats.Full+stats.Denied)
+}
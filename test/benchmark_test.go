@@ -1,20 +1,25 @@
 package test
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"github.com/xesina/tcp-chat/internal/client"
-	"github.com/xesina/tcp-chat/internal/server"
+	"github.com/xesina/tcp-chat/pkg/chat/client"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"github.com/xesina/tcp-chat/pkg/chat/server"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
 
 const clientCount = 100
-const benchmarkServerPort = 50005
+const benchmarkServerPort = 50007
 
 func TestBenchmark(t *testing.T) {
-	srv := server.New(false)
+	srv := server.New()
 	serverAddr := net.TCPAddr{Port: benchmarkServerPort}
 	go func() {
 		err := srv.Start(&serverAddr)
@@ -48,7 +53,8 @@ func TestBenchmark(t *testing.T) {
 			b.ReportAllocs()
 
 			for i := 0; i < b.N; i++ {
-				assert.NoError(b, clients[0].SendMsg(srv.ListClientIDs(), payload))
+				_, err := clients[0].SendMsg(srv.ListClientIDs(), payload)
+				assert.NoError(b, err)
 				for j := 1; j < clientCount; j++ {
 					<-clientChs[j]
 				}
@@ -62,7 +68,8 @@ func TestBenchmark(t *testing.T) {
 		result := testing.Benchmark(func(b *testing.B) {
 			b.ReportAllocs()
 			for i := 0; i < b.N; i++ {
-				assert.NoError(b, clients[0].SendMsg(srv.ListClientIDs(), payload))
+				_, err := clients[0].SendMsg(srv.ListClientIDs(), payload)
+				assert.NoError(b, err)
 				for j := 1; j < clientCount; j++ {
 					<-clientChs[j]
 				}
@@ -83,3 +90,162 @@ func waitForClientsToConnect(t *testing.T, srv *server.Server) {
 	// If even after polling for several seconds, not all clients have connected, stop the test
 	require.Equal(t, clientCount, len(srv.ListClientIDs()))
 }
+
+// BenchmarkFanout measures sending a msg to a room of 1k and 10k members,
+// half of them speaking the line protocol and half the framed one, ns/op is
+// the time until every member has read the msg. The members are served over
+// an in-memory listener, which needs no file descriptor per connection, and
+// over TCP loopback where the server writes with writev. 10k loopback
+// members need more file descriptors than common limits allow, TCP is only
+// measured with 1k.
+func BenchmarkFanout(b *testing.B) {
+	b.Run("pipe", func(b *testing.B) {
+		for _, n := range []int{1000, 10000} {
+			b.Run(fmt.Sprintf("%d recipients", n), func(b *testing.B) {
+				l := newPipeListener()
+				benchmarkFanout(b, l, l.Dial, n)
+			})
+		}
+	})
+	b.Run("tcp", func(b *testing.B) {
+		b.Run("1000 recipients", func(b *testing.B) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(b, err)
+			dial := func() (net.Conn, error) {
+				return net.Dial("tcp", l.Addr().String())
+			}
+			benchmarkFanout(b, l, dial, 1000)
+		})
+	})
+}
+
+func benchmarkFanout(b *testing.B, l net.Listener, dial func() (net.Conn, error), n int) {
+	srv := server.New()
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	var received sync.WaitGroup
+	for i := 0; i < n; i++ {
+		conn, r := joinRoom(b, dial, "bench", i%2 == 0)
+		go readIncoming(conn, r, i%2 == 0, &received)
+	}
+	sender, r := joinRoom(b, dial, "bench", true)
+	defer sender.Close()
+
+	payload := []byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit.")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		received.Add(n)
+		require.NoError(b, protocol.WriteFrame(sender, protocol.NewRoomSend("bench", payload)))
+		f, err := protocol.ReadFrame(r)
+		require.NoError(b, err)
+		require.Equal(b, protocol.TypeDone, f.Type)
+		received.Wait()
+	}
+}
+
+// joinRoom connects with dial and joins room, it returns once the server
+// confirmed
+func joinRoom(b *testing.B, dial func() (net.Conn, error), room string, framed bool) (net.Conn, *bufio.Reader) {
+	conn, err := dial()
+	require.NoError(b, err)
+	r := bufio.NewReader(conn)
+	if !framed {
+		_, err = conn.Write(protocol.NewJoin(room).Marshal())
+		require.NoError(b, err)
+		line, err := r.ReadString('\n')
+		require.NoError(b, err)
+		require.Equal(b, protocol.DoneMsg+"\n", line)
+		return conn, r
+	}
+
+	_, err = conn.Write([]byte{protocol.FramePreface})
+	require.NoError(b, err)
+	require.NoError(b, protocol.WriteFrame(conn, protocol.NewJoin(room)))
+	f, err := protocol.ReadFrame(r)
+	require.NoError(b, err)
+	require.Equal(b, protocol.TypeDone, f.Type)
+	return conn, r
+}
+
+// readIncoming marks every INCOMING msg read from conn as received until
+// the connection is closed
+func readIncoming(conn net.Conn, r *bufio.Reader, framed bool, received *sync.WaitGroup) {
+	defer conn.Close()
+	for {
+		if framed {
+			f, err := protocol.ReadFrame(r)
+			if err != nil {
+				return
+			}
+			if f.Type == protocol.TypeRoomIncoming {
+				received.Done()
+			}
+			continue
+		}
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if line != protocol.IncomingMsg+"\n" {
+			continue
+		}
+		// the sender and the body follow on their own lines
+		for i := 0; i < 2; i++ {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+		}
+		received.Done()
+	}
+}
+
+// pipeListener is an in-memory net.Listener handing out one end of a
+// net.Pipe for every Dial
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Dial() (net.Conn, error) {
+	c, s := net.Pipe()
+	select {
+	case l.conns <- s:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("pipe listener closed")
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("pipe listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/xesina/tcp-chat/pkg/chat/client"
+	"github.com/xesina/tcp-chat/pkg/chat/protocol"
+	"github.com/xesina/tcp-chat/pkg/chat/server"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCustomCommand(t *testing.T) {
+	srv := server.New()
+	srv.HandleFunc("DEPLOY-STATUS", func(c *server.Context) error {
+		env, err := c.ReadArg()
+		if err != nil {
+			return err
+		}
+		if env != "prod" && env != "staging" {
+			return c.ReplyError(protocol.NewErrorDetail(protocol.CodeMalformedMessage, env))
+		}
+		return c.ReplyText(fmt.Sprintf("%s green for %d of %d", env, c.ID(), len(c.Server().ListClientIDs())))
+	})
+	watched := make(chan context.Context, 1)
+	srv.HandleFunc("WATCH", func(c *server.Context) error {
+		watched <- c.Context()
+		return c.ReplyText("watching")
+	})
+
+	addr := &net.TCPAddr{Port: 50017}
+	go srv.Start(addr)
+	defer srv.Stop()
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr.String())
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for _, config := range []client.Config{{}, {Protocol: client.ProtocolLine}} {
+		cl := client.NewWithConfig(config)
+		assert.NoError(t, cl.Connect(addr))
+		id, err := cl.WhoAmI()
+		assert.NoError(t, err)
+
+		status, err := cl.Command("DEPLOY-STATUS", "prod")
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("prod green for %d of 1", id), status)
+		// names are case insensitive in both protocols
+		status, err = cl.Command("deploy-status", "staging")
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("staging green for %d of 1", id), status)
+
+		_, err = cl.Command("DEPLOY-STATUS", "moon")
+		var e *client.ServerError
+		assert.True(t, errors.As(err, &e))
+		assert.Equal(t, protocol.CodeMalformedMessage, e.Code)
+
+		_, err = cl.Command("ROLLBACK")
+		assert.True(t, errors.As(err, &e))
+		assert.Equal(t, protocol.CodeUnknownMessage, e.Code)
+
+		_, err = cl.Command("WATCH")
+		assert.NoError(t, err)
+		ctx := <-watched
+		assert.NoError(t, ctx.Err())
+		cl.Close()
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Error("context not cancelled once the connection closed")
+		}
+	}
+}
@@ -3,17 +3,17 @@ package test
 import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"github.com/xesina/tcp-chat/internal/client"
-	"github.com/xesina/tcp-chat/internal/server"
+	"github.com/xesina/tcp-chat/pkg/chat/client"
+	"github.com/xesina/tcp-chat/pkg/chat/server"
 	"net"
 	"testing"
 	"time"
 )
 
-const serverPort = 50005
+const serverPort = 50006
 
 func TestIntegration(t *testing.T) {
-	srv := server.New(false)
+	srv := server.New()
 
 	serverAddr := net.TCPAddr{Port: serverPort}
 	go func() {
@@ -58,7 +58,8 @@ func TestIntegration(t *testing.T) {
 
 	t.Run("Send message from the first client to the two other clients", func(t *testing.T) {
 		body := []byte("Hello world!")
-		assert.Equal(t, nil, client1.SendMsg([]uint64{2, 3}, body))
+		_, err := client1.SendMsg([]uint64{2, 3}, body)
+		assert.NoError(t, err)
 
 		go client2.HandleIncomingMessages(client2Ch)
 		incomingMessage := <-client2Ch
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/xesina/tcp-chat/pkg/chat/client"
+	"github.com/xesina/tcp-chat/pkg/chat/server"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	srv := server.New()
+	addr := &net.TCPAddr{Port: 50032}
+	go srv.Start(addr)
+	defer srv.Stop()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go srv.ServeMetrics(l)
+
+	sender, receiver := client.New(), client.New()
+	for i := 0; i < 50; i++ {
+		if err = sender.Connect(addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	defer sender.Close()
+	assert.NoError(t, receiver.Connect(addr))
+	defer receiver.Close()
+
+	id, err := receiver.WhoAmI()
+	assert.NoError(t, err)
+	_, err = sender.SendMsg([]uint64{id}, []byte("Hi"))
+	assert.NoError(t, err)
+	incoming := make(chan client.IncomingMessage, 1)
+	go receiver.HandleIncomingMessages(incoming)
+	select {
+	case <-incoming:
+	case <-time.After(time.Second):
+		t.Fatal("msg not received")
+	}
+
+	res, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Type"), "text/plain; version=0.0.4")
+	b, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	body := string(b)
+
+	for _, line := range []string{
+		"# TYPE tcpchat_connected_clients gauge\ntcpchat_connected_clients 2\n",
+		"tcpchat_connections_accepted_total 2\n",
+		`tcpchat_connections_rejected_total{reason="server_full"} 0`,
+		`tcpchat_messages_received_total{command="HELLO"} 2`,
+		`tcpchat_messages_received_total{command="SEND"} 1`,
+		`tcpchat_messages_sent_total{command="INCOMING"} 1`,
+		`tcpchat_sent_bytes_total{command="INCOMING"} `,
+		`tcpchat_received_bytes_total{command="SEND"} `,
+		`tcpchat_send_fanout_size_bucket{le="1"} 1`,
+		"tcpchat_send_fanout_size_count 1\n",
+		`tcpchat_handler_duration_seconds_count{command="SEND"} 1`,
+		"# TYPE tcpchat_write_queue_depth gauge\n",
+		`tcpchat_errors_total{type="queue_overflow"} 0`,
+	} {
+		assert.Contains(t, body, line)
+	}
+
+	assert.NoError(t, srv.Stop())
+	_, err = http.Get("http://" + l.Addr().String() + "/metrics")
+	assert.Error(t, err)
+}